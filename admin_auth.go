@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	adminRoleReader   = "reader"
+	adminRoleDeployer = "deployer"
+
+	adminIdentityKey = "adminIdentity"
+
+	adminAuthMethodToken = "token"
+	adminAuthMethodHMAC  = "hmac"
+
+	hmacKeyIDHeader     = "X-RMF-Key-Id"
+	hmacTimestampHeader = "X-RMF-Timestamp"
+	hmacSignatureHeader = "X-RMF-Signature"
+	hmacMaxClockSkew    = 5 * time.Minute
+
+	adminMaxBodySize = 32 * 1024 * 1024 // install params carry the framework runtimes
+)
+
+// adminRoleLevels a role can do everything which the lower levels can do
+var adminRoleLevels = map[string]int{
+	adminRoleReader:   1,
+	adminRoleDeployer: 2,
+}
+
+// AdminToken a bearer token for the admin API
+type AdminToken struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+	Role  string `yaml:"role"`
+}
+
+// AdminHMACKey a shared secret for HMAC-signed admin requests
+type AdminHMACKey struct {
+	KeyID  string `yaml:"keyId"`
+	Secret string `yaml:"secret"`
+	Role   string `yaml:"role"`
+}
+
+// AdminIdentity the authenticated caller of the admin API
+type AdminIdentity struct {
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	Method string `json:"method"`
+}
+
+// HasRole check the identity's role covers the required one
+func (identity *AdminIdentity) HasRole(role string) bool {
+	level, ok := adminRoleLevels[identity.Role]
+	return ok && level >= adminRoleLevels[role]
+}
+
+// hmacSignatureCache the signatures accepted in the clock skew, a replayed request is rejected
+type hmacSignatureCache struct {
+	mutex      sync.Mutex
+	expiration map[string]time.Time // key ID + signature to the time it's no longer accepted
+}
+
+var hmacSeenSignatures = &hmacSignatureCache{expiration: map[string]time.Time{}}
+
+// checkAndAdd add the signature, return false if it's seen. The expired ones are dropped
+func (cache *hmacSignatureCache) checkAndAdd(key string, expiration time.Time, now time.Time) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if seen, ok := cache.expiration[key]; ok && now.Before(seen) {
+		return false
+	}
+
+	for seenKey, seen := range cache.expiration {
+		if !now.Before(seen) {
+			delete(cache.expiration, seenKey)
+		}
+	}
+
+	cache.expiration[key] = expiration
+	return true
+}
+
+func abortAdminAuth(ctx *gin.Context, status int, message string) {
+	if status == http.StatusUnauthorized {
+		ctx.Header("WWW-Authenticate", `Bearer realm="rmf-admin"`)
+	}
+
+	ctx.AbortWithStatusJSON(status, gin.H{
+		"error": message,
+	})
+}
+
+// adminAuthMiddleware authenticate the caller, then authorize it for the role
+func adminAuthMiddleware(role string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		identity, err := authenticateAdmin(ctx, currentSiteConfig())
+
+		if err != nil {
+			abortAdminAuth(ctx, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		if !identity.HasRole(role) {
+			abortAdminAuth(ctx, http.StatusForbidden,
+				fmt.Sprintf("Role '%s' of '%s' is not allowed, require role '%s'", identity.Role, identity.Name, role))
+			return
+		}
+
+		ctx.Set(adminIdentityKey, identity)
+		ctx.Next()
+	}
+}
+
+// adminIdentityFromContext Get the authenticated admin from context
+func adminIdentityFromContext(ctx *gin.Context) *AdminIdentity {
+	if v, ok := ctx.Get(adminIdentityKey); ok {
+		return v.(*AdminIdentity)
+	}
+
+	return nil
+}
+
+// adminActor the authenticated admin's name, as the actor of the changes
+func adminActor(ctx *gin.Context) string {
+	if identity := adminIdentityFromContext(ctx); identity != nil {
+		return identity.Name
+	}
+
+	return ""
+}
+
+func authenticateAdmin(ctx *gin.Context, conf *SiteConfig) (*AdminIdentity, error) {
+	if keyID := ctx.GetHeader(hmacKeyIDHeader); keyID != "" {
+		return authenticateAdminHMAC(ctx, conf, keyID)
+	}
+
+	authorization := ctx.GetHeader("Authorization")
+
+	if authorization == "" {
+		return nil, fmt.Errorf("Missing credentials, require a bearer token or a HMAC signature")
+	}
+
+	const bearerPrefix = "Bearer "
+
+	if len(authorization) <= len(bearerPrefix) || !strings.EqualFold(authorization[:len(bearerPrefix)], bearerPrefix) {
+		return nil, fmt.Errorf("Invalid Authorization header, require a bearer token")
+	}
+
+	token := []byte(strings.TrimSpace(authorization[len(bearerPrefix):]))
+
+	for _, item := range conf.AdminTokens {
+		if item.Token != "" && subtle.ConstantTimeCompare(token, []byte(item.Token)) == 1 {
+			return &AdminIdentity{Name: item.Name, Role: item.Role, Method: adminAuthMethodToken}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Invalid token")
+}
+
+func authenticateAdminHMAC(ctx *gin.Context, conf *SiteConfig, keyID string) (*AdminIdentity, error) {
+	var key *AdminHMACKey
+
+	for i := range conf.AdminHMACKeys {
+		if conf.AdminHMACKeys[i].KeyID == keyID && conf.AdminHMACKeys[i].Secret != "" {
+			key = &conf.AdminHMACKeys[i]
+			break
+		}
+	}
+
+	if key == nil {
+		return nil, fmt.Errorf("Unknown HMAC key '%s'", keyID)
+	}
+
+	timestamp := ctx.GetHeader(hmacTimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s header, require unix seconds", hmacTimestampHeader)
+	}
+
+	if skew := time.Since(time.Unix(seconds, 0)); skew > hmacMaxClockSkew || skew < -hmacMaxClockSkew {
+		return nil, fmt.Errorf("Expired HMAC signature, the clock skew is %v", skew.Round(time.Second))
+	}
+
+	signature, err := hex.DecodeString(ctx.GetHeader(hmacSignatureHeader))
+
+	if err != nil || len(signature) == 0 {
+		return nil, fmt.Errorf("Invalid %s header, require a hex string", hmacSignatureHeader)
+	}
+
+	// read the body for signing, and leave it for the handler
+	body := []byte{}
+
+	if ctx.Request.Body != nil {
+		body, err = ioutil.ReadAll(http.MaxBytesReader(ctx.Writer, ctx.Request.Body, adminMaxBodySize))
+
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read the request body, at most %d bytes", adminMaxBodySize)
+		}
+
+		ctx.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	expected := signAdminRequest(key.Secret, ctx.Request.Method, ctx.Request.URL.RequestURI(), timestamp, body)
+
+	if !hmac.Equal(signature, expected) {
+		return nil, fmt.Errorf("Invalid HMAC signature")
+	}
+
+	// a signature is accepted once, until it expires by the clock skew
+	if !hmacSeenSignatures.checkAndAdd(key.KeyID+"\x00"+hex.EncodeToString(signature),
+		time.Unix(seconds, 0).Add(hmacMaxClockSkew), time.Now()) {
+		return nil, fmt.Errorf("Replayed HMAC signature, sign each request with a new timestamp")
+	}
+
+	return &AdminIdentity{Name: key.KeyID, Role: key.Role, Method: adminAuthMethodHMAC}, nil
+}
+
+// signAdminRequest HMAC-SHA256 of "{method}\n{requestURI}\n{timestamp}\n{body}"
+func signAdminRequest(secret, method, requestURI, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + requestURI + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// warnAdminCredentials log the missing credentials, which reject all admin calls
+func warnAdminCredentials(conf *SiteConfig) {
+	if len(conf.AdminTokens) == 0 && len(conf.AdminHMACKeys) == 0 {
+		log.Printf("[WARN]  No adminTokens or adminHMACKeys in site config, the admin API rejects all calls\n")
+	}
+}
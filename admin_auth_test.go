@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_adminAuthMiddleware_hmac(t *testing.T) {
+	previous := currentSiteConfig()
+	defer storeSiteConfig(previous)
+
+	conf := previous.Clone()
+	conf.AdminHMACKeys = []AdminHMACKey{{KeyID: "ci", Secret: "s3cret", Role: adminRoleDeployer}}
+	storeSiteConfig(conf)
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.POST("/api/metadata/install", adminAuthMiddleware(adminRoleDeployer), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	post := func(body string, signedBody string) int {
+		request := httptest.NewRequest(http.MethodPost, "/api/metadata/install", strings.NewReader(body))
+		request.Header.Set(hmacKeyIDHeader, "ci")
+		request.Header.Set(hmacTimestampHeader, timestamp)
+		request.Header.Set(hmacSignatureHeader, hex.EncodeToString(
+			signAdminRequest("s3cret", http.MethodPost, "/api/metadata/install", timestamp, []byte(signedBody))))
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	if code := post(`{"a":1}`, `{"a":1}`); code != http.StatusOK {
+		t.Errorf("signed request = %d, want %d", code, http.StatusOK)
+	}
+
+	if code := post(`{"a":1}`, `{"a":1}`); code != http.StatusUnauthorized {
+		t.Errorf("replayed request = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	if code := post(`{"a":2}`, `{"a":3}`); code != http.StatusUnauthorized {
+		t.Errorf("request with a wrong signature = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	large := strings.Repeat("x", adminMaxBodySize+1)
+
+	if code := post(large, large); code != http.StatusUnauthorized {
+		t.Errorf("request with a too large body = %d, want %d", code, http.StatusUnauthorized)
+	}
+}
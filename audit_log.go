@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	auditMaxPayloadSize = 256 * 1024 // larger payloads are recorded by size only
+	auditDefaultLimit   = 100
+	auditMaxRejected    = 60 // rejected calls recorded in a minute, the more are only counted in the log
+)
+
+// AuditRecord one admin call, or one change made by the server itself
+type AuditRecord struct {
+	Time        time.Time       `json:"time"`
+	Identity    *AdminIdentity  `json:"identity"` // nil if not authenticated
+	ClientIP    string          `json:"clientIP,omitempty"`
+	Action      string          `json:"action"` // the API path
+	Services    []string        `json:"services,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	PayloadSize int             `json:"payloadSize"`
+	Status      int             `json:"status"`
+	Result      json.RawMessage `json:"result,omitempty"`
+}
+
+// AuditQuery the filters of querying the audit log, the zero values match all
+type AuditQuery struct {
+	ServiceName string
+	Since       time.Time
+	Until       time.Time
+	Limit       int
+}
+
+// AuditLog append-only JSON lines file of the admin calls
+type AuditLog struct {
+	mutex    sync.Mutex
+	filename string
+	file     *os.File
+
+	rejectedMutex   sync.Mutex
+	rejectedSince   time.Time // the start of the minute
+	rejectedCount   int
+	rejectedDropped int
+}
+
+// OpenAuditLog open (or create) the audit log for appending
+func OpenAuditLog(filename string) (*AuditLog, error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuditLog{filename: filename, file: file}, nil
+}
+
+// Append write the record and flush it to disk. Nothing to do if the audit log is disabled (nil)
+func (auditLog *AuditLog) Append(record *AuditRecord) error {
+	if auditLog == nil {
+		return nil
+	}
+
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+
+	line, err := json.Marshal(record)
+
+	if err != nil {
+		return err
+	}
+
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+
+	if _, err = auditLog.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	return auditLog.file.Sync()
+}
+
+// Close close the audit log file if it's enabled
+func (auditLog *AuditLog) Close() error {
+	if auditLog == nil {
+		return nil
+	}
+
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+
+	return auditLog.file.Close()
+}
+
+// Query the matched records, the newest first
+func (auditLog *AuditLog) Query(query *AuditQuery) ([]AuditRecord, error) {
+	res := []AuditRecord{}
+
+	if auditLog == nil {
+		return res, nil
+	}
+
+	file, err := os.Open(auditLog.filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	limit := query.Limit
+
+	if limit <= 0 {
+		limit = auditDefaultLimit
+	}
+
+	reader := bufio.NewReader(file)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		var record AuditRecord
+
+		// skip the broken line, usually the last one written partly while crashing
+		if len(line) > 0 && json.Unmarshal(line, &record) == nil && query.match(&record) {
+			res = append(res, record)
+
+			// keep the recent ones only
+			if len(res) > limit*2 {
+				res = append([]AuditRecord(nil), res[len(res)-limit:]...)
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	if len(res) > limit {
+		res = res[len(res)-limit:]
+	}
+
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Time.After(res[j].Time) })
+	return res, nil
+}
+
+func (query *AuditQuery) match(record *AuditRecord) bool {
+	if !query.Since.IsZero() && record.Time.Before(query.Since) {
+		return false
+	}
+
+	if !query.Until.IsZero() && record.Time.After(query.Until) {
+		return false
+	}
+
+	if query.ServiceName == "" {
+		return true
+	}
+
+	for _, serviceName := range record.Services {
+		if serviceName == query.ServiceName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// auditServiceNames the sorted values of "serviceName" anywhere in the JSON payload
+func auditServiceNames(payload []byte) []string {
+	var value interface{}
+
+	if json.Unmarshal(payload, &value) != nil {
+		return nil
+	}
+
+	serviceMap := map[string]bool{}
+	var walk func(value interface{})
+
+	walk = func(value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for key, item := range v {
+				if name, ok := item.(string); ok && key == "serviceName" && name != "" {
+					serviceMap[name] = true
+				} else {
+					walk(item)
+				}
+			}
+		case []interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		}
+	}
+
+	walk(value)
+
+	services := []string{}
+
+	for serviceName := range serviceMap {
+		services = append(services, serviceName)
+	}
+
+	sort.Strings(services)
+	return services
+}
+
+// auditWriter copy the response for the audit record
+type auditWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *auditWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *auditWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// auditBody copy what the auth and the handler read from the request body, nothing is read ahead
+type auditBody struct {
+	io.ReadCloser
+	data bytes.Buffer
+}
+
+func (b *auditBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.data.Write(p[:n])
+	return n, err
+}
+
+// auditMiddleware write each changing admin call (not GET) to the audit log, also the rejected ones.
+// The body is only copied while being read, at most adminMaxBodySize, so a call rejected by the auth
+// costs nothing. Rejected calls are recorded without the payload, which comes from an unknown caller, and
+// at most auditMaxRejected in a minute.
+func auditMiddleware(auditLog *AuditLog) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if auditLog == nil || c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		body := &auditBody{ReadCloser: http.MaxBytesReader(c.Writer, c.Request.Body, adminMaxBodySize)}
+		c.Request.Body = body
+		writer := &auditWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+
+		c.Next()
+
+		payload := body.data.Bytes()
+		record := &AuditRecord{
+			Time:        start,
+			Identity:    adminIdentityFromContext(c),
+			ClientIP:    getClientIP(c),
+			Action:      c.Request.URL.Path,
+			PayloadSize: len(payload),
+			Status:      writer.Status(),
+		}
+
+		if record.Identity != nil {
+			record.Services = auditServiceNames(payload)
+
+			if len(payload) <= auditMaxPayloadSize && json.Valid(payload) {
+				record.Payload = payload
+			}
+		}
+
+		if result := writer.body.Bytes(); json.Valid(result) {
+			record.Result = result
+		}
+
+		if record.Identity == nil && !auditLog.allowRejected(start) {
+			return
+		}
+
+		if err := auditLog.Append(record); err != nil {
+			log.Printf("[ERROR]  Cannot write audit log for '%s': %v\n", record.Action, err)
+		}
+	}
+}
+
+// allowRejected check a rejected call can be recorded in the minute, then an unknown caller can't fill the disk
+// or hold the file. The dropped ones are logged when the minute ends.
+func (auditLog *AuditLog) allowRejected(now time.Time) bool {
+	auditLog.rejectedMutex.Lock()
+	defer auditLog.rejectedMutex.Unlock()
+
+	if now.Sub(auditLog.rejectedSince) >= time.Minute {
+		if auditLog.rejectedDropped > 0 {
+			log.Printf("[WARN]  Audit log: %d rejected calls not recorded since %s\n", auditLog.rejectedDropped,
+				auditLog.rejectedSince.Format(time.RFC3339))
+		}
+
+		auditLog.rejectedSince = now
+		auditLog.rejectedCount = 0
+		auditLog.rejectedDropped = 0
+	}
+
+	if auditLog.rejectedCount >= auditMaxRejected {
+		auditLog.rejectedDropped++
+		return false
+	}
+
+	auditLog.rejectedCount++
+	return true
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rmf-audit")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	auditLog, err := OpenAuditLog(filepath.Join(dir, "audit.jsonl"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer auditLog.Close()
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	group := engine.Group("/api/metadata").Use(auditMiddleware(auditLog))
+	group.POST("/update-app-extra", func(c *gin.Context) {
+		c.Set(adminIdentityKey, &AdminIdentity{Name: "ci-deployer", Role: adminRoleDeployer, Method: adminAuthMethodToken})
+		ioutil.ReadAll(c.Request.Body)
+		c.JSON(http.StatusOK, gin.H{"update": true})
+	})
+
+	start := time.Now().Add(-time.Second)
+
+	for _, payload := range []string{
+		`[{"serviceName":"rmf-checkout","gitRevision":{"tag":"v2"},"extra":{"activationPercent":"100"}}]`,
+		`[{"serviceName":"rmf-home","gitRevision":{"tag":"v1"},"extra":{}}]`,
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/api/metadata/update-app-extra", strings.NewReader(payload))
+		request.RemoteAddr = "10.0.0.1:1234"
+		engine.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	records, err := auditLog.Query(&AuditQuery{ServiceName: "rmf-checkout", Since: start})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 1 {
+		t.Fatalf("Query() got %d records, want 1", len(records))
+	}
+
+	record := records[0]
+
+	if record.Identity == nil || record.Identity.Name != "ci-deployer" || record.ClientIP != "10.0.0.1" ||
+		record.Status != http.StatusOK || !reflect.DeepEqual(record.Services, []string{"rmf-checkout"}) ||
+		!strings.Contains(string(record.Payload), `"activationPercent":"100"`) || string(record.Result) != `{"update":true}` {
+		t.Errorf("Query() = %+v", record)
+	}
+
+	if records, _ := auditLog.Query(&AuditQuery{Until: start}); len(records) != 0 {
+		t.Errorf("Query() before the calls got %d records, want 0", len(records))
+	}
+
+	if records, _ := auditLog.Query(&AuditQuery{Limit: 1}); len(records) != 1 || records[0].Services[0] != "rmf-home" {
+		t.Errorf("Query() the newest = %+v, want rmf-home", records)
+	}
+}
+
+func TestAuditMiddleware_rejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rmf-audit")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	auditLog, err := OpenAuditLog(filepath.Join(dir, "audit.jsonl"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer auditLog.Close()
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	group := engine.Group("/api/metadata").Use(auditMiddleware(auditLog))
+	group.POST("/update-app-extra", func(c *gin.Context) {
+		abortAdminAuth(c, http.StatusUnauthorized, "Require the admin token")
+	}, func(c *gin.Context) {
+		t.Error("the handler is called after the auth is rejected")
+	})
+
+	payload := `[{"serviceName":"rmf-checkout","gitRevision":{"tag":"v2"},"extra":{}}]`
+
+	// the calls over the limit are only counted
+	for i := 0; i < auditMaxRejected+5; i++ {
+		request := httptest.NewRequest(http.MethodPost, "/api/metadata/update-app-extra", strings.NewReader(payload))
+		engine.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	records, err := auditLog.Query(&AuditQuery{Limit: auditMaxRejected * 2})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != auditMaxRejected || auditLog.rejectedDropped != 5 {
+		t.Fatalf("Query() got %d records and %d dropped, want %d and 5", len(records), auditLog.rejectedDropped,
+			auditMaxRejected)
+	}
+
+	if record := records[0]; record.Identity != nil || record.Status != http.StatusUnauthorized ||
+		record.Payload != nil || record.Services != nil || record.PayloadSize != 0 {
+		t.Errorf("Query() = %+v, want the rejected call without the payload", record)
+	}
+}
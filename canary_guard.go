@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	autoRollbackKey = "autoRollback" // set "true" in the version's Extra to opt in the canary guard
+
+	actorCanaryGuard           = "canary-guard"
+	auditActionCanaryRollback  = "canary-rollback"
+	auditMethodAuto            = "auto"
+	canaryGuardDefaultInterval = 60
+)
+
+// CanaryGuardConfig roll back a canary automatically when its error rate is too high against the stable version
+type CanaryGuardConfig struct {
+	Interval      int     `yaml:"interval"`      // seconds between the checks
+	Window        int     `yaml:"window"`        // minutes of the reports compared
+	MaxErrorRatio float64 `yaml:"maxErrorRatio"` // the canary's error rate over the stable one's
+	MinErrorRate  float64 `yaml:"minErrorRate"`  // never roll back under this error rate, such as when stable has none
+	MinDeliveries int64   `yaml:"minDeliveries"` // of the canary in the window, fewer are not judged
+}
+
+// MergeFrom merge the values set in the YAML file
+func (conf *CanaryGuardConfig) MergeFrom(other *CanaryGuardConfig) {
+	if other.Interval > 0 {
+		conf.Interval = other.Interval
+	}
+
+	if other.Window > 0 {
+		conf.Window = other.Window
+	}
+
+	if other.MaxErrorRatio > 0 {
+		conf.MaxErrorRatio = other.MaxErrorRatio
+	}
+
+	if other.MinErrorRate > 0 {
+		conf.MinErrorRate = other.MinErrorRate
+	}
+
+	if other.MinDeliveries > 0 {
+		conf.MinDeliveries = other.MinDeliveries
+	}
+}
+
+// CanaryRollback a canary rolled back by the guard
+type CanaryRollback struct {
+	Time              time.Time   `json:"time"`
+	ServiceName       string      `json:"serviceName"`
+	GitRevision       GitRevision `json:"gitRevision"`
+	ActivationPercent int         `json:"activationPercent"` // before rolling back
+	Deliveries        int64       `json:"deliveries"`
+	ErrorRate         float64     `json:"errorRate"`
+	StableVersionKey  string      `json:"stableVersionKey"`
+	StableErrorRate   float64     `json:"stableErrorRate"`
+
+	manifest *AppManifest // the copy when checking
+}
+
+// CanaryGuard check the opted-in canaries periodically, by the client reports in versionHealth. Only the reports
+// of the clients delivered the version are judged, see VersionHealthStore for the trust model
+type CanaryGuard struct {
+	cache    *AppManifestCache
+	auditLog *AuditLog
+}
+
+// NewCanaryGuard new a CanaryGuard, the audit log may be nil
+func NewCanaryGuard(cache *AppManifestCache, auditLog *AuditLog) *CanaryGuard {
+	return &CanaryGuard{cache: cache, auditLog: auditLog}
+}
+
+// Run check the canaries on each interval, never returns
+func (guard *CanaryGuard) Run() {
+	for {
+		interval := currentSiteConfig().CanaryGuard.Interval
+
+		if interval < 1 {
+			interval = canaryGuardDefaultInterval
+		}
+
+		time.Sleep(time.Duration(interval) * time.Second)
+		versionHealth.ExpireClients(time.Now())
+
+		if mutations.Enter() {
+			guard.Check(time.Now())
+			mutations.Leave()
+		}
+	}
+}
+
+// Check roll back the canaries with too many errors, return them
+func (guard *CanaryGuard) Check(now time.Time) []CanaryRollback {
+	rollbacks := guard.findRollbacks(now)
+
+	for i := range rollbacks {
+		guard.rollback(&rollbacks[i])
+	}
+
+	return rollbacks
+}
+
+// canaryActivationPercent the highest percent between 0 and 100 (both excluded) of the default users and the
+// groups in 'activationPercentByGroup', with the rollout. 0 if the version is not a canary for any of them
+func canaryActivationPercent(manifest *AppManifest) int {
+	groups := []string{defaultUserGroup}
+
+	if value, ok := manifest.Extra[activationPercentByGroupKey]; ok {
+		percents, _ := parseActivationPercentByGroup(value)
+
+		for group := range percents {
+			if group != activationPercentOtherGroups {
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	res := 0
+
+	for _, group := range groups {
+		if percent := calcActivationPercent(manifest, []string{group}); percent > res && percent < 100 {
+			res = percent
+		}
+	}
+
+	return res
+}
+
+// findRollbacks compare each opted-in canary (0 < activation percent < 100 for the default users or a group, by
+// the extra or the rollout) with the stable version, which is the other version delivered most in the window
+func (guard *CanaryGuard) findRollbacks(now time.Time) []CanaryRollback {
+	conf := currentSiteConfig().CanaryGuard
+	summaries := map[string][]VersionHealthSummary{}
+
+	for _, summary := range versionHealth.Summary("", now.Add(-time.Duration(conf.Window)*time.Minute)) {
+		summaries[summary.ServiceName] = append(summaries[summary.ServiceName], summary)
+	}
+
+	rollbacks := []CanaryRollback{}
+
+	for serviceName, items := range summaries {
+		manifests := map[string]*AppManifest{}
+
+		for _, manifest := range guard.cache.serviceVersions(serviceName) {
+			manifest := manifest
+			manifests[manifest.GitRevision.GetVersionKey()] = &manifest
+		}
+
+		for _, canary := range items {
+			manifest, ok := manifests[canary.VersionKey]
+
+			if !ok || manifest.Extra[autoRollbackKey] != "true" || canary.Deliveries < conf.MinDeliveries {
+				continue
+			}
+
+			// a release set is rolled back as a whole, by update-release-set
+			if _, inSet := manifest.Extra[releaseSetKey]; inSet {
+				continue
+			}
+
+			percent := canaryActivationPercent(manifest)
+
+			if percent == 0 {
+				continue
+			}
+
+			var stable *VersionHealthSummary
+
+			for i := range items {
+				if _, installed := manifests[items[i].VersionKey]; installed && items[i].VersionKey != canary.VersionKey &&
+					(stable == nil || items[i].Deliveries > stable.Deliveries) {
+					stable = &items[i]
+				}
+			}
+
+			if stable == nil || stable.Deliveries == 0 {
+				continue
+			}
+
+			threshold := stable.ErrorRate * conf.MaxErrorRatio
+
+			if threshold < conf.MinErrorRate {
+				threshold = conf.MinErrorRate
+			}
+
+			if canary.ErrorRate > threshold {
+				rollbacks = append(rollbacks, CanaryRollback{
+					Time:              now,
+					ServiceName:       serviceName,
+					GitRevision:       manifest.GitRevision,
+					ActivationPercent: percent,
+					Deliveries:        canary.Deliveries,
+					ErrorRate:         canary.ErrorRate,
+					StableVersionKey:  stable.VersionKey,
+					StableErrorRate:   stable.ErrorRate,
+					manifest:          manifest,
+				})
+			}
+		}
+	}
+
+	return rollbacks
+}
+
+// rollback set the canary's activation percent to 0 like the admin API, then log, audit and dispatch it
+func (guard *CanaryGuard) rollback(rollback *CanaryRollback) {
+	extra := MetadataExtra{activationPercentKey: "0"}
+
+	if manifest := rollback.manifest; manifest != nil {
+		if _, ok := manifest.Extra[activationPercentByGroupKey]; ok {
+			extra[activationPercentByGroupKey] = ""
+		}
+
+		// the rollout's percent is before the activation percent
+		if manifest.Rollout != nil && manifest.Rollout.State != rolloutStateAborted {
+			param := &AppRolloutParam{GitRevision: rollback.GitRevision, ServiceName: rollback.ServiceName}
+
+			if _, err := guard.cache.AbortAppRollout(actorCanaryGuard, param); err != nil {
+				log.Printf("[ERROR]  Cannot abort the rollout of '%s' %s: %v\n", rollback.ServiceName,
+					rollback.GitRevision.GetVersionKey(), err)
+			}
+		}
+	}
+
+	if _, err := guard.cache.UpdateAppExtra(actorCanaryGuard, []AppUpdateExtraParam{{
+		GitRevision: rollback.GitRevision,
+		ServiceName: rollback.ServiceName,
+		Extra:       extra,
+	}}); err != nil {
+		log.Printf("[ERROR]  Cannot roll back canary '%s' %s: %v\n", rollback.ServiceName,
+			rollback.GitRevision.GetVersionKey(), err)
+		return
+	}
+
+	log.Printf("[WARN]  Rolled back canary '%s' %s: error rate %.4f against %.4f of stable %s\n", rollback.ServiceName,
+		rollback.GitRevision.GetVersionKey(), rollback.ErrorRate, rollback.StableErrorRate, rollback.StableVersionKey)
+
+	payload, _ := json.Marshal(rollback)
+	record := &AuditRecord{
+		Time:        rollback.Time,
+		Identity:    &AdminIdentity{Name: actorCanaryGuard, Method: auditMethodAuto},
+		Action:      auditActionCanaryRollback,
+		Services:    []string{rollback.ServiceName},
+		Payload:     payload,
+		PayloadSize: len(payload),
+		Status:      http.StatusOK,
+	}
+
+	if err := guard.auditLog.Append(record); err != nil {
+		log.Printf("[ERROR]  Cannot write audit log for '%s': %v\n", record.Action, err)
+	}
+
+	webhooks.Dispatch(webhookEventCanaryRollback, rollback)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCanaryGuard_Check(t *testing.T) {
+	versionHealth = NewVersionHealthStore()
+	cache := NewAppManifestCache()
+	versions := map[string]MetadataExtra{
+		"v1": {},
+		"v2": {activationPercentKey: "10", autoRollbackKey: "true"},
+		"v3": {activationPercentKey: "10"},
+	}
+
+	for tag, extra := range versions {
+		if _, err := cache.InstallAppVersion("tester", &AppInstallParam{Manifest: AppManifest{
+			ServiceName: "rmf-a", GitRevision: GitRevision{Tag: tag}, Extra: extra,
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+
+	// stable: 1% errors, both canaries: 10% errors
+	for tag, count := range map[string]int{"v1": 1000, "v2": 200, "v3": 200} {
+		git := GitRevision{Tag: tag}
+
+		for i := 0; i < count; i++ {
+			stickyID := fmt.Sprintf("%s-client-%d", tag, i)
+			versionHealth.ObserveDeliveries(stickyID, map[string]string{"rmf-a": git.GetVersionKey()}, now)
+
+			if (tag == "v1" && i%100 == 0) || (tag != "v1" && i%10 == 0) {
+				report := &BeaconReport{Type: beaconTypeException, ServiceName: "rmf-a", GitRevision: git}
+				versionHealth.ObserveReport(stickyID, fmt.Sprintf("10.0.%d.1", i), report, now)
+			}
+		}
+	}
+
+	guard := NewCanaryGuard(cache, nil)
+	rollbacks := guard.Check(now)
+
+	if len(rollbacks) != 1 || rollbacks[0].GitRevision.Tag != "v2" || rollbacks[0].StableVersionKey != "v1_" {
+		t.Fatalf("Check() = %+v, want the opted-in v2 against v1", rollbacks)
+	}
+
+	v2 := GitRevision{Tag: "v2"}
+
+	if manifest := cache.findAppVersion("rmf-a", &v2); manifest.Extra[activationPercentKey] != "0" {
+		t.Errorf("Check() should set the activation percent of v2 to 0, got %v", manifest.Extra)
+	}
+
+	if history := cache.QueryHistory("rmf-a", 1); len(history) != 1 || history[0].Actor != actorCanaryGuard {
+		t.Errorf("Check() should update the extra as %s, got %+v", actorCanaryGuard, history)
+	}
+
+	if rollbacks := guard.Check(now); len(rollbacks) != 0 {
+		t.Errorf("Check() again = %+v, want none", rollbacks)
+	}
+}
+
+func TestCanaryGuard_Check_canaries(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest AppManifest
+		forged   bool // the errors are reported by the clients not delivered the canary
+		oneHost  bool // the errors are reported by the clients delivered the canary, from one host
+		want     bool
+	}{
+		{"rollout", AppManifest{
+			Extra:   MetadataExtra{autoRollbackKey: "true"},
+			Rollout: &AppRollout{Steps: []RolloutStep{{"0s", 10}, {"24h", 100}}},
+		}, false, false, true},
+		{"group", AppManifest{
+			Extra: MetadataExtra{activationPercentKey: "0", activationPercentByGroupKey: "beta:10", autoRollbackKey: "true"},
+		}, false, false, true},
+		{"all groups", AppManifest{
+			Extra: MetadataExtra{activationPercentByGroupKey: "beta:100", autoRollbackKey: "true"},
+		}, false, false, false},
+		{"forged", AppManifest{
+			Extra: MetadataExtra{activationPercentKey: "10", autoRollbackKey: "true"},
+		}, true, false, false},
+		{"one host", AppManifest{
+			Extra: MetadataExtra{activationPercentKey: "10", autoRollbackKey: "true"},
+		}, false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			versionHealth = NewVersionHealthStore()
+			cache := NewAppManifestCache()
+			v1 := GitRevision{Tag: "v1"}
+			v2 := GitRevision{Tag: "v2"}
+			canary := tt.manifest
+			canary.ServiceName, canary.GitRevision = "rmf-a", v2
+
+			for _, manifest := range []AppManifest{{ServiceName: "rmf-a", GitRevision: v1, Extra: MetadataExtra{}}, canary} {
+				if _, err := cache.InstallAppVersion("tester", &AppInstallParam{Manifest: manifest}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			now := time.Now()
+
+			// stable: no errors, canary: 20% errors
+			for _, git := range []GitRevision{v1, v2} {
+				for i := 0; i < 200; i++ {
+					stickyID := fmt.Sprintf("%s-client-%d", git.Tag, i)
+					versionHealth.ObserveDeliveries(stickyID, map[string]string{"rmf-a": git.GetVersionKey()}, now)
+
+					if git == v2 && i%5 == 0 {
+						clientIP := fmt.Sprintf("10.0.%d.1", i)
+
+						if tt.forged {
+							stickyID = fmt.Sprintf("forged-%d", i)
+						} else if tt.oneHost {
+							clientIP = "10.0.0.1"
+						}
+
+						report := &BeaconReport{Type: beaconTypeException, ServiceName: "rmf-a", GitRevision: git}
+						versionHealth.ObserveReport(stickyID, clientIP, report, now)
+					}
+				}
+			}
+
+			rollbacks := NewCanaryGuard(cache, nil).Check(now)
+
+			if got := len(rollbacks) == 1 && rollbacks[0].GitRevision == v2; got != tt.want {
+				t.Fatalf("Check() = %+v, want rolled back %v", rollbacks, tt.want)
+			}
+
+			if !tt.want {
+				return
+			}
+
+			manifest := cache.findAppVersion("rmf-a", &v2)
+
+			if calcActivationPercent(manifest, []string{defaultUserGroup}) != 0 ||
+				calcActivationPercent(manifest, []string{"beta"}) != 0 {
+				t.Errorf("Check() should stop delivering v2, got %v, rollout %+v", manifest.Extra, manifest.Rollout)
+			}
+		})
+	}
+}
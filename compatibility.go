@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// isFrameworkCompatible check the app's 'frameworkVersion' range includes the framework's tag. It's
+// compatible without the range, without a framework, or when the framework's tag is not a version.
+func isFrameworkCompatible(manifest *AppManifest, frameworkTag string) bool {
+	if manifest.FrameworkVersion == "" || frameworkTag == "" {
+		return true
+	}
+
+	version, ok := parseSemver(frameworkTag)
+
+	if !ok {
+		return true
+	}
+
+	versionRange, err := compileSemverRange(manifest.FrameworkVersion)
+	return err == nil && versionRange.Match(version)
+}
+
+func filterFrameworkCompatible(items []AppFilterItem, frameworkTag string) []AppFilterItem {
+	res := []AppFilterItem{}
+
+	for _, item := range items {
+		if isFrameworkCompatible(item.App, frameworkTag) {
+			res = append(res, item)
+		}
+	}
+
+	return res
+}
+
+// newestCompatibleVersion the compatible version with the largest tag, out of the items filtered for the user,
+// see filterUserManifests(). The versions of activation percent 0 are skipped. Nil if none
+func newestCompatibleVersion(items []AppFilterItem, frameworkTag string) *AppManifest {
+	var newest *AppManifest
+	var newestVersion semver
+
+	for _, item := range items {
+		manifest := item.App
+
+		if item.ActivationPercent < 1 || !isFrameworkCompatible(manifest, frameworkTag) {
+			continue
+		}
+
+		version, ok := parseSemver(manifest.GitRevision.Tag)
+
+		if !ok {
+			version = semver{Major: -1}
+		}
+
+		if newest == nil || version.compare(newestVersion) > 0 || (version.compare(newestVersion) == 0 &&
+			manifest.GitRevision.GetVersionKey() > newest.GitRevision.GetVersionKey()) {
+			newest, newestVersion = manifest, version
+		}
+	}
+
+	return newest
+}
+
+// serviceVersions copy the service's versions, then they can be read without the lock
+func (cache *AppManifestCache) serviceVersions(serviceName string) []AppManifest {
+	value, ok := cache.ServiceManifests.Load(serviceName)
+
+	if !ok {
+		return nil
+	}
+
+	mtxValue, _ := cache.ServiceMutexes.LoadOrStore(serviceName, &sync.RWMutex{})
+	mtx := mtxValue.(*sync.RWMutex)
+
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	res := make([]AppManifest, 0, len(value.(AppVersionMap)))
+
+	for _, manifest := range value.(AppVersionMap) {
+		res = append(res, *manifest)
+	}
+
+	return res
+}
+
+// frameworkCompatibilityWarnings the framework versions no version of a service is compatible with, after
+// installing the manifest. Then the users getting such a framework version get no version of the service.
+func (cache *AppManifestCache) frameworkCompatibilityWarnings(installed *AppManifest) []string {
+	frameworks := cache.serviceVersions(frameworkServiceName)
+	services := []string{installed.ServiceName}
+
+	if installed.ServiceName == frameworkServiceName {
+		frameworks = []AppManifest{*installed}
+		services = services[:0]
+
+		cache.ServiceManifests.Range(func(key, value interface{}) bool {
+			if serviceName := key.(string); serviceName != frameworkServiceName {
+				services = append(services, serviceName)
+			}
+
+			return true
+		})
+
+		sort.Strings(services)
+	}
+
+	warnings := []string{}
+	now := time.Now()
+
+	for _, serviceName := range services {
+		versions := cache.serviceVersions(serviceName)
+
+		for i := range frameworks {
+			framework := &frameworks[i]
+
+			if framework.Rollout != nil && !framework.Rollout.IsActive(now) {
+				continue
+			}
+
+			compatible := len(versions) == 0
+
+			for j := range versions {
+				if isFrameworkCompatible(&versions[j], framework.GitRevision.Tag) {
+					compatible = true
+					break
+				}
+			}
+
+			if !compatible {
+				warnings = append(warnings, fmt.Sprintf("No version of '%s' is compatible with framework '%s'",
+					serviceName, framework.GitRevision.GetVersionKey()))
+			}
+		}
+	}
+
+	sort.Strings(warnings)
+	return warnings
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dependencyWarnInterval = 10 * time.Minute
+
+// throttledWarnings log each warning at most once in the interval, the same apps are dropped on each request
+type throttledWarnings struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time // the warning to the time it's logged
+}
+
+var dependencyWarnings = &throttledWarnings{interval: dependencyWarnInterval, last: map[string]time.Time{}}
+
+// allow check the warning is not logged in the interval, and record it. The expired ones are dropped
+func (warnings *throttledWarnings) allow(message string, now time.Time) bool {
+	warnings.mutex.Lock()
+	defer warnings.mutex.Unlock()
+
+	if last, ok := warnings.last[message]; ok && now.Sub(last) < warnings.interval {
+		return false
+	}
+
+	for key, last := range warnings.last {
+		if now.Sub(last) >= warnings.interval {
+			delete(warnings.last, key)
+		}
+	}
+
+	warnings.last[message] = now
+	return true
+}
+
+// Printf log the warning, unless it's logged in the interval
+func (warnings *throttledWarnings) Printf(format string, args ...interface{}) {
+	if message := fmt.Sprintf(format, args...); warnings.allow(message, time.Now()) {
+		log.Print(message)
+	}
+}
+
+// PrintfByKey log the warning, unless a warning of the key is logged in the interval. For the warnings whose
+// details come from the clients, which would make each message new
+func (warnings *throttledWarnings) PrintfByKey(key string, format string, args ...interface{}) {
+	if warnings.allow(key, time.Now()) {
+		log.Printf(format, args...)
+	}
+}
+
+// resolveAppDependencies resolve the apps' dependencies against the apps selected for the same request.
+// The apps are returned in topological order (dependencies first, then by ID). An app is dropped when
+// one of its dependencies is not selected, or when it is in (or depends on) a dependency cycle.
+// 'selected' are the IDs selected outside of 'apps', such as polyfill and framework.
+func resolveAppDependencies(apps []MetadataApp, selected map[string]bool) []MetadataApp {
+	byID := map[string]*MetadataApp{}
+
+	for i := range apps {
+		byID[apps[i].ID] = &apps[i]
+	}
+
+	// drop the apps with missing dependencies, until nothing changes
+	for changed := true; changed; {
+		changed = false
+
+		for _, id := range sortedAppIDs(byID) {
+			for _, dep := range byID[id].Dependencies {
+				if dep == id || selected[dep] {
+					continue
+				}
+
+				if _, ok := byID[dep]; !ok {
+					dependencyWarnings.Printf("[WARN]  Drop app '%s': dependency '%s' is missing or disabled for the user\n", id, dep)
+					delete(byID, id)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	// Kahn's algorithm, take the smallest ID first for a stable order
+	inDegrees := map[string]int{}
+	dependents := map[string][]string{}
+
+	for id, app := range byID {
+		inDegrees[id] += 0
+
+		for _, dep := range uniqueStrings(app.Dependencies) {
+			if _, ok := byID[dep]; ok && dep != id {
+				inDegrees[id]++
+				dependents[dep] = append(dependents[dep], id)
+			}
+		}
+	}
+
+	ready := []string{}
+
+	for id, degree := range inDegrees {
+		if degree == 0 {
+			ready = append(ready, id)
+		}
+	}
+
+	result := make([]MetadataApp, 0, len(byID))
+
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		id := ready[0]
+		ready = ready[1:]
+		result = append(result, *byID[id])
+		delete(inDegrees, id)
+
+		for _, dependent := range dependents[id] {
+			inDegrees[dependent]--
+
+			if inDegrees[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	if len(inDegrees) > 0 {
+		cyclic := []string{}
+
+		for id := range inDegrees {
+			cyclic = append(cyclic, id)
+		}
+
+		sort.Strings(cyclic)
+		dependencyWarnings.Printf("[WARN]  Drop apps in or depending on a dependency cycle: %s\n", strings.Join(cyclic, ", "))
+	}
+
+	return result
+}
+
+// checkAppDependencies check each dependency of the manifest has an installed version
+func (cache *AppManifestCache) checkAppDependencies(manifest *AppManifest) error {
+	missing := []string{}
+
+	for _, dep := range manifest.Dependencies {
+		if dep == manifest.ServiceName || cache.hasInstalledVersion(dep) {
+			continue
+		}
+
+		missing = append(missing, dep)
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("Unsatisfied dependencies of '%s': %s", manifest.ServiceName, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+func (cache *AppManifestCache) hasInstalledVersion(serviceName string) bool {
+	value, ok := cache.ServiceManifests.Load(serviceName)
+
+	if !ok {
+		return false
+	}
+
+	mtxValue, _ := cache.ServiceMutexes.LoadOrStore(serviceName, &sync.RWMutex{})
+	mtx := mtxValue.(*sync.RWMutex)
+
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	return len(value.(AppVersionMap)) > 0
+}
+
+func sortedAppIDs(byID map[string]*MetadataApp) []string {
+	ids := make([]string, 0, len(byID))
+
+	for id := range byID {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+func uniqueStrings(values []string) []string {
+	seen := map[string]bool{}
+	res := []string{}
+
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			res = append(res, value)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_resolveAppDependencies(t *testing.T) {
+	app := func(id string, deps ...string) MetadataApp {
+		return MetadataApp{ID: id, Dependencies: deps}
+	}
+	selected := map[string]bool{frameworkServiceName: true}
+
+	tests := []struct {
+		name string
+		apps []MetadataApp
+		want []string
+	}{
+		{
+			name: "topological order",
+			apps: []MetadataApp{app("rmf-c", "rmf-b"), app("rmf-b", "rmf-a"), app("rmf-a", frameworkServiceName)},
+			want: []string{"rmf-a", "rmf-b", "rmf-c"},
+		},
+		{
+			name: "independent apps by ID",
+			apps: []MetadataApp{app("rmf-b"), app("rmf-a"), app("rmf-c", "rmf-b", "rmf-b")},
+			want: []string{"rmf-a", "rmf-b", "rmf-c"},
+		},
+		{
+			name: "missing dependency drops dependents",
+			apps: []MetadataApp{app("rmf-a", "rmf-missing"), app("rmf-b", "rmf-a"), app("rmf-c")},
+			want: []string{"rmf-c"},
+		},
+		{
+			name: "cycle drops members and dependents",
+			apps: []MetadataApp{app("rmf-a", "rmf-b"), app("rmf-b", "rmf-a"), app("rmf-c", "rmf-a"), app("rmf-d", "rmf-d")},
+			want: []string{"rmf-d"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+
+			for _, app := range resolveAppDependencies(tt.apps, selected) {
+				got = append(got, app.ID)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveAppDependencies() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_throttledWarnings_allow(t *testing.T) {
+	warnings := &throttledWarnings{interval: time.Minute, last: map[string]time.Time{}}
+	now := time.Now()
+
+	tests := []struct {
+		message string
+		at      time.Duration
+		want    bool
+	}{
+		{"drop rmf-a", 0, true},
+		{"drop rmf-a", 30 * time.Second, false},
+		{"drop rmf-b", 30 * time.Second, true},
+		{"drop rmf-a", time.Minute, true},
+		{"drop rmf-a", 90 * time.Second, false},
+	}
+	for _, tt := range tests {
+		if got := warnings.allow(tt.message, now.Add(tt.at)); got != tt.want {
+			t.Errorf("allow(%s) at %v = %v, want %v", tt.message, tt.at, got, tt.want)
+		}
+	}
+}
+
+func Test_throttledWarnings_PrintfByKey(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	warnings := &throttledWarnings{interval: time.Minute, last: map[string]time.Time{}}
+
+	for i := 0; i < 100; i++ {
+		warnings.PrintfByKey("jwt", "[WARN]  ignore JWT from 10.0.0.%d\n", i)
+	}
+
+	if lines := strings.Count(output.String(), "\n"); lines != 1 || len(warnings.last) != 1 {
+		t.Errorf("PrintfByKey() logged %d lines with %d keys, want 1", lines, len(warnings.last))
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	exposureSourceSPA  = "spa"
+	exposureSourceInfo = "info"
+)
+
+// ExposureLogConfig the exposure log of the selected versions, for joining A/B assignments with business metrics
+type ExposureLogConfig struct {
+	File       string   `yaml:"file"`       // empty to disable
+	MaxSize    int64    `yaml:"maxSize"`    // MB, the file is rotated when it's larger
+	MaxBackups int      `yaml:"maxBackups"` // rotated files kept as 'file.1' (the newest) to 'file.N'
+	SampleRate *float64 `yaml:"sampleRate"` // the ratio of the sessions logged, from 0 to 1
+}
+
+// MergeFrom merge the values set in the YAML file
+func (conf *ExposureLogConfig) MergeFrom(other *ExposureLogConfig) {
+	if other.File != "" {
+		conf.File = other.File
+	}
+
+	if other.MaxSize > 0 {
+		conf.MaxSize = other.MaxSize
+	}
+
+	if other.MaxBackups > 0 {
+		conf.MaxBackups = other.MaxBackups
+	}
+
+	if other.SampleRate != nil {
+		conf.SampleRate = other.SampleRate
+	}
+}
+
+// LogSampleRate the value of SampleRate, 1 if it's not set
+func (conf *ExposureLogConfig) LogSampleRate() float64 {
+	if conf.SampleRate == nil {
+		return 1
+	}
+
+	return *conf.SampleRate
+}
+
+// ExposureRecord the versions a user gets from one SPA render or metadata call
+type ExposureRecord struct {
+	Time       time.Time         `json:"time"`
+	SessionID  string            `json:"sessionId"`
+	UserGroups []string          `json:"userGroups"`
+	Source     string            `json:"source"`   // spa or info
+	Versions   map[string]string `json:"versions"` // service name to version key
+}
+
+// ExposureLog JSON lines file of the exposures, rotated by size
+type ExposureLog struct {
+	mutex  sync.Mutex
+	conf   ExposureLogConfig
+	file   *os.File // nil after a failed rotation, opened again by the next Append
+	size   int64
+	closed bool
+}
+
+// OpenExposureLog open (or create) the exposure log for appending
+func OpenExposureLog(conf *ExposureLogConfig) (*ExposureLog, error) {
+	exposureLog := &ExposureLog{conf: *conf}
+
+	if err := exposureLog.open(); err != nil {
+		return nil, err
+	}
+
+	return exposureLog, nil
+}
+
+func (exposureLog *ExposureLog) open() error {
+	file, err := os.OpenFile(exposureLog.conf.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	exposureLog.file = file
+	exposureLog.size = info.Size()
+	return nil
+}
+
+// rotate rename 'file' to 'file.1', 'file.1' to 'file.2' and so on, then open a new file.
+// NOTE: lock the exposure log before calling
+func (exposureLog *ExposureLog) rotate() error {
+	exposureLog.file.Close()
+	filename := exposureLog.conf.File
+	os.Remove(fmt.Sprintf("%s.%d", filename, exposureLog.conf.MaxBackups))
+
+	for i := exposureLog.conf.MaxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", filename, i), fmt.Sprintf("%s.%d", filename, i+1))
+	}
+
+	if exposureLog.conf.MaxBackups > 0 {
+		if err := os.Rename(filename, filename+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(filename); err != nil {
+		return err
+	}
+
+	return exposureLog.open()
+}
+
+// isExposureSampled check the session is logged. With the session ID, all calls of the session are logged or not
+func isExposureSampled(sessionID string, sampleRate float64) bool {
+	if sampleRate >= 1 {
+		return true
+	}
+
+	if sessionID == "" {
+		return rand.Float64() < sampleRate
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(sessionID))
+
+	return float64(mixHash64(hash.Sum64())%10000) < sampleRate*10000
+}
+
+// Log write the versions delivered to the user if the session is sampled. Nothing to do if the exposure log
+// is disabled (nil)
+func (exposureLog *ExposureLog) Log(source string, param *GenMetadataParam, info *MetadataInfoForRequest) {
+	if exposureLog == nil || !isExposureSampled(param.SessionID, exposureLog.conf.LogSampleRate()) {
+		return
+	}
+
+	record := &ExposureRecord{
+		Time:       time.Now(),
+		SessionID:  param.SessionID,
+		UserGroups: param.UserGroups,
+		Source:     source,
+		Versions:   info.DeliveredVersions(),
+	}
+
+	if err := exposureLog.Append(record); err != nil {
+		log.Printf("[ERROR]  Cannot write exposure log: %v\n", err)
+	}
+}
+
+// Append write the record, rotate the file first if it would be too large
+func (exposureLog *ExposureLog) Append(record *ExposureRecord) error {
+	line, err := json.Marshal(record)
+
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+
+	exposureLog.mutex.Lock()
+	defer exposureLog.mutex.Unlock()
+
+	if exposureLog.closed {
+		return fmt.Errorf("exposure log %s is closed", exposureLog.conf.File)
+	}
+
+	if exposureLog.file == nil {
+		if err := exposureLog.open(); err != nil {
+			return err
+		}
+	}
+
+	if maxSize := exposureLog.conf.MaxSize * 1024 * 1024; maxSize > 0 && exposureLog.size > 0 &&
+		exposureLog.size+int64(len(line)) > maxSize {
+		if err := exposureLog.rotate(); err != nil {
+			exposureLog.file = nil
+			return err
+		}
+	}
+
+	n, err := exposureLog.file.Write(line)
+	exposureLog.size += int64(n)
+	return err
+}
+
+// Close close the exposure log file if it's enabled
+func (exposureLog *ExposureLog) Close() error {
+	if exposureLog == nil {
+		return nil
+	}
+
+	exposureLog.mutex.Lock()
+	defer exposureLog.mutex.Unlock()
+
+	exposureLog.closed = true
+
+	if exposureLog.file == nil {
+		return nil
+	}
+
+	err := exposureLog.file.Close()
+	exposureLog.file = nil
+	return err
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExposureLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rmf-exposure")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "exposure.jsonl")
+	exposureLog, err := OpenExposureLog(&ExposureLogConfig{File: filename, MaxSize: 1, MaxBackups: 2, SampleRate: floatPointer(1)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer exposureLog.Close()
+
+	info := &MetadataInfoForRequest{
+		FrameworkApp:     MetadataApp{ID: frameworkServiceName},
+		OtherApps:        []MetadataApp{{ID: "rmf-a"}},
+		SelectedVersions: map[string]string{frameworkServiceName: "v1_", "rmf-a": "v2_", "rmf-dropped": "v1_"},
+	}
+	exposureLog.Log(exposureSourceSPA, &GenMetadataParam{SessionID: "session-1", UserGroups: []string{"beta"}}, info)
+
+	content, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var record ExposureRecord
+
+	if err := json.Unmarshal(content, &record); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{frameworkServiceName: "v1_", "rmf-a": "v2_"}
+
+	if record.SessionID != "session-1" || record.Source != exposureSourceSPA || !reflect.DeepEqual(record.Versions, want) {
+		t.Errorf("exposure record = %+v, want versions %v", record, want)
+	}
+
+	// rotate after 1 MB, keep 2 backups
+	large := &ExposureRecord{SessionID: strings.Repeat("x", 400*1024)}
+
+	for i := 0; i < 10; i++ {
+		if err := exposureLog.Append(large); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{filename, filename + ".1", filename + ".2"} {
+		if info, err := os.Stat(name); err != nil || info.Size() > 1024*1024 {
+			t.Errorf("rotated file %s = %v, %v, want at most 1 MB", name, info, err)
+		}
+	}
+
+	if _, err := os.Stat(filename + ".3"); !os.IsNotExist(err) {
+		t.Errorf("rotated file %s.3 should be removed", filename)
+	}
+}
+
+func Test_isExposureSampled(t *testing.T) {
+	sampled := 0
+
+	for i := 0; i < 1000; i++ {
+		sessionID := fmt.Sprintf("session-%d", i)
+
+		if isExposureSampled(sessionID, 0.2) {
+			sampled++
+		}
+
+		if isExposureSampled(sessionID, 0.2) != isExposureSampled(sessionID, 0.2) {
+			t.Fatalf("isExposureSampled(%s) is not sticky", sessionID)
+		}
+	}
+
+	if sampled < 120 || sampled > 280 {
+		t.Errorf("isExposureSampled() sampled %d of 1000, want about 200", sampled)
+	}
+}
+
+func TestExposureLog_rotateFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rmf-exposure")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "exposure.jsonl")
+	exposureLog, err := OpenExposureLog(&ExposureLogConfig{File: filename, MaxSize: 1, MaxBackups: 1})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer exposureLog.Close()
+
+	// a non-empty directory at 'file.1' fails the rotation
+	if err := os.MkdirAll(filepath.Join(filename+".1", "blocker"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	large := &ExposureRecord{SessionID: strings.Repeat("x", 600*1024)}
+
+	if err := exposureLog.Append(large); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exposureLog.Append(large); err == nil {
+		t.Fatalf("Append() with a failed rotation, want error")
+	}
+
+	os.RemoveAll(filename + ".1")
+
+	if err := exposureLog.Append(large); err != nil {
+		t.Errorf("Append() after the rotation can succeed = %v, want nil", err)
+	}
+
+	if _, err := os.Stat(filename + ".1"); err != nil {
+		t.Errorf("rotated file %s.1 = %v, want it exists", filename, err)
+	}
+
+	exposureLog.Close()
+
+	if err := exposureLog.Append(large); err == nil {
+		t.Errorf("Append() after Close(), want error")
+	}
+}
+
+func TestExposureLogConfig_MergeFrom_sampleRate(t *testing.T) {
+	conf := defaultSiteConfig.Clone()
+	conf.ExposureLog.MergeFrom(&ExposureLogConfig{})
+
+	if got := conf.ExposureLog.LogSampleRate(); got != 1 {
+		t.Errorf("LogSampleRate() not set = %v, want 1", got)
+	}
+
+	conf.ExposureLog.MergeFrom(&ExposureLogConfig{SampleRate: floatPointer(0)})
+
+	if got := conf.ExposureLog.LogSampleRate(); got != 0 {
+		t.Errorf("LogSampleRate() = %v, want 0", got)
+	}
+
+	if err := conf.Validate(); err != nil {
+		t.Errorf("Validate() with sampleRate 0 = %v, want nil", err)
+	}
+
+	conf.ExposureLog.SampleRate = floatPointer(1.5)
+
+	if err := conf.Validate(); err == nil {
+		t.Errorf("Validate() with sampleRate 1.5, want error")
+	}
+
+	if isExposureSampled("session-1", 0) || isExposureSampled("", 0) {
+		t.Errorf("isExposureSampled() with rate 0 = true, want false")
+	}
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+)
+
+const (
+	actorStartup         = "startup"          // replaying the journal without the actor
+	actorManifestWatcher = "manifest-watcher" // installing or uninstalling the changed manifest files
+)
+
+// VersionChange a version before and after a revision, nil when it's not installed
+type VersionChange struct {
+	ServiceName string       `json:"serviceName"`
+	VersionKey  string       `json:"versionKey"`
+	Before      *AppManifest `json:"before"`
+	After       *AppManifest `json:"after"`
+}
+
+// ReleaseSetChange a release set before and after a revision, nil when it's not installed
+type ReleaseSetChange struct {
+	Name   string      `json:"name"`
+	Before *ReleaseSet `json:"before"`
+	After  *ReleaseSet `json:"after"`
+}
+
+// Revision one recorded mutation of AppManifestCache, with the changed versions and release sets
+type Revision struct {
+	ID          int64              `json:"id"`
+	Time        time.Time          `json:"time"`
+	Actor       string             `json:"actor"`
+	Op          string             `json:"op"`
+	RevertTo    int64              `json:"revertTo,omitempty"` // the revision restored by a revert
+	Versions    []VersionChange    `json:"versions"`
+	ReleaseSets []ReleaseSetChange `json:"releaseSets,omitempty"`
+}
+
+// AppRevertParam revert a service, or the whole site without the service name, to the state after the revision.
+// Versions and ReleaseSets are the states to restore (as After), filled when reverting.
+type AppRevertParam struct {
+	Revision    *int64             `json:"revision"` // required, 0 is the state at startup
+	ServiceName string             `json:"serviceName"`
+	Versions    []VersionChange    `json:"versions,omitempty"`
+	ReleaseSets []ReleaseSetChange `json:"releaseSets,omitempty"`
+}
+
+// cacheSnapshot copies of some services' versions, and the release sets when they are changed
+type cacheSnapshot struct {
+	versions    map[string]AppVersionMap
+	releaseSets map[string]*ReleaseSet
+}
+
+// cloneAppManifest copy the manifest with its own Extra, the Extra of an installed version is changed in place
+func cloneAppManifest(manifest *AppManifest) *AppManifest {
+	res := *manifest
+	res.Extra = MetadataExtra{}
+
+	for key, value := range manifest.Extra {
+		res.Extra[key] = value
+	}
+
+	return &res
+}
+
+// journalRecordScope the sorted services changed by the record, and whether it changes the release sets.
+// Locking the services in this order never deadlocks.
+// NOTE: lock the release sets before calling for the ops of release sets
+func (cache *AppManifestCache) journalRecordScope(record *JournalRecord) ([]string, bool) {
+	serviceMap := map[string]bool{}
+	withReleaseSets := false
+
+	switch record.Op {
+	case journalOpInstall:
+		if record.Install != nil {
+			serviceMap[record.Install.Manifest.ServiceName] = true
+		}
+	case journalOpUninstall:
+		if record.Uninstall != nil {
+			serviceMap[record.Uninstall.ServiceName] = true
+		}
+	case journalOpUpdateExtra:
+		for _, param := range record.UpdateExtra {
+			serviceMap[param.ServiceName] = true
+		}
+	case journalOpSetRollout:
+		if record.Rollout != nil {
+			serviceMap[record.Rollout.ServiceName] = true
+		}
+	case journalOpInstallReleaseSet, journalOpUninstallReleaseSet, journalOpUpdateReleaseSet:
+		withReleaseSets = true
+
+		if record.ReleaseSet != nil {
+			for _, app := range record.ReleaseSet.Apps {
+				serviceMap[app.Manifest.ServiceName] = true
+			}
+
+			if set, ok := cache.releaseSets[record.ReleaseSet.Name]; ok {
+				for serviceName := range set.Versions {
+					serviceMap[serviceName] = true
+				}
+			}
+		}
+	case journalOpRevert:
+		if record.Revert != nil {
+			for _, change := range record.Revert.Versions {
+				serviceMap[change.ServiceName] = true
+			}
+
+			withReleaseSets = len(record.Revert.ReleaseSets) > 0
+		}
+	case journalOpSnapshot:
+		if record.Snapshot != nil {
+			for _, change := range record.Snapshot.Versions {
+				serviceMap[change.ServiceName] = true
+			}
+
+			withReleaseSets = len(record.Snapshot.ReleaseSets) > 0
+		}
+	}
+
+	services := make([]string, 0, len(serviceMap))
+
+	for serviceName := range serviceMap {
+		services = append(services, serviceName)
+	}
+
+	sort.Strings(services)
+	return services, withReleaseSets
+}
+
+// snapshot copy the services' versions, and the release sets if required.
+// NOTE: lock the services (and the release sets) before calling
+func (cache *AppManifestCache) snapshot(services []string, withReleaseSets bool) *cacheSnapshot {
+	res := &cacheSnapshot{versions: map[string]AppVersionMap{}}
+
+	for _, serviceName := range services {
+		versions := AppVersionMap{}
+
+		if value, ok := cache.ServiceManifests.Load(serviceName); ok {
+			for key, manifest := range value.(AppVersionMap) {
+				versions[key] = cloneAppManifest(manifest)
+			}
+		}
+
+		res.versions[serviceName] = versions
+	}
+
+	if withReleaseSets {
+		res.releaseSets = map[string]*ReleaseSet{}
+
+		// a set is replaced as a whole when changing, no need to copy it
+		for name, set := range cache.releaseSets {
+			res.releaseSets[name] = set
+		}
+	}
+
+	return res
+}
+
+// diffSnapshots the changed versions and release sets, in the order of service name and version key
+func diffSnapshots(before *cacheSnapshot, after *cacheSnapshot) ([]VersionChange, []ReleaseSetChange) {
+	versions := []VersionChange{}
+	services := make([]string, 0, len(after.versions))
+
+	for serviceName := range after.versions {
+		services = append(services, serviceName)
+	}
+
+	sort.Strings(services)
+
+	for _, serviceName := range services {
+		keys := []string{}
+
+		for key := range before.versions[serviceName] {
+			keys = append(keys, key)
+		}
+
+		for key := range after.versions[serviceName] {
+			if _, ok := before.versions[serviceName][key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			old, updated := before.versions[serviceName][key], after.versions[serviceName][key]
+
+			if !reflect.DeepEqual(old, updated) {
+				versions = append(versions, VersionChange{ServiceName: serviceName, VersionKey: key, Before: old, After: updated})
+			}
+		}
+	}
+
+	var releaseSets []ReleaseSetChange
+	names := []string{}
+
+	for name := range before.releaseSets {
+		names = append(names, name)
+	}
+
+	for name := range after.releaseSets {
+		if _, ok := before.releaseSets[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		old, updated := before.releaseSets[name], after.releaseSets[name]
+
+		if !reflect.DeepEqual(old, updated) {
+			releaseSets = append(releaseSets, ReleaseSetChange{Name: name, Before: old, After: updated})
+		}
+	}
+
+	return versions, releaseSets
+}
+
+// commitMutation apply the change, then write the journal and record the revision if it's applied. The
+// revision is nil when nothing is changed. If the journal can't be written, the change is undone and the
+// error is a *JournalWriteError, it would be lost when restarting.
+// NOTE: lock the changed services (and the release sets) before calling
+func (cache *AppManifestCache) commitMutation(record *JournalRecord, apply func() bool) (*Revision, bool, error) {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+
+	services, withReleaseSets := cache.journalRecordScope(record)
+	before := cache.snapshot(services, withReleaseSets)
+
+	if !apply() {
+		return nil, false, nil
+	}
+
+	after := cache.snapshot(services, withReleaseSets)
+
+	if err := cache.writeJournal(record); err != nil {
+		cache.restoreSnapshot(before, after)
+		return nil, false, err
+	}
+
+	revision := cache.recordRevision(record, before, after)
+
+	if revision != nil && !cache.replaying {
+		webhooks.Dispatch(record.Op, &webhookMutationEvent{Actor: record.Actor, Revision: revision})
+	}
+
+	return revision, true, nil
+}
+
+// restoreSnapshot undo the changes from before to after. NOTE: Leave cache.FrameworkRuntimes unchanged.
+// NOTE: lock the services (and the release sets) before calling
+func (cache *AppManifestCache) restoreSnapshot(before *cacheSnapshot, after *cacheSnapshot) {
+	versions, releaseSets := diffSnapshots(before, after)
+	undo := &AppRevertParam{}
+
+	for _, change := range versions {
+		undo.Versions = append(undo.Versions, VersionChange{
+			ServiceName: change.ServiceName,
+			VersionKey:  change.VersionKey,
+			Before:      change.After,
+			After:       change.Before,
+		})
+	}
+
+	for _, change := range releaseSets {
+		undo.ReleaseSets = append(undo.ReleaseSets, ReleaseSetChange{
+			Name:   change.Name,
+			Before: change.After,
+			After:  change.Before,
+		})
+	}
+
+	cache.applyRevert(undo)
+}
+
+func (cache *AppManifestCache) recordRevision(record *JournalRecord, before *cacheSnapshot, after *cacheSnapshot) *Revision {
+	versions, releaseSets := diffSnapshots(before, after)
+
+	if len(versions) == 0 && len(releaseSets) == 0 {
+		return nil
+	}
+
+	revision := &Revision{
+		Time:        record.Time,
+		Actor:       record.Actor,
+		Op:          record.Op,
+		Versions:    versions,
+		ReleaseSets: releaseSets,
+	}
+
+	if record.Revert != nil && record.Revert.Revision != nil {
+		revision.RevertTo = *record.Revert.Revision
+	}
+
+	cache.historyMutex.Lock()
+	defer cache.historyMutex.Unlock()
+
+	cache.lastRevisionID++
+	revision.ID = cache.lastRevisionID
+	cache.history = append(cache.history, revision)
+
+	if limit := currentSiteConfig().HistoryLimit; limit > 0 && len(cache.history) > limit {
+		cache.history = append([]*Revision(nil), cache.history[len(cache.history)-limit:]...)
+	}
+
+	return revision
+}
+
+// QueryHistory the kept revisions, the newest first. With the service name, only its changes are listed.
+// At most limit revisions if limit > 0.
+func (cache *AppManifestCache) QueryHistory(serviceName string, limit int) []*Revision {
+	cache.historyMutex.RLock()
+	defer cache.historyMutex.RUnlock()
+
+	res := []*Revision{}
+
+	for i := len(cache.history) - 1; i >= 0 && (limit <= 0 || len(res) < limit); i-- {
+		revision := cache.history[i]
+
+		if serviceName == "" {
+			res = append(res, revision)
+			continue
+		}
+
+		filtered := *revision
+		filtered.Versions = nil
+		filtered.ReleaseSets = nil
+
+		for _, change := range revision.Versions {
+			if change.ServiceName == serviceName {
+				filtered.Versions = append(filtered.Versions, change)
+			}
+		}
+
+		for _, change := range revision.ReleaseSets {
+			if releaseSetChangeHasService(&change, serviceName) {
+				filtered.ReleaseSets = append(filtered.ReleaseSets, change)
+			}
+		}
+
+		if len(filtered.Versions) > 0 || len(filtered.ReleaseSets) > 0 {
+			res = append(res, &filtered)
+		}
+	}
+
+	return res
+}
+
+func releaseSetChangeHasService(change *ReleaseSetChange, serviceName string) bool {
+	for _, set := range []*ReleaseSet{change.Before, change.After} {
+		if set != nil {
+			if _, ok := set.Versions[serviceName]; ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// revertChanges the states to restore for reverting to the revision: for each version (and release set)
+// changed later, its state before the first later change
+func (cache *AppManifestCache) revertChanges(param *AppRevertParam) ([]VersionChange, []ReleaseSetChange, error) {
+	cache.historyMutex.RLock()
+	defer cache.historyMutex.RUnlock()
+
+	if param.Revision == nil {
+		return nil, nil, fmt.Errorf("Missing revision")
+	}
+
+	target := *param.Revision
+
+	if target < 0 || target > cache.lastRevisionID {
+		return nil, nil, fmt.Errorf("Revision %d not found", target)
+	}
+
+	if len(cache.history) > 0 && cache.history[0].ID > target+1 {
+		return nil, nil, fmt.Errorf("Revision %d is out of the kept history, the oldest is %d",
+			target, cache.history[0].ID)
+	}
+
+	versions := []VersionChange{}
+	var releaseSets []ReleaseSetChange
+	restored := map[string]bool{}
+
+	for _, revision := range cache.history {
+		if revision.ID <= target {
+			continue
+		}
+
+		for _, change := range revision.Versions {
+			id := change.ServiceName + "\x00" + change.VersionKey
+
+			if (param.ServiceName != "" && change.ServiceName != param.ServiceName) || restored[id] {
+				continue
+			}
+
+			restored[id] = true
+			versions = append(versions, VersionChange{
+				ServiceName: change.ServiceName,
+				VersionKey:  change.VersionKey,
+				After:       change.Before,
+			})
+		}
+
+		for _, change := range revision.ReleaseSets {
+			if param.ServiceName != "" {
+				// the versions of a set are restored together with the set
+				if releaseSetChangeHasService(&change, param.ServiceName) {
+					return nil, nil, fmt.Errorf("'%s' is changed by release set '%s' in revision %d, revert the whole site instead",
+						param.ServiceName, change.Name, revision.ID)
+				}
+
+				continue
+			}
+
+			if !restored["\x00"+change.Name] {
+				restored["\x00"+change.Name] = true
+				releaseSets = append(releaseSets, ReleaseSetChange{Name: change.Name, After: change.Before})
+			}
+		}
+	}
+
+	return versions, releaseSets, nil
+}
+
+// revertServices the sorted services changed by the revert
+func revertServices(versions []VersionChange) []string {
+	serviceMap := map[string]bool{}
+	services := []string{}
+
+	for _, change := range versions {
+		if !serviceMap[change.ServiceName] {
+			serviceMap[change.ServiceName] = true
+			services = append(services, change.ServiceName)
+		}
+	}
+
+	sort.Strings(services)
+	return services
+}
+
+// RevertToRevision restore a service, or the whole site, to the state after the revision in one revision
+func (cache *AppManifestCache) RevertToRevision(actor string, param *AppRevertParam) (*Revision, error) {
+	cache.releaseSetMutex.Lock()
+	defer cache.releaseSetMutex.Unlock()
+
+	// the services to lock are known from the history, check them again after locking
+	for retry := 0; retry < 3; retry++ {
+		versions, _, err := cache.revertChanges(param)
+
+		if err != nil {
+			return nil, err
+		}
+
+		services := revertServices(versions)
+		unlock := cache.lockServices(services)
+		versions, releaseSets, err := cache.revertChanges(param)
+
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+
+		if !reflect.DeepEqual(services, revertServices(versions)) {
+			unlock()
+			continue
+		}
+
+		revert := &AppRevertParam{Revision: param.Revision, ServiceName: param.ServiceName}
+
+		for _, change := range versions {
+			if current := cache.findAppVersionByKey(change.ServiceName, change.VersionKey); !reflect.DeepEqual(current, change.After) {
+				revert.Versions = append(revert.Versions, change)
+			}
+		}
+
+		for _, change := range releaseSets {
+			if current := cache.releaseSets[change.Name]; !reflect.DeepEqual(current, change.After) {
+				revert.ReleaseSets = append(revert.ReleaseSets, change)
+			}
+		}
+
+		if len(revert.Versions) == 0 && len(revert.ReleaseSets) == 0 {
+			unlock()
+			return nil, fmt.Errorf("Nothing to revert, it's the same as revision %d", *param.Revision)
+		}
+
+		revision, _, err := cache.commitMutation(&JournalRecord{Op: journalOpRevert, Actor: actor, Revert: revert},
+			func() bool {
+				cache.applyRevert(revert)
+				return true
+			})
+
+		unlock()
+		return revision, err
+	}
+
+	return nil, fmt.Errorf("The history is changing, try again later")
+}
+
+// applyRevert restore the versions and release sets. NOTE: Leave cache.FrameworkRuntimes unchanged.
+func (cache *AppManifestCache) applyRevert(param *AppRevertParam) {
+	for _, change := range param.Versions {
+		value, ok := cache.ServiceManifests.Load(change.ServiceName)
+
+		if !ok {
+			value = AppVersionMap{}
+			cache.ServiceManifests.Store(change.ServiceName, value)
+		}
+
+		if change.After == nil {
+			delete(value.(AppVersionMap), change.VersionKey)
+		} else {
+			value.(AppVersionMap)[change.VersionKey] = cloneAppManifest(change.After)
+		}
+	}
+
+	if len(param.ReleaseSets) > 0 && cache.releaseSets == nil {
+		cache.releaseSets = map[string]*ReleaseSet{}
+	}
+
+	for _, change := range param.ReleaseSets {
+		if change.After == nil {
+			delete(cache.releaseSets, change.Name)
+		} else {
+			cache.releaseSets[change.Name] = change.After
+		}
+	}
+}
+
+// serviceNames the names of all services
+func (cache *AppManifestCache) serviceNames() []string {
+	services := []string{}
+
+	cache.ServiceManifests.Range(func(key, value interface{}) bool {
+		services = append(services, key.(string))
+		return true
+	})
+
+	sort.Strings(services)
+	return services
+}
+
+// findAppVersionByKey the installed version, nil if not found. NOTE: lock the service's mutex before calling
+func (cache *AppManifestCache) findAppVersionByKey(serviceName string, versionKey string) *AppManifest {
+	value, ok := cache.ServiceManifests.Load(serviceName)
+
+	if !ok {
+		return nil
+	}
+
+	return value.(AppVersionMap)[versionKey]
+}
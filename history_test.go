@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAppManifestCache_history(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rmf-history")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "journal.jsonl")
+
+	cache := NewAppManifestCache()
+
+	if err := cache.ReplayJournal(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	v1 := GitRevision{Tag: "v1"}
+	v2 := GitRevision{Tag: "v2"}
+	install := func(actor string, serviceName string, git GitRevision) {
+		if _, err := cache.InstallAppVersion(actor, &AppInstallParam{Manifest: AppManifest{
+			ServiceName: serviceName,
+			GitRevision: git,
+			Extra:       MetadataExtra{},
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versionKeys := func(cache *AppManifestCache, serviceName string) []string {
+		keys := []string{}
+
+		for _, manifest := range cache.serviceVersions(serviceName) {
+			keys = append(keys, manifest.GitRevision.GetVersionKey()+":"+manifest.Extra[activationPercentKey])
+		}
+
+		return keys
+	}
+
+	// revisions 1 to 4
+	install("alice", "rmf-a", v1)
+	install("alice", "rmf-a", v2)
+	cache.UpdateAppExtra("bob", []AppUpdateExtraParam{
+		{ServiceName: "rmf-a", GitRevision: v1, Extra: MetadataExtra{activationPercentKey: "20"}},
+	})
+	install("bob", "rmf-b", v1)
+
+	history := cache.QueryHistory("rmf-a", 0)
+	ids := []int64{}
+
+	for _, revision := range history {
+		ids = append(ids, revision.ID)
+	}
+
+	if !reflect.DeepEqual(ids, []int64{3, 2, 1}) {
+		t.Fatalf("QueryHistory() IDs = %v, want [3 2 1]", ids)
+	}
+
+	if change := history[0].Versions[0]; history[0].Actor != "bob" || change.Before.Extra[activationPercentKey] != "" ||
+		change.After.Extra[activationPercentKey] != "20" {
+		t.Errorf("QueryHistory() newest = %+v, want the extra updated by bob", history[0])
+	}
+
+	revision, err := cache.RevertToRevision("carol", &AppRevertParam{Revision: int64Pointer(1), ServiceName: "rmf-a"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if revision.ID != 5 || revision.RevertTo != 1 || len(revision.Versions) != 2 {
+		t.Errorf("RevertToRevision() = %+v, want revision 5 of 2 versions", revision)
+	}
+
+	if got := versionKeys(cache, "rmf-a"); !reflect.DeepEqual(got, []string{"v1_:"}) {
+		t.Errorf("rmf-a versions after reverting = %v, want [v1_:]", got)
+	}
+
+	if got := versionKeys(cache, "rmf-b"); len(got) != 1 {
+		t.Errorf("rmf-b versions after reverting rmf-a = %v, want unchanged", got)
+	}
+
+	if _, err := cache.RevertToRevision("carol", &AppRevertParam{Revision: int64Pointer(1),
+		ServiceName: "rmf-a"}); err == nil {
+		t.Errorf("RevertToRevision() to the current state, want error")
+	}
+
+	if _, err := cache.RevertToRevision("carol", &AppRevertParam{ServiceName: "rmf-a"}); err == nil {
+		t.Errorf("RevertToRevision() without the revision, want error")
+	}
+
+	if _, err := cache.RevertToRevision("carol", &AppRevertParam{Revision: int64Pointer(99)}); err == nil {
+		t.Errorf("RevertToRevision() to a missing revision, want error")
+	}
+
+	// revert the revert, then the whole site
+	if _, err := cache.RevertToRevision("carol", &AppRevertParam{Revision: int64Pointer(4)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := versionKeys(cache, "rmf-a"); len(got) != 2 {
+		t.Errorf("rmf-a versions after reverting to 4 = %v, want 2 versions", got)
+	}
+
+	if _, err := cache.RevertToRevision("carol", &AppRevertParam{Revision: int64Pointer(0)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(versionKeys(cache, "rmf-a")) != 0 || len(versionKeys(cache, "rmf-b")) != 0 {
+		t.Errorf("versions after reverting the site to 0 = %v %v, want none",
+			versionKeys(cache, "rmf-a"), versionKeys(cache, "rmf-b"))
+	}
+
+	cache.journal.Close()
+
+	// the history is rebuilt from the journal with the same revisions
+	restarted := NewAppManifestCache()
+
+	if err := restarted.ReplayJournal(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	defer restarted.journal.Close()
+
+	want, got := cache.QueryHistory("", 0), restarted.QueryHistory("", 0)
+
+	if len(got) != len(want) {
+		t.Fatalf("replayed %d revisions, want %d", len(got), len(want))
+	}
+
+	for i := range want {
+		if got[i].ID != want[i].ID || got[i].Actor != want[i].Actor || got[i].Op != want[i].Op ||
+			len(got[i].Versions) != len(want[i].Versions) {
+			t.Errorf("replayed revision = %+v, want %+v", got[i], want[i])
+		}
+	}
+}
+
+func TestAppManifestCache_historyOfReleaseSet(t *testing.T) {
+	cache := NewAppManifestCache()
+	set := &AppReleaseSetParam{Name: "feature-x", ActivationPercent: 100, Apps: []AppInstallParam{
+		{Manifest: AppManifest{ServiceName: "rmf-a", GitRevision: GitRevision{Tag: "v2"}, Extra: MetadataExtra{}}},
+	}}
+
+	if err := cache.InstallReleaseSet("alice", set); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cache.RevertToRevision("bob", &AppRevertParam{Revision: int64Pointer(0), ServiceName: "rmf-a"}); err == nil {
+		t.Errorf("RevertToRevision() of a release set's service, want error")
+	}
+
+	if _, err := cache.RevertToRevision("bob", &AppRevertParam{Revision: int64Pointer(0)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cache.QueryReleaseSets()) != 0 || len(cache.serviceVersions("rmf-a")) != 0 {
+		t.Errorf("RevertToRevision() should uninstall the release set with its versions")
+	}
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// jwtClockLeeway tolerate the clock skew between the identity provider and us
+const jwtClockLeeway = time.Minute
+
+// identityWarnings the warnings of the identities sent by the clients, such as the expired JWTs on each request
+var identityWarnings = &throttledWarnings{interval: time.Minute, last: map[string]time.Time{}}
+
+// IdentityConfig where the JWT comes from, how to verify it, and how to map its claims to user groups
+type IdentityConfig struct {
+	JWTCookie   string            `yaml:"jwtCookie"`   // cookie name of the JWT, empty to disable
+	JWTHeader   bool              `yaml:"jwtHeader"`   // read 'Authorization: Bearer {JWT}'
+	SharedKey   string            `yaml:"sharedKey"`   // for HS256, HS384 and HS512
+	JWKSFile    string            `yaml:"jwksFile"`    // JWKS of RSA or EC public keys, for RS* and ES*
+	Issuer      string            `yaml:"issuer"`      // check 'iss' if not empty
+	Audience    string            `yaml:"audience"`    // check 'aud' if not empty
+	GroupsClaim string            `yaml:"groupsClaim"` // a string (split by ',') or an array of strings
+	GroupMap    map[string]string `yaml:"groupMap"`    // claim value to user group, all values are kept if empty
+
+	GroupsHeader   string   `yaml:"groupsHeader"`   // such as 'X-RMF-User-Groups', set by the reverse proxy
+	TrustedProxies []string `yaml:"trustedProxies"` // CIDRs or IPs, the header from others is ignored
+
+	TrustedProxyNets []*net.IPNet `yaml:"-"`
+}
+
+// Enabled check any JWT source is configured
+func (conf *IdentityConfig) Enabled() bool {
+	return conf.JWTCookie != "" || conf.JWTHeader
+}
+
+// MergeFrom merge the identity config from 'other'
+func (conf *IdentityConfig) MergeFrom(other *IdentityConfig) {
+	conf.JWTCookie = other.JWTCookie
+	conf.JWTHeader = other.JWTHeader
+	conf.SharedKey = other.SharedKey
+	conf.JWKSFile = other.JWKSFile
+	conf.Issuer = other.Issuer
+	conf.Audience = other.Audience
+
+	if other.GroupsClaim != "" {
+		conf.GroupsClaim = other.GroupsClaim
+	}
+
+	conf.GroupMap = other.GroupMap
+	conf.GroupsHeader = other.GroupsHeader
+	conf.TrustedProxies = other.TrustedProxies
+	conf.UpdateTrustedProxyNets()
+}
+
+// parseTrustedProxies parse the CIDRs, an IP is a CIDR of itself
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	res := []*net.IPNet{}
+
+	for _, proxy := range proxies {
+		cidr := proxy
+
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s'", proxy)
+		}
+
+		res = append(res, ipNet)
+	}
+
+	return res, nil
+}
+
+// UpdateTrustedProxyNets update TrustedProxyNets by TrustedProxies, see SiteConfig.Validate() for the errors
+func (conf *IdentityConfig) UpdateTrustedProxyNets() {
+	conf.TrustedProxyNets, _ = parseTrustedProxies(conf.TrustedProxies)
+}
+
+// isTrustedProxy check the direct peer of the request, never the forwarded client IP
+func (conf *IdentityConfig) isTrustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+
+	if err != nil {
+		host = remoteAddr
+	}
+
+	return conf.isTrustedIP(net.ParseIP(host))
+}
+
+// isTrustedIP check the IP is in TrustedProxyNets
+func (conf *IdentityConfig) isTrustedIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range conf.TrustedProxyNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getClientIP the peer's IP, or the forwarded one when the peer is a trusted proxy.
+// X-Forwarded-For is walked from the right, each proxy appends its peer, so the first untrusted
+// address is the client. The addresses at the left are set by the client and can't be trusted.
+func getClientIP(c *gin.Context) string {
+	conf := &currentSiteConfig().Identity
+	clientIP, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+
+	if err != nil {
+		clientIP = c.Request.RemoteAddr
+	}
+
+	if !conf.isTrustedProxy(c.Request.RemoteAddr) {
+		return clientIP
+	}
+
+	hops := strings.Split(strings.Join(c.Request.Header["X-Forwarded-For"], ","), ",")
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+
+		if hop == "" {
+			continue
+		}
+
+		ip := net.ParseIP(hop)
+
+		if ip == nil {
+			break
+		}
+
+		clientIP = hop
+
+		if !conf.isTrustedIP(ip) {
+			break
+		}
+	}
+
+	return clientIP
+}
+
+// jsonWebKey a key in JWKS, only the public parts of RSA and EC keys
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// JWTVerifier verify JWT by the shared key or the public keys
+type JWTVerifier struct {
+	conf       *IdentityConfig
+	publicKeys map[string]crypto.PublicKey // kid to key
+}
+
+// NewJWTVerifier new a JWTVerifier, loading the JWKS file if configured
+func NewJWTVerifier(conf *IdentityConfig) (*JWTVerifier, error) {
+	verifier := &JWTVerifier{conf: conf, publicKeys: map[string]crypto.PublicKey{}}
+
+	if conf.JWKSFile == "" {
+		return verifier, nil
+	}
+
+	content, err := ioutil.ReadFile(conf.JWKSFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read JWKS file %s", conf.JWKSFile)
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	if err = json.Unmarshal(content, &jwks); err != nil {
+		return nil, fmt.Errorf("Cannot parse JWKS file %s: %v", conf.JWKSFile, err)
+	}
+
+	for _, key := range jwks.Keys {
+		publicKey, err := key.publicKey()
+
+		if err != nil {
+			log.Printf("[ERROR]  Skip key '%s' in JWKS file %s: %v\n", key.Kid, conf.JWKSFile, err)
+			continue
+		}
+
+		verifier.publicKeys[key.Kid] = publicKey
+	}
+
+	return verifier, nil
+}
+
+func decodeJWTPart(part string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(part, "="))
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	bytes, err := decodeJWTPart(value)
+
+	if err != nil || len(bytes) == 0 {
+		return nil, fmt.Errorf("invalid base64url integer")
+	}
+
+	return new(big.Int).SetBytes(bytes), nil
+}
+
+func (key *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := decodeBigInt(key.N)
+
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeBigInt(key.E)
+
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[key.Crv]
+
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve '%s'", key.Crv)
+		}
+
+		x, err := decodeBigInt(key.X)
+
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeBigInt(key.Y)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type '%s'", key.Kty)
+}
+
+// Verify check the signature and the registered claims, return all claims
+func (verifier *JWTVerifier) Verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	headerJSON, err := decodeJWTPart(parts[0])
+
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return nil, fmt.Errorf("malformed JWT header")
+	}
+
+	signature, err := decodeJWTPart(parts[2])
+
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT signature")
+	}
+
+	if err = verifier.verifySignature(header.Alg, header.Kid, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	claimsJSON, err := decodeJWTPart(parts[1])
+	claims := map[string]interface{}{}
+
+	if err != nil || json.Unmarshal(claimsJSON, &claims) != nil {
+		return nil, fmt.Errorf("malformed JWT claims")
+	}
+
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(jwtClockLeeway)) {
+		return nil, fmt.Errorf("expired JWT")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtClockLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("JWT not valid yet")
+	}
+
+	if verifier.conf.Issuer != "" && claims["iss"] != verifier.conf.Issuer {
+		return nil, fmt.Errorf("unexpected JWT issuer")
+	}
+
+	if verifier.conf.Audience != "" && !stringSliceContainsAny(claimStrings(claims["aud"]), []string{verifier.conf.Audience}) {
+		return nil, fmt.Errorf("unexpected JWT audience")
+	}
+
+	return claims, nil
+}
+
+func jwtHashes(alg string) (func() hash.Hash, crypto.Hash) {
+	switch alg[2:] {
+	case "256":
+		return sha256.New, crypto.SHA256
+	case "384":
+		return sha512.New384, crypto.SHA384
+	case "512":
+		return sha512.New, crypto.SHA512
+	}
+
+	return nil, 0
+}
+
+func (verifier *JWTVerifier) verifySignature(alg string, kid string, signed string, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported JWT alg '%s'", alg)
+	}
+
+	newHash, cryptoHash := jwtHashes(alg)
+
+	if newHash == nil {
+		return fmt.Errorf("unsupported JWT alg '%s'", alg)
+	}
+
+	if strings.HasPrefix(alg, "HS") {
+		if verifier.conf.SharedKey == "" {
+			return fmt.Errorf("no shared key for JWT alg '%s'", alg)
+		}
+
+		mac := hmac.New(newHash, []byte(verifier.conf.SharedKey))
+		mac.Write([]byte(signed))
+
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("invalid JWT signature")
+		}
+
+		return nil
+	}
+
+	publicKey, ok := verifier.publicKeys[kid]
+
+	if !ok {
+		return fmt.Errorf("unknown JWT key '%s'", kid)
+	}
+
+	digest := newHash()
+	digest.Write([]byte(signed))
+	hashed := digest.Sum(nil)
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(key, cryptoHash, hashed, signature) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+
+		if strings.HasPrefix(alg, "ES") && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+
+			if ecdsa.Verify(key, hashed, r, s) {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("invalid JWT signature")
+}
+
+// claimStrings a claim as strings: a string split by ',', or an array of strings
+func claimStrings(claim interface{}) []string {
+	res := []string{}
+
+	switch value := claim.(type) {
+	case string:
+		for _, item := range strings.Split(value, userGroupsSplitSep) {
+			if item = strings.TrimSpace(item); item != "" {
+				res = append(res, item)
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			if str, ok := item.(string); ok && str != "" {
+				res = append(res, str)
+			}
+		}
+	}
+
+	return res
+}
+
+// GroupsFromClaims map the groups claim to user groups
+func (conf *IdentityConfig) GroupsFromClaims(claims map[string]interface{}) []string {
+	values := claimStrings(claims[conf.GroupsClaim])
+
+	if len(conf.GroupMap) == 0 {
+		return values
+	}
+
+	groups := []string{}
+
+	for _, value := range values {
+		if group, ok := conf.GroupMap[value]; ok {
+			groups = append(groups, group)
+		}
+	}
+
+	return groups
+}
+
+// identityVerifierValue the verifier for the config in use, rebuilt after reloading the site config
+type identityVerifierEntry struct {
+	conf     *SiteConfig
+	verifier *JWTVerifier
+}
+
+var identityVerifierValue atomic.Value
+
+func identityVerifier(conf *SiteConfig) *JWTVerifier {
+	if entry, ok := identityVerifierValue.Load().(*identityVerifierEntry); ok && entry.conf == conf {
+		return entry.verifier
+	}
+
+	verifier, err := NewJWTVerifier(&conf.Identity)
+
+	if err != nil {
+		log.Printf("[ERROR]  Identity: %v\n", err)
+		verifier = &JWTVerifier{conf: &conf.Identity, publicKeys: map[string]crypto.PublicKey{}}
+	}
+
+	identityVerifierValue.Store(&identityVerifierEntry{conf: conf, verifier: verifier})
+	return verifier
+}
+
+// getIdentityUserGroups the user groups from a valid JWT in the request, nil without it
+func getIdentityUserGroups(c *gin.Context) []string {
+	conf := currentSiteConfig()
+
+	if !conf.Identity.Enabled() {
+		return nil
+	}
+
+	token := ""
+
+	if conf.Identity.JWTHeader {
+		if authorization := c.GetHeader("Authorization"); len(authorization) > 7 &&
+			strings.EqualFold(authorization[:7], "Bearer ") {
+			token = strings.TrimSpace(authorization[7:])
+		}
+	}
+
+	if token == "" && conf.Identity.JWTCookie != "" {
+		token, _ = c.Cookie(conf.Identity.JWTCookie)
+	}
+
+	if token == "" {
+		return nil
+	}
+
+	claims, err := identityVerifier(conf).Verify(token, time.Now())
+
+	if err != nil {
+		identityWarnings.PrintfByKey("jwt", "[WARN]  Identity: ignore JWT from %s: %v (logged once a minute)\n",
+			getClientIP(c), err)
+		return nil
+	}
+
+	return conf.Identity.GroupsFromClaims(claims)
+}
+
+// getProxyUserGroups the user groups in the header set by a trusted reverse proxy, nil without it
+func getProxyUserGroups(c *gin.Context) []string {
+	conf := currentSiteConfig()
+
+	if conf.Identity.GroupsHeader == "" {
+		return nil
+	}
+
+	value := c.GetHeader(conf.Identity.GroupsHeader)
+
+	if value == "" {
+		return nil
+	}
+
+	if !conf.Identity.isTrustedProxy(c.Request.RemoteAddr) {
+		identityWarnings.PrintfByKey("groupsHeader",
+			"[WARN]  Identity: ignore header %s from untrusted %s (logged once a minute)\n",
+			conf.Identity.GroupsHeader, c.Request.RemoteAddr)
+		return nil
+	}
+
+	return claimStrings(value)
+}
+
+// mergeUserGroups unique groups. The default group is kept only when there is no other group,
+// then the versions for the groups are preferred to the default versions
+func mergeUserGroups(groupLists ...[]string) []string {
+	res := []string{}
+	seen := map[string]bool{}
+
+	for _, groups := range groupLists {
+		for _, group := range groups {
+			if group != defaultUserGroup && !seen[group] {
+				seen[group] = true
+				res = append(res, group)
+			}
+		}
+	}
+
+	if len(res) == 0 {
+		return []string{defaultUserGroup}
+	}
+
+	return res
+}
+
+// getUserGroups the user groups from the session, the identity provider and the trusted reverse proxy
+func getUserGroups(c *gin.Context) []string {
+	return mergeUserGroups(getSessionUserGroups(c), getIdentityUserGroups(c), getProxyUserGroups(c))
+}
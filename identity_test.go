@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func signTestJWT(t *testing.T, header, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	headerJSON, _ := json.Marshal(header)
+	claimsJSON, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func TestJWTVerifier_Verify(t *testing.T) {
+	now := time.Now()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "rmf-identity")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	jwksFile := filepath.Join(dir, "jwks.json")
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		}},
+	})
+
+	if err = ioutil.WriteFile(jwksFile, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &IdentityConfig{
+		SharedKey:   "secret",
+		JWKSFile:    jwksFile,
+		Issuer:      "https://idp.example.com",
+		Audience:    "rmf",
+		GroupsClaim: "groups",
+		GroupMap:    map[string]string{"qa-team": "tester"},
+	}
+
+	verifier, err := NewJWTVerifier(conf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs256 := func(key string) func([]byte) []byte {
+		return func(signed []byte) []byte {
+			mac := hmac.New(sha256.New, []byte(key))
+			mac.Write(signed)
+			return mac.Sum(nil)
+		}
+	}
+	rs256 := func(signed []byte) []byte {
+		hashed := sha256.Sum256(signed)
+		signature, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, hashed[:])
+		return signature
+	}
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		res := map[string]interface{}{
+			"iss":    conf.Issuer,
+			"aud":    []string{"other", "rmf"},
+			"exp":    now.Add(time.Hour).Unix(),
+			"groups": []string{"qa-team", "unknown"},
+		}
+
+		for key, value := range changes {
+			res[key] = value
+		}
+
+		return res
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		groups []string
+	}{
+		{"HS256", signTestJWT(t, map[string]interface{}{"alg": "HS256"}, claims(nil), hs256("secret")), []string{"tester"}},
+		{"RS256", signTestJWT(t, map[string]interface{}{"alg": "RS256", "kid": "k1"}, claims(nil), rs256), []string{"tester"}},
+		{"wrong key", signTestJWT(t, map[string]interface{}{"alg": "HS256"}, claims(nil), hs256("other")), nil},
+		{"unknown kid", signTestJWT(t, map[string]interface{}{"alg": "RS256", "kid": "k2"}, claims(nil), rs256), nil},
+		{"alg none", signTestJWT(t, map[string]interface{}{"alg": "none"}, claims(nil), func([]byte) []byte { return nil }), nil},
+		{"expired", signTestJWT(t, map[string]interface{}{"alg": "HS256"},
+			claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}), hs256("secret")), nil},
+		{"not before", signTestJWT(t, map[string]interface{}{"alg": "HS256"},
+			claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()}), hs256("secret")), nil},
+		{"wrong issuer", signTestJWT(t, map[string]interface{}{"alg": "HS256"},
+			claims(map[string]interface{}{"iss": "https://evil.example.com"}), hs256("secret")), nil},
+		{"wrong audience", signTestJWT(t, map[string]interface{}{"alg": "HS256"},
+			claims(map[string]interface{}{"aud": "other"}), hs256("secret")), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var groups []string
+
+			if claims, err := verifier.Verify(tt.token, now); err == nil {
+				groups = conf.GroupsFromClaims(claims)
+			}
+
+			if !reflect.DeepEqual(groups, tt.groups) {
+				t.Errorf("Verify() groups = %v, want %v", groups, tt.groups)
+			}
+		})
+	}
+}
+
+func Test_mergeUserGroups(t *testing.T) {
+	tests := []struct {
+		name       string
+		groupLists [][]string
+		want       []string
+	}{
+		{"default only", [][]string{{defaultUserGroup}, nil}, []string{defaultUserGroup}},
+		{"groups replace default", [][]string{{defaultUserGroup}, {"beta"}}, []string{"beta"}},
+		{"unique", [][]string{{"tester"}, {"beta", "tester"}}, []string{"tester", "beta"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeUserGroups(tt.groupLists...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeUserGroups() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdentityConfig_isTrustedProxy(t *testing.T) {
+	conf := &IdentityConfig{TrustedProxies: []string{"127.0.0.1", "10.0.0.0/8", "::1"}}
+	conf.UpdateTrustedProxyNets()
+
+	tests := []struct {
+		remoteAddr string
+		want       bool
+	}{
+		{"127.0.0.1:5000", true},
+		{"10.1.2.3:5000", true},
+		{"[::1]:5000", true},
+		{"192.168.1.1:5000", false},
+		{"bad", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr, func(t *testing.T) {
+			if got := conf.isTrustedProxy(tt.remoteAddr); got != tt.want {
+				t.Errorf("isTrustedProxy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getClientIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	previous := currentSiteConfig()
+	defer storeSiteConfig(previous)
+
+	conf := previous.Clone()
+	conf.Identity.TrustedProxies = []string{"127.0.0.1", "10.0.0.0/8"}
+	conf.Identity.UpdateTrustedProxyNets()
+	storeSiteConfig(conf)
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"direct", "192.168.1.1:5000", nil, "192.168.1.1"},
+		{"untrusted peer", "192.168.1.1:5000", []string{"1.2.3.4"}, "192.168.1.1"},
+		{"trusted proxy", "127.0.0.1:5000", []string{"1.2.3.4"}, "1.2.3.4"},
+		{"spoofed", "127.0.0.1:5000", []string{"6.6.6.6, 1.2.3.4"}, "1.2.3.4"},
+		{"proxy chain", "127.0.0.1:5000", []string{"6.6.6.6, 1.2.3.4, 10.1.1.1"}, "1.2.3.4"},
+		{"multiple headers", "127.0.0.1:5000", []string{"6.6.6.6", "1.2.3.4"}, "1.2.3.4"},
+		{"only proxies", "127.0.0.1:5000", []string{"10.1.1.1"}, "10.1.1.1"},
+		{"no header", "127.0.0.1:5000", nil, "127.0.0.1"},
+		{"invalid hop", "127.0.0.1:5000", []string{"1.2.3.4, bad, 10.1.1.1"}, "10.1.1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+			c.Request.RemoteAddr = tt.remoteAddr
+			c.Request.Header.Set("X-Real-IP", "7.7.7.7")
+
+			for _, value := range tt.forwardedFor {
+				c.Request.Header.Add("X-Forwarded-For", value)
+			}
+
+			if got := getClientIP(c); got != tt.want {
+				t.Errorf("getClientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -9,7 +9,9 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -21,15 +23,19 @@ type WalkAppsResult struct {
 }
 
 const (
-	appDirPrefix               = "rmf-"
-	polyfillServiceName        = "polyfill"
-	frameworkServiceName       = "framework"
-	frameworkRuntimeFilePrefix = "runtime-framework."
-	userGroupKey               = "userGroup"
-	activationPercentKey       = "activationPercent"
-	testerUserGroup            = "tester"
-	defaultUserGroup           = ""
-	userGroupsSplitSep         = ","
+	appDirPrefix                 = "rmf-"
+	polyfillServiceName          = "polyfill"
+	frameworkServiceName         = "framework"
+	frameworkRuntimeFilePrefix   = "runtime-framework."
+	userGroupKey                 = "userGroup"
+	activationPercentKey         = "activationPercent"
+	activationPercentByGroupKey  = "activationPercentByGroup"
+	activationPercentOtherGroups = "*"
+	targetingKey                 = "targeting"
+	releaseSetKey                = "releaseSet"
+	testerUserGroup              = "tester"
+	defaultUserGroup             = ""
+	userGroupsSplitSep           = ","
 )
 
 var manifestFileNameRegexp = regexp.MustCompile(`^rmf-manifest([.\-_].+)?\.json$`)
@@ -125,16 +131,32 @@ func noCacheMiddleware(ctx *gin.Context) {
 	ctx.Next()
 }
 
+// mutationErrorStatus 500 if the change can't be written to the journal, or 400 for the invalid change
+func mutationErrorStatus(err error) int {
+	if _, ok := err.(*JournalWriteError); ok {
+		return http.StatusInternalServerError
+	}
+
+	return http.StatusBadRequest
+}
+
 func main() {
 	parseFlags()
 
 	if siteConfigFile != "" {
-		LoadSiteConfig(siteConfigFile)
+		if conf, err := LoadSiteConfig(siteConfigFile); err == nil {
+			storeSiteConfig(conf)
+		} else {
+			log.Printf("[ERROR]  %v\n", err)
+		}
 	}
 
-	globalSiteConfig.UpdateExtraKeysHiddenMap()
+	// NOTE: only the startup settings are read from 'siteConfig', requests read currentSiteConfig() for reloading
+	siteConfig := currentSiteConfig()
+	warnAdminCredentials(siteConfig)
+	warnSessionSign(siteConfig)
 
-	walkAppsResult := walkAppFiles(globalSiteConfig.StartupInitDir)
+	walkAppsResult := walkAppFiles(siteConfig.StartupInitDir)
 	// fmt.Printf("WalkAppsResult: %v\", walkAppsResult)
 	cache := NewAppManifestCache()
 
@@ -142,77 +164,361 @@ func main() {
 		cache.LoadAppManifest(filename)
 	}
 
-	cache.CacheFrameworkRuntimes(globalSiteConfig.StartupInitDir)
+	cache.CacheFrameworkRuntimes(siteConfig.StartupInitDir)
+
+	// runtime installs are replayed after the files on disk, before serving traffic
+	if siteConfig.ManifestJournalFile != "" {
+		if err := cache.ReplayJournal(siteConfig.ManifestJournalFile); err != nil {
+			log.Printf("[ERROR]  %v\n", err)
+		}
+	}
+
+	var auditLog *AuditLog
+
+	if siteConfig.AuditLogFile != "" {
+		var err error
+
+		if auditLog, err = OpenAuditLog(siteConfig.AuditLogFile); err != nil {
+			log.Printf("[ERROR]  Cannot open audit log %s: %v\n", siteConfig.AuditLogFile, err)
+		}
+	}
+
+	var exposureLog *ExposureLog
+
+	if siteConfig.ExposureLog.File != "" {
+		var err error
+
+		if exposureLog, err = OpenExposureLog(&siteConfig.ExposureLog); err != nil {
+			log.Printf("[ERROR]  Cannot open exposure log %s: %v\n", siteConfig.ExposureLog.File, err)
+		}
+	}
+
+	webhooks.Run()
+	go watchRolloutSteps(cache, rolloutWatchInterval)
+
+	if siteConfig.WatchStartupInitDir {
+		watcher := NewManifestWatcher(cache, siteConfig.StartupInitDir)
+		go watcher.Run(time.Duration(siteConfig.WatchInterval) * time.Second)
+	}
 
 	// fmt.Printf("Cache ServiceManifests: %+v\n", cache.ServiceManifests)
 	// fmt.Printf("Cache FrameworkRuntimes: %+v\n", cache.FrameworkRuntimes)
 
-	if globalSiteConfig.GinReleaseMode {
+	if siteConfigFile != "" {
+		go reloadSiteConfigOnSignal(siteConfigFile)
+
+		if siteConfig.WatchSiteConfig {
+			go reloadSiteConfigOnChange(siteConfigFile, time.Duration(siteConfig.WatchInterval)*time.Second)
+		}
+	}
+
+	if siteConfig.GinReleaseMode {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
 	engine := gin.Default()
+
+	if siteConfig.EnableMetrics {
+		engine.Use(metricsMiddleware)
+		engine.GET("/metrics", noCacheMiddleware, adminAuthMiddleware(adminRoleReader), metricsHandler(cache))
+	}
+
 	sessionMiddleware := createSessionMiddleware()
 
+	if siteConfig.EnableBeacon {
+		engine.POST("/api/metrics/beacon", noCacheMiddleware, beaconHandler(cache))
+
+		if file := siteConfig.VersionHealth.File; file != "" {
+			if err := versionHealth.Load(file); err != nil {
+				log.Printf("[ERROR]  Cannot load version health %s: %v\n", file, err)
+			}
+
+			go saveVersionHealthPeriodically(file, time.Duration(siteConfig.VersionHealth.SaveInterval)*time.Second)
+		}
+
+		go NewCanaryGuard(cache, auditLog).Run()
+	}
+
 	engine.GET("/healthz", noCacheMiddleware, func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"message": "OK",
 		})
 	})
 
-	metadataRouterGroup := engine.Group("/api/metadata").Use(sessionMiddleware, noCacheMiddleware)
+	metadataRouterGroup := engine.Group("/api/metadata").Use(stickyIDMiddleware, sessionMiddleware, noCacheMiddleware)
 
 	metadataRouterGroup.GET("/info", func(c *gin.Context) {
 		userGroups := getUserGroups(c)
-		info := cache.GenerateMetadata(GenMetadataParam{userGroups, true})
+		param := GenMetadataParam{
+			UserGroups:      userGroups,
+			IsInlineRuntime: true,
+			SessionID:       getStickyID(c),
+			Targeting:       NewTargetingContext(c, userGroups),
+		}
+		info := cache.GenerateMetadata(param)
+		exposureLog.Log(exposureSourceInfo, &param, info)
+
+		conf := currentSiteConfig()
 
 		c.JSONP(http.StatusOK, &Metadata{
 			Apps:  info.OtherApps,
-			Extra: globalSiteConfig.SafeExtra(globalSiteConfig.Extra),
+			Extra: conf.SafeExtra(conf.Extra),
 		})
 	})
 
-	metadataRouterGroup.POST("/install-app-version", func(c *gin.Context) {
+	// admin API: no session, each route requires a role
+	adminRouterGroup := engine.Group("/api/metadata").Use(noCacheMiddleware, mutationGateMiddleware, auditMiddleware(auditLog))
+
+	adminRouterGroup.POST("/install-app-version", adminAuthMiddleware(adminRoleDeployer), func(c *gin.Context) {
 		var param AppInstallParam
 
 		if err := c.BindJSON(&param); err != nil {
 			return
 		}
 
-		ok := cache.InstallAppVersion(&param)
+		warnings, err := cache.InstallAppVersion(adminActor(c), &param)
+
+		if err != nil {
+			c.JSON(mutationErrorStatus(err), gin.H{
+				"install": false,
+				"error":   err.Error(),
+			})
+			return
+		}
 
 		c.JSON(http.StatusOK, gin.H{
-			"install": ok,
+			"install":  true,
+			"warnings": warnings,
 		})
 	})
 
-	metadataRouterGroup.POST("/uninstall-app-version", func(c *gin.Context) {
+	adminRouterGroup.POST("/uninstall-app-version", adminAuthMiddleware(adminRoleDeployer), func(c *gin.Context) {
 		var param AppUninstallParam
 
 		if err := c.BindJSON(&param); err != nil {
 			return
 		}
 
-		ok := cache.UninstallAppVersion(&param)
+		ok, err := cache.UninstallAppVersion(adminActor(c), &param)
+
+		if err != nil {
+			c.JSON(mutationErrorStatus(err), gin.H{
+				"uninstall": false,
+				"error":     err.Error(),
+			})
+			return
+		}
+
 		c.JSON(http.StatusOK, gin.H{
 			"uninstall": ok,
 		})
 	})
 
-	metadataRouterGroup.POST("/update-app-extra", func(c *gin.Context) {
+	adminRouterGroup.POST("/update-app-extra", adminAuthMiddleware(adminRoleDeployer), func(c *gin.Context) {
 		var params []AppUpdateExtraParam
 
 		if err := c.BindJSON(&params); err != nil {
 			return
 		}
 
-		ok := cache.UpdateAppExtra(params)
+		for _, param := range params {
+			if err := checkAppExtra(param.Extra); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"update": false,
+					"error":  err.Error(),
+				})
+				return
+			}
+		}
+
+		ok, err := cache.UpdateAppExtra(adminActor(c), params)
+
+		if err != nil {
+			c.JSON(mutationErrorStatus(err), gin.H{
+				"update": false,
+				"error":  err.Error(),
+			})
+			return
+		}
+
 		c.JSON(http.StatusOK, gin.H{
 			"update": ok,
 		})
 	})
 
-	metadataRouterGroup.GET("/query-app-versions", func(c *gin.Context) {
+	rolloutHandlers := map[string]func(actor string, param *AppRolloutParam) (*AppRollout, error){
+		"/set-rollout":    cache.SetAppRollout,
+		"/pause-rollout":  cache.PauseAppRollout,
+		"/resume-rollout": cache.ResumeAppRollout,
+		"/abort-rollout":  cache.AbortAppRollout,
+	}
+
+	for path, handler := range rolloutHandlers {
+		handler := handler
+
+		adminRouterGroup.POST(path, adminAuthMiddleware(adminRoleDeployer), func(c *gin.Context) {
+			var param AppRolloutParam
+
+			if err := c.BindJSON(&param); err != nil {
+				return
+			}
+
+			rollout, err := handler(adminActor(c), &param)
+
+			if err != nil {
+				c.JSON(mutationErrorStatus(err), gin.H{
+					"rollout": nil,
+					"error":   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{
+				"rollout": rollout,
+			})
+		})
+	}
+
+	adminRouterGroup.POST("/install-release-set", adminAuthMiddleware(adminRoleDeployer), func(c *gin.Context) {
+		var param AppReleaseSetParam
+
+		if err := c.BindJSON(&param); err != nil {
+			return
+		}
+
+		if err := cache.InstallReleaseSet(adminActor(c), &param); err != nil {
+			c.JSON(mutationErrorStatus(err), gin.H{
+				"install": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"install": true,
+		})
+	})
+
+	adminRouterGroup.POST("/uninstall-release-set", adminAuthMiddleware(adminRoleDeployer), func(c *gin.Context) {
+		var param AppReleaseSetParam
+
+		if err := c.BindJSON(&param); err != nil {
+			return
+		}
+
+		ok, err := cache.UninstallReleaseSet(adminActor(c), &param)
+
+		if err != nil {
+			c.JSON(mutationErrorStatus(err), gin.H{
+				"uninstall": false,
+				"error":     err.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"uninstall": ok,
+		})
+	})
+
+	adminRouterGroup.POST("/update-release-set", adminAuthMiddleware(adminRoleDeployer), func(c *gin.Context) {
+		var param AppReleaseSetParam
+
+		if err := c.BindJSON(&param); err != nil {
+			return
+		}
+
+		if err := cache.UpdateReleaseSet(adminActor(c), &param); err != nil {
+			c.JSON(mutationErrorStatus(err), gin.H{
+				"update": false,
+				"error":  err.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"update": true,
+		})
+	})
+
+	adminRouterGroup.GET("/query-release-sets", adminAuthMiddleware(adminRoleReader), func(c *gin.Context) {
+		c.JSON(http.StatusOK, cache.QueryReleaseSets())
+	})
+
+	adminRouterGroup.GET("/query-history", adminAuthMiddleware(adminRoleReader), func(c *gin.Context) {
+		limit, _ := strconv.Atoi(c.Query("limit"))
+		c.JSON(http.StatusOK, cache.QueryHistory(c.Query("id"), limit))
+	})
+
+	adminRouterGroup.POST("/revert", adminAuthMiddleware(adminRoleDeployer), func(c *gin.Context) {
+		var param AppRevertParam
+
+		if err := c.BindJSON(&param); err != nil {
+			return
+		}
+
+		revision, err := cache.RevertToRevision(adminActor(c), &param)
+
+		if err != nil {
+			c.JSON(mutationErrorStatus(err), gin.H{
+				"revert": false,
+				"error":  err.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"revert":   true,
+			"revision": revision,
+		})
+	})
+
+	adminRouterGroup.GET("/query-audit", adminAuthMiddleware(adminRoleReader), func(c *gin.Context) {
+		query := &AuditQuery{ServiceName: c.Query("id")}
+		query.Limit, _ = strconv.Atoi(c.Query("limit"))
+
+		for _, item := range []struct {
+			name  string
+			value *time.Time
+		}{{"since", &query.Since}, {"until", &query.Until}} {
+			if text := c.Query(item.name); text != "" {
+				t, err := time.Parse(time.RFC3339, text)
+
+				if err != nil {
+					c.AbortWithError(http.StatusBadRequest, fmt.Errorf("Invalid '%s', require RFC 3339 time", item.name))
+					return
+				}
+
+				*item.value = t
+			}
+		}
+
+		records, err := auditLog.Query(query)
+
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, records)
+	})
+
+	adminRouterGroup.GET("/query-version-health", adminAuthMiddleware(adminRoleReader), func(c *gin.Context) {
+		window, err := strconv.Atoi(c.DefaultQuery("window", "60"))
+
+		if err != nil || window < 1 {
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("Invalid window, require minutes at least 1"))
+			return
+		}
+
+		c.JSON(http.StatusOK, versionHealth.Summary(c.Query("id"), time.Now().Add(-time.Duration(window)*time.Minute)))
+	})
+
+	adminRouterGroup.GET("/query-webhook-deliveries", adminAuthMiddleware(adminRoleReader), func(c *gin.Context) {
+		c.JSON(http.StatusOK, webhooks.Attempts(c.Query("failed") == "true"))
+	})
+
+	adminRouterGroup.GET("/query-app-versions", adminAuthMiddleware(adminRoleReader), func(c *gin.Context) {
 		appID := c.Query("id")
 
 		if appID == "" {
@@ -223,6 +529,32 @@ func main() {
 		cache.QueryAppVersions(c, appID)
 	})
 
+	adminRouterGroup.POST("/reload-site-config", adminAuthMiddleware(adminRoleDeployer), func(c *gin.Context) {
+		if siteConfigFile == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"reload": false,
+				"error":  "No site config file to reload",
+			})
+			return
+		}
+
+		result, err := ReloadSiteConfig(siteConfigFile)
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"reload": false,
+				"error":  err.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"reload":      true,
+			"changed":     result.Changed,
+			"needRestart": result.NeedRestart,
+		})
+	})
+
 	userRouterGroup := engine.Group("/api/user").Use(sessionMiddleware, noCacheMiddleware)
 
 	userRouterGroup.GET("/is-tester", func(c *gin.Context) {
@@ -238,6 +570,11 @@ func main() {
 	})
 
 	userRouterGroup.POST("/login-as-tester", func(c *gin.Context) {
+		if !currentSiteConfig().EnableTesterLogin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Tester login is disabled"})
+			return
+		}
+
 		var isTester bool
 
 		if err := c.BindJSON(&isTester); err != nil {
@@ -260,17 +597,32 @@ func main() {
 		c.Status(http.StatusOK)
 	})
 
-	if globalSiteConfig.EnableServeStatic {
+	if siteConfig.EnableServeStatic {
 		// Fix invalid MIME type in windows
 		mime.AddExtensionType(".js", "text/javascript")
 
-		serveDirsAndFiles(engine, &walkAppsResult, globalSiteConfig.StartupInitDir)
+		serveDirsAndFiles(engine, siteConfig.StartupInitDir)
 	}
 
-	// SPA
-	engine.NoRoute(sessionMiddleware, noCacheMiddleware, func(c *gin.Context) {
+	noRouteHandlers := []gin.HandlerFunc{}
+
+	if siteConfig.EnableServeStatic {
+		noRouteHandlers = append(noRouteHandlers, appStaticMiddleware(siteConfig.StartupInitDir))
+	}
+
+	// SPA, only for navigation requests
+	noRouteHandlers = append(noRouteHandlers, notFoundMiddleware, stickyIDMiddleware)
+	noRouteHandlers = append(noRouteHandlers, sessionMiddleware, noCacheMiddleware, func(c *gin.Context) {
+		c.Set(metricsRouteGroupKey, metricsGroupSPA)
 		userGroups := getUserGroups(c)
-		info := cache.GenerateMetadata(GenMetadataParam{userGroups, true})
+		param := GenMetadataParam{
+			UserGroups:      userGroups,
+			IsInlineRuntime: true,
+			SessionID:       getStickyID(c),
+			Targeting:       NewTargetingContext(c, userGroups),
+		}
+		info := cache.GenerateMetadata(param)
+		exposureLog.Log(exposureSourceSPA, &param, info)
 		// fmt.Printf("INFO %+v\n", info)
 		userAgent := c.Request.UserAgent()
 		HTML, pushLink := info.GenerateIndexHTML(userAgent)
@@ -282,6 +634,20 @@ func main() {
 		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(HTML))
 	})
 
-	fmt.Println("Serve on: ", globalSiteConfig.ListenAddress)
-	engine.Run(globalSiteConfig.ListenAddress)
+	engine.NoRoute(noRouteHandlers...)
+
+	// the new process may have compacted the journal before failing
+	if err := runServer(engine, siteConfig, cache.ReopenJournal); err != nil && err != http.ErrServerClosed {
+		log.Printf("[ERROR]  Serve on %s: %v\n", siteConfig.ListenAddress, err)
+	}
+
+	cache.CloseJournal()
+	auditLog.Close()
+	exposureLog.Close()
+
+	if siteConfig.EnableBeacon && siteConfig.VersionHealth.File != "" {
+		if err := versionHealth.Save(siteConfig.VersionHealth.File); err != nil {
+			log.Printf("[ERROR]  Cannot save version health %s: %v\n", siteConfig.VersionHealth.File, err)
+		}
+	}
 }
@@ -3,8 +3,10 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
 	"path"
@@ -20,6 +22,8 @@ import (
 type GenMetadataParam struct {
 	UserGroups      []string
 	IsInlineRuntime bool
+	SessionID       string            // the client's sticky ID, keep the selected versions sticky for it, random if empty
+	Targeting       *TargetingContext // the request for the targeting rules, the targeted versions are skipped if nil
 }
 
 // AppFilterItem the app item found
@@ -36,6 +40,16 @@ type AppManifestCache struct {
 	FrameworkRuntimes sync.Map // entry URL to runtime JS contents, as map[key string]string
 	ServiceManifests  sync.Map // serviceName to AppVersionMap, as map[key string]AppVersionMap
 	ServiceMutexes    sync.Map // serviceName to *RWMutex, for per app's Query or Changing
+
+	journal   *ManifestJournal // write each mutation when persisting is enabled
+	replaying bool             // applying the journal at startup, no events are dispatched
+
+	releaseSetMutex sync.RWMutex
+	releaseSets     map[string]*ReleaseSet // name to set, replaced as a whole when changing
+
+	historyMutex   sync.RWMutex
+	history        []*Revision // the newest last, at most SiteConfig.HistoryLimit
+	lastRevisionID int64
 }
 
 // NewAppManifestCache new an AppManifestCache
@@ -45,18 +59,15 @@ func NewAppManifestCache() *AppManifestCache {
 
 // LoadAppManifest cache each Manifest file
 func (cache *AppManifestCache) LoadAppManifest(filename string) {
-	content, err := ioutil.ReadFile(filename)
+	manifest, err := readAppManifest(filename)
 
 	if err != nil {
-		log.Printf("[ERROR]  Cannot read file %s\n", filename)
+		log.Printf("[ERROR]  %v\n", err)
 		return
 	}
 
-	var manifest AppManifest
-	err = json.Unmarshal(content, &manifest)
-
-	if err != nil {
-		log.Printf("[ERROR]  Unmarshal file %s to AppManifest\n", filename)
+	if err = checkAppManifest(manifest); err != nil {
+		log.Printf("[ERROR]  Skip %s: %v\n", filename, err)
 		return
 	}
 
@@ -69,10 +80,27 @@ func (cache *AppManifestCache) LoadAppManifest(filename string) {
 		cache.ServiceManifests.Store(manifest.ServiceName, appManifests)
 	}
 
-	appManifests[manifest.GitRevision.GetVersionKey()] = &manifest
+	appManifests[manifest.GitRevision.GetVersionKey()] = manifest
 	// fmt.Printf("manifest: %+v\n", manifest)
 }
 
+func readAppManifest(filename string) (*AppManifest, error) {
+	content, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read file %s", filename)
+	}
+
+	var manifest AppManifest
+	err = json.Unmarshal(content, &manifest)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unmarshal file %s to AppManifest", filename)
+	}
+
+	return &manifest, nil
+}
+
 // CacheFrameworkRuntimes cache framework runtimes
 func (cache *AppManifestCache) CacheFrameworkRuntimes(baseDir string) {
 	value, ok := cache.ServiceManifests.Load(frameworkServiceName)
@@ -98,13 +126,12 @@ func (cache *AppManifestCache) CacheFrameworkRuntimes(baseDir string) {
 	}
 }
 
-func readRuntimeContent(baseDir string, entry string) (string, error) {
+// findRuntimeFile find the runtime file for the entry URL, by its last 3, 2 or 1 path parts
+func findRuntimeFile(baseDir string, entry string) string {
 	entryParts := strings.Split(entry, "/")
 	partsLen := len(entryParts)
-	var content []byte
-	var err error
 
-	readRuntime := func(validPathParts int) bool {
+	for validPathParts := 3; validPathParts > 0; validPathParts-- {
 		start := 0
 
 		if partsLen > validPathParts {
@@ -115,19 +142,24 @@ func readRuntimeContent(baseDir string, entry string) (string, error) {
 		filename := path.Join(parts...)
 
 		if exist, _ := pathExists(filename); exist {
-			content, err = ioutil.ReadFile(filename)
-
-			if err == nil {
-				return true
-			}
+			return filename
 		}
-
-		return false
 	}
 
-	ok := readRuntime(3) || readRuntime(2) || readRuntime(1)
+	return ""
+}
 
-	if !ok {
+func readRuntimeContent(baseDir string, entry string) (string, error) {
+	var content []byte
+	var err error
+
+	filename := findRuntimeFile(baseDir, entry)
+
+	if filename != "" {
+		content, err = ioutil.ReadFile(filename)
+	}
+
+	if filename == "" || err != nil {
 		log.Printf("[ERROR]  Cannot read runtime content for %s\n", entry)
 		return "", fmt.Errorf("Cannot read runtime content")
 	}
@@ -147,7 +179,103 @@ func stringSliceContainsAny(a, b []string) bool {
 	return false
 }
 
-func calcActivationPercent(manifest *AppManifest) int {
+// parseActivationPercentByGroup parse such as "tester:100,beta:50,*:5", the '*' is for the other users
+func parseActivationPercentByGroup(value string) (map[string]int, error) {
+	res := map[string]int{}
+
+	for _, item := range strings.Split(value, userGroupsSplitSep) {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		sep := strings.LastIndex(item, ":")
+
+		if sep < 0 {
+			return nil, fmt.Errorf("Invalid %s item '%s', require 'group:percent'", activationPercentByGroupKey, item)
+		}
+
+		percent, err := strconv.Atoi(strings.TrimSpace(item[sep+1:]))
+
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("Invalid %s item '%s', require percent from 0 to 100", activationPercentByGroupKey, item)
+		}
+
+		res[strings.TrimSpace(item[:sep])] = percent
+	}
+
+	return res, nil
+}
+
+// checkAppExtra check the values in extra, which are used for selecting versions
+func checkAppExtra(extra MetadataExtra) error {
+	if _, ok := extra[releaseSetKey]; ok {
+		return fmt.Errorf("Extra '%s' is set by install-release-set, not by the caller", releaseSetKey)
+	}
+
+	if value, ok := extra[activationPercentByGroupKey]; ok {
+		if _, err := parseActivationPercentByGroup(value); err != nil {
+			return err
+		}
+	}
+
+	return checkTargeting(extra)
+}
+
+// checkAppManifest check the extra and the rollout, which are used for selecting versions
+func checkAppManifest(manifest *AppManifest) error {
+	if manifest.Rollout != nil {
+		if err := manifest.Rollout.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if manifest.FrameworkVersion != "" {
+		if _, err := compileSemverRange(manifest.FrameworkVersion); err != nil {
+			return fmt.Errorf("Invalid frameworkVersion \"%s\": %v", manifest.FrameworkVersion, err)
+		}
+	}
+
+	return checkAppExtra(manifest.Extra)
+}
+
+// calcActivationPercent the percent for the user. With 'activationPercentByGroup', the largest percent of
+// the user's groups; else the percent of the rollout schedule; else the percent of '*' for the other users;
+// else 'activationPercent'. It's 0 before the rollout activates the version, or after aborting the rollout.
+func calcActivationPercent(manifest *AppManifest, userGroups []string) int {
+	now := time.Now()
+
+	if manifest.Rollout != nil && !manifest.Rollout.IsActive(now) {
+		return 0
+	}
+
+	var percents map[string]int
+
+	if value, ok := manifest.Extra[activationPercentByGroupKey]; ok {
+		percents, _ = parseActivationPercentByGroup(value)
+	}
+
+	activationPercent, found := 0, false
+
+	for _, group := range userGroups {
+		if percent, ok := percents[group]; ok && (!found || percent > activationPercent) {
+			activationPercent, found = percent, true
+		}
+	}
+
+	if found {
+		return activationPercent
+	}
+
+	if manifest.Rollout != nil {
+		if percent, ok := manifest.Rollout.Percent(now); ok {
+			return percent
+		}
+	}
+
+	if percent, ok := percents[activationPercentOtherGroups]; ok {
+		return percent
+	}
+
 	if value, ok := manifest.Extra[activationPercentKey]; ok {
 		activationPercent, err := strconv.Atoi(value)
 
@@ -166,42 +294,96 @@ func calcActivationPercent(manifest *AppManifest) int {
 	return 100
 }
 
-func filterUserManifests(manifests AppVersionMap, userGroups []string) (
+// filterUserManifests the versions for the user's groups, and the default versions. A version with 'targeting'
+// is only for the requests matching the rule, and preferred to the versions without it. The versions in
+// release sets are skipped, see selectReleaseSets().
+func filterUserManifests(manifests AppVersionMap, userGroups []string, targeting *TargetingContext) (
 	matches []AppFilterItem, defaults []AppFilterItem) {
 	matches = []AppFilterItem{}
 	defaults = []AppFilterItem{}
+	targetedMatches := []AppFilterItem{}
 	defaultGroups := []string{defaultUserGroup}
 
 	for _, manifest := range manifests {
+		// a version in a release set is only selected with the set
+		if _, ok := manifest.Extra[releaseSetKey]; ok {
+			continue
+		}
+
 		groupsInExtra := defaultGroups
+		value, hasUserGroup := manifest.Extra[userGroupKey]
 
-		if value, ok := manifest.Extra[userGroupKey]; ok {
+		if hasUserGroup {
 			groupsInExtra = strings.Split(value, userGroupsSplitSep)
 		}
 
-		activationPercent := calcActivationPercent(manifest)
+		activationPercent := calcActivationPercent(manifest, userGroups)
 
 		if activationPercent < 1 {
 			continue
 		}
 
 		item := AppFilterItem{App: manifest, ActivationPercent: activationPercent}
+		targeted, matched := matchTargeting(manifest, targeting)
+
+		if !matched {
+			continue
+		}
 
-		if stringSliceContainsAny(groupsInExtra, userGroups) {
+		if targeted {
+			if !hasUserGroup || stringSliceContainsAny(groupsInExtra, userGroups) {
+				targetedMatches = append(targetedMatches, item)
+			}
+		} else if stringSliceContainsAny(groupsInExtra, userGroups) {
 			matches = append(matches, item)
 		} else if stringSliceContainsAny(groupsInExtra, defaultGroups) {
 			defaults = append(defaults, item)
 		}
 	}
 
+	if len(targetedMatches) > 0 {
+		return targetedMatches, defaults
+	}
+
 	return matches, defaults
 }
 
-func selectAppByActivationPercent(r *rand.Rand, manifests []AppFilterItem) int {
+// mixHash64 the finalizer of SplitMix64, FNV alone spreads the last bytes badly into the high bits
+func mixHash64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// selectAppByActivationPercent select an app weighted by ActivationPercent. With a sticky key (such
+// as session ID and service name), it uses weighted rendezvous hashing: the same key always gets the same
+// version, on any server instance, until the weights change in a way that excludes that version.
+func selectAppByActivationPercent(r *rand.Rand, stickyKey string, manifests []AppFilterItem) int {
 	selIdx := 0
 	mLen := len(manifests)
 
-	if mLen > 1 {
+	if mLen > 1 && stickyKey != "" {
+		maxScore := math.Inf(-1)
+
+		for i := 0; i < mLen; i++ {
+			hash := fnv.New64a()
+			hash.Write([]byte(stickyKey))
+			hash.Write([]byte{0})
+			hash.Write([]byte(manifests[i].App.GitRevision.GetVersionKey()))
+
+			// uniform in (0, 1), then the largest ln(u)/weight wins
+			u := (float64(mixHash64(hash.Sum64())>>11) + 0.5) / (1 << 53)
+			score := math.Log(u) / float64(manifests[i].ActivationPercent)
+
+			if score > maxScore {
+				maxScore = score
+				selIdx = i
+			}
+		}
+	} else if mLen > 1 {
 		sum := 0
 		steps := make([]int, mLen)
 
@@ -222,14 +404,60 @@ func selectAppByActivationPercent(r *rand.Rand, manifests []AppFilterItem) int {
 	return selIdx
 }
 
+// selectServiceApp select the service's version for the user: the version of the user's release set, else
+// one of the versions filtered for the user, by the activation percents. Only the versions compatible with
+// the framework are selected; if none of them is, the newest compatible version of all the versions filtered for
+// the user (also the defaults) is the fallback.
+// NOTE: lock the service's mutex before calling
+func selectServiceApp(serviceName string, versions AppVersionMap, param *GenMetadataParam, r *rand.Rand,
+	releaseSetVersion string, frameworkTag string) *AppManifest {
+	if manifest, ok := versions[releaseSetVersion]; ok && isFrameworkCompatible(manifest, frameworkTag) {
+		return manifest
+	}
+
+	matches, defaults := filterUserManifests(versions, param.UserGroups, param.Targeting)
+	manifests := defaults
+
+	if len(matches) > 0 {
+		manifests = matches
+	}
+
+	// guard for defaults is empty
+	if len(manifests) == 0 {
+		return nil
+	}
+
+	compatibles := filterFrameworkCompatible(manifests, frameworkTag)
+
+	if len(compatibles) == 0 {
+		return newestCompatibleVersion(append(append([]AppFilterItem{}, matches...), defaults...), frameworkTag)
+	}
+
+	stickyKey := ""
+
+	if param.SessionID != "" {
+		stickyKey = param.SessionID + "/" + serviceName
+	}
+
+	return compatibles[selectAppByActivationPercent(r, stickyKey, compatibles)].App
+}
+
 // GenerateMetadata Generate Metadata for user request
 func (cache *AppManifestCache) GenerateMetadata(param GenMetadataParam) *MetadataInfoForRequest {
-	info := &MetadataInfoForRequest{}
+	info := &MetadataInfoForRequest{SelectedVersions: map[string]string{}}
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	releaseSets := cache.selectReleaseSets(r, param.SessionID)
+	releaseSetVersions := map[string]string{}
+	frameworkTag := ""
+
+	// a set with the framework is checked against its own framework version
+	for _, set := range releaseSets {
+		if framework, ok := set.Versions[frameworkServiceName]; ok && cache.isReleaseSetCompatible(set, framework.Tag) {
+			releaseSetVersions[frameworkServiceName] = framework.GetVersionKey()
+		}
+	}
 
-	cache.ServiceManifests.Range(func(key, value interface{}) bool {
-		serviceName := key.(string)
-
+	selectService := func(serviceName string, versions AppVersionMap) {
 		// lock AppVersionMap when using it's content
 		mtxValue, _ := cache.ServiceMutexes.LoadOrStore(serviceName, &sync.RWMutex{})
 		mtx := mtxValue.(*sync.RWMutex)
@@ -237,33 +465,73 @@ func (cache *AppManifestCache) GenerateMetadata(param GenMetadataParam) *Metadat
 		mtx.RLock()
 		defer mtx.RUnlock()
 
-		// filter app versions for the user
-		matches, defaults := filterUserManifests(value.(AppVersionMap), param.UserGroups)
-		manifests := defaults
+		selectedApp := selectServiceApp(serviceName, versions, &param, r, releaseSetVersions[serviceName], frameworkTag)
 
-		if len(matches) > 0 {
-			manifests = matches
+		if selectedApp == nil {
+			return
 		}
 
-		// guard for defaults is empty
-		if len(manifests) == 0 {
-			return true
-		}
-
-		selIdx := selectAppByActivationPercent(r, manifests)
-		app := manifests[selIdx].App.ConvertToMetadataApp()
+		serverMetrics.ObserveSelection(serviceName, selectedApp.GitRevision.GetVersionKey(), param.UserGroups)
+		info.SelectedVersions[serviceName] = selectedApp.GitRevision.GetVersionKey()
+		app := selectedApp.ConvertToMetadataApp()
 
 		if serviceName == polyfillServiceName {
 			info.PolyfillApp = *app
 		} else if serviceName == frameworkServiceName {
+			frameworkTag = selectedApp.GitRevision.Tag
 			cache.AppendFrameworkAppInfo(info, app, param.IsInlineRuntime)
 		} else {
 			info.OtherApps = append(info.OtherApps, *app)
 		}
+	}
+
+	// the framework first, the other apps must be compatible with it
+	if value, ok := cache.ServiceManifests.Load(frameworkServiceName); ok {
+		selectService(frameworkServiceName, value.(AppVersionMap))
+	}
+
+	// then the other sets against the selected framework, a set is dropped as a whole if any version is incompatible
+	for _, set := range releaseSets {
+		if framework, ok := set.Versions[frameworkServiceName]; ok &&
+			info.SelectedVersions[frameworkServiceName] != framework.GetVersionKey() {
+			continue
+		}
+
+		if !cache.isReleaseSetCompatible(set, frameworkTag) {
+			continue
+		}
+
+		for serviceName, gitRevision := range set.Versions {
+			releaseSetVersions[serviceName] = gitRevision.GetVersionKey()
+		}
+	}
+
+	cache.ServiceManifests.Range(func(key, value interface{}) bool {
+		if serviceName := key.(string); serviceName != frameworkServiceName {
+			selectService(serviceName, value.(AppVersionMap))
+		}
 
 		return true
 	})
 
+	// polyfill and framework are always loaded before the other apps
+	selected := map[string]bool{}
+
+	if info.PolyfillApp.ID != "" {
+		selected[info.PolyfillApp.ID] = true
+	}
+
+	if info.FrameworkApp.ID != "" {
+		selected[info.FrameworkApp.ID] = true
+	}
+
+	info.OtherApps = resolveAppDependencies(info.OtherApps, selected)
+
+	// the deliveries are the base of the error rates of the client reports
+	if currentSiteConfig().EnableBeacon {
+		versionHealth.ObserveDeliveries(param.SessionID, info.DeliveredVersions(), time.Now())
+	}
+
 	return info
 }
 
@@ -295,14 +563,54 @@ func (cache *AppManifestCache) AppendFrameworkAppInfo(
 }
 
 // InstallAppVersion Install an new App version after the static files have been deployed.
-func (cache *AppManifestCache) InstallAppVersion(app *AppInstallParam) bool {
+// Reject it when some dependencies have no installed version. Return the warnings of framework
+// compatibility, see frameworkCompatibilityWarnings().
+func (cache *AppManifestCache) InstallAppVersion(actor string, app *AppInstallParam) ([]string, error) {
+	if err := checkAppManifest(&app.Manifest); err != nil {
+		return nil, err
+	}
+
+	// the steps of a rollout start from installing, by default
+	if app.Manifest.Rollout != nil {
+		app.Manifest.Rollout.normalize(time.Now())
+	}
+
+	// check before locking, the dependencies' mutexes are locked for reading
+	if err := cache.checkAppDependencies(&app.Manifest); err != nil {
+		return nil, err
+	}
+
 	// lock AppVersionMap when changing it's content
 	mtxValue, _ := cache.ServiceMutexes.LoadOrStore(app.Manifest.ServiceName, &sync.RWMutex{})
 	mtx := mtxValue.(*sync.RWMutex)
 
 	mtx.Lock()
-	defer mtx.Unlock()
 
+	if err := cache.releaseSetMemberError(app.Manifest.ServiceName, &app.Manifest.GitRevision); err != nil {
+		mtx.Unlock()
+		return nil, err
+	}
+
+	_, _, err := cache.commitMutation(&JournalRecord{Op: journalOpInstall, Actor: actor, Install: app}, func() bool {
+		cache.applyInstallAppVersion(app)
+		return true
+	})
+	mtx.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	warnings := cache.frameworkCompatibilityWarnings(&app.Manifest)
+
+	for _, warning := range warnings {
+		log.Printf("[WARN]  Install '%s' %s: %s\n", app.Manifest.ServiceName, app.Manifest.GitRevision.GetVersionKey(), warning)
+	}
+
+	return warnings, nil
+}
+
+func (cache *AppManifestCache) applyInstallAppVersion(app *AppInstallParam) {
 	// Save the runtime thunk's content first
 	for url, content := range app.FrameworkRuntimes {
 		cache.FrameworkRuntimes.Store(url, content)
@@ -318,18 +626,54 @@ func (cache *AppManifestCache) InstallAppVersion(app *AppInstallParam) bool {
 		appManifests = AppVersionMap{}
 	}
 
-	version := app.Manifest.GitRevision.GetVersionKey()
-	appManifests[version] = &app.Manifest
+	manifest := app.Manifest
+	version := manifest.GitRevision.GetVersionKey()
+	appManifests[version] = &manifest
 
 	if !ok {
 		cache.ServiceManifests.Store(app.Manifest.ServiceName, appManifests)
 	}
-
-	return true
 }
 
 // UninstallAppVersion Uninstall an deployed App version. NOTE: Leave cache.FrameworkRuntimes unchanged.
-func (cache *AppManifestCache) UninstallAppVersion(app *AppUninstallParam) bool {
+func (cache *AppManifestCache) UninstallAppVersion(actor string, app *AppUninstallParam) (bool, error) {
+	// lock AppVersionMap when changing it's content
+	mtxValue, _ := cache.ServiceMutexes.LoadOrStore(app.ServiceName, &sync.RWMutex{})
+	mtx := mtxValue.(*sync.RWMutex)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if err := cache.releaseSetMemberError(app.ServiceName, &app.GitRevision); err != nil {
+		return false, err
+	}
+
+	_, isFound, err := cache.commitMutation(&JournalRecord{Op: journalOpUninstall, Actor: actor, Uninstall: app},
+		func() bool {
+			return cache.applyUninstallAppVersion(app)
+		})
+
+	return isFound, err
+}
+
+// releaseSetMemberError reject changing a version of a release set alone, the set is installed, selected and
+// uninstalled as a whole. NOTE: lock the service before calling
+func (cache *AppManifestCache) releaseSetMemberError(serviceName string, gitRevision *GitRevision) error {
+	manifest := cache.findAppVersion(serviceName, gitRevision)
+
+	if manifest == nil {
+		return nil
+	}
+
+	if setName, ok := manifest.Extra[releaseSetKey]; ok {
+		return fmt.Errorf("Version '%s' of '%s' is in release set '%s', change it by install-release-set, "+
+			"update-release-set or uninstall-release-set", gitRevision.GetVersionKey(), serviceName, setName)
+	}
+
+	return nil
+}
+
+func (cache *AppManifestCache) applyUninstallAppVersion(app *AppUninstallParam) bool {
 	value, ok := cache.ServiceManifests.Load(app.ServiceName)
 
 	if !ok {
@@ -338,13 +682,6 @@ func (cache *AppManifestCache) UninstallAppVersion(app *AppUninstallParam) bool
 
 	appManifests := value.(AppVersionMap)
 
-	// lock AppVersionMap when changing it's content
-	mtxValue, _ := cache.ServiceMutexes.LoadOrStore(app.ServiceName, &sync.RWMutex{})
-	mtx := mtxValue.(*sync.RWMutex)
-
-	mtx.Lock()
-	defer mtx.Unlock()
-
 	// Find the version and delete it
 	version := app.GitRevision.GetVersionKey()
 	_, isFound := appManifests[version]
@@ -356,44 +693,78 @@ func (cache *AppManifestCache) UninstallAppVersion(app *AppUninstallParam) bool
 	return isFound
 }
 
-// UpdateAppExtra Update multi deployed Apps' Extra
-func (cache *AppManifestCache) UpdateAppExtra(params []AppUpdateExtraParam) bool {
-	// group params by service name (as App ID)
+// groupUpdateExtraParams group params by service name (as App ID)
+func groupUpdateExtraParams(params []AppUpdateExtraParam) map[string][]*AppUpdateExtraParam {
 	serviceMap := map[string][]*AppUpdateExtraParam{}
 
-	for _, p := range params {
-		slice, ok := serviceMap[p.ServiceName]
+	for i := range params {
+		p := &params[i]
+		serviceMap[p.ServiceName] = append(serviceMap[p.ServiceName], p)
+	}
 
-		if !ok {
-			slice = []*AppUpdateExtraParam{}
-		}
+	return serviceMap
+}
+
+// UpdateAppExtra Update multi deployed Apps' Extra. None is updated if any version is in a release set
+func (cache *AppManifestCache) UpdateAppExtra(actor string, params []AppUpdateExtraParam) (bool, error) {
+	serviceMap := groupUpdateExtraParams(params)
 
-		slice = append(slice, &p)
-		serviceMap[p.ServiceName] = slice
+	for serviceName, params := range serviceMap {
+		if err := cache.checkUpdateOneAppExtra(serviceName, params); err != nil {
+			return false, err
+		}
 	}
 
 	// update each App's Extra
 	hasOK := false
 
 	for serviceName, params := range serviceMap {
-		if cache.UpdateOneAppExtra(serviceName, params) {
+		ok, err := cache.UpdateOneAppExtra(actor, serviceName, params)
+
+		if err != nil {
+			return hasOK, err
+		}
+
+		if ok {
 			hasOK = true
 		}
 	}
 
-	return hasOK
+	return hasOK, nil
 }
 
-// UpdateOneAppExtra Update one deployed App's Extra
-func (cache *AppManifestCache) UpdateOneAppExtra(serviceName string, params []*AppUpdateExtraParam) bool {
-	value, ok := cache.ServiceManifests.Load(serviceName)
+// checkUpdateOneAppExtra check no version in params is in a release set
+func (cache *AppManifestCache) checkUpdateOneAppExtra(serviceName string, params []*AppUpdateExtraParam) error {
+	mtxValue, _ := cache.ServiceMutexes.LoadOrStore(serviceName, &sync.RWMutex{})
+	mtx := mtxValue.(*sync.RWMutex)
 
-	if !ok {
-		return false
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	for _, param := range params {
+		if err := cache.releaseSetMemberError(serviceName, &param.GitRevision); err != nil {
+			return err
+		}
 	}
 
-	appVersionMap := value.(AppVersionMap)
+	return nil
+}
+
+func (cache *AppManifestCache) applyUpdateAppExtra(params []AppUpdateExtraParam) bool {
+	hasOK := false
+
+	for serviceName, params := range groupUpdateExtraParams(params) {
+		if cache.applyUpdateOneAppExtra(serviceName, params) {
+			hasOK = true
+		}
+	}
 
+	return hasOK
+}
+
+// UpdateOneAppExtra Update one deployed App's Extra
+func (cache *AppManifestCache) UpdateOneAppExtra(actor string, serviceName string, params []*AppUpdateExtraParam) (
+	bool, error) {
 	// lock AppVersionMap when changing it's content
 	mtxValue, _ := cache.ServiceMutexes.LoadOrStore(serviceName, &sync.RWMutex{})
 	mtx := mtxValue.(*sync.RWMutex)
@@ -401,6 +772,34 @@ func (cache *AppManifestCache) UpdateOneAppExtra(serviceName string, params []*A
 	mtx.Lock()
 	defer mtx.Unlock()
 
+	for _, param := range params {
+		if err := cache.releaseSetMemberError(serviceName, &param.GitRevision); err != nil {
+			return false, err
+		}
+	}
+
+	record := &JournalRecord{Op: journalOpUpdateExtra, Actor: actor}
+
+	for _, param := range params {
+		record.UpdateExtra = append(record.UpdateExtra, *param)
+	}
+
+	_, hasOK, err := cache.commitMutation(record, func() bool {
+		return cache.applyUpdateOneAppExtra(serviceName, params)
+	})
+
+	return hasOK, err
+}
+
+func (cache *AppManifestCache) applyUpdateOneAppExtra(serviceName string, params []*AppUpdateExtraParam) bool {
+	value, ok := cache.ServiceManifests.Load(serviceName)
+
+	if !ok {
+		return false
+	}
+
+	appVersionMap := value.(AppVersionMap)
+
 	// update each version in params
 	hasOK := false
 
@@ -408,6 +807,10 @@ func (cache *AppManifestCache) UpdateOneAppExtra(serviceName string, params []*A
 		version := param.GitRevision.GetVersionKey()
 
 		if app, ok := appVersionMap[version]; ok {
+			if app.Extra == nil {
+				app.Extra = MetadataExtra{}
+			}
+
 			// Merge each K-V, not replace all
 			for key, value := range param.Extra {
 				app.Extra[key] = value
@@ -438,5 +841,77 @@ func (cache *AppManifestCache) QueryAppVersions(ctx *gin.Context, serviceName st
 	mtx.RLock()
 	defer mtx.RUnlock()
 
-	ctx.JSON(http.StatusOK, appVersionMap)
+	splits := calcActivationSplits(appVersionMap)
+	res := map[string]AppVersionQueryItem{}
+
+	for versionKey, manifest := range appVersionMap {
+		res[versionKey] = AppVersionQueryItem{AppManifest: manifest, ActivationSplit: splits[versionKey]}
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+// AppVersionQueryItem the manifest, and the percent of the users getting it in each group
+type AppVersionQueryItem struct {
+	*AppManifest
+	ActivationSplit map[string]float64 `json:"activationSplit"`
+}
+
+// calcActivationSplits the percent of the users getting each version, by version key then user group.
+// The groups are those in 'userGroup' and 'activationPercentByGroup', and '*' for the other users.
+// NOTE: the versions with 'targeting' depend on the request, they are not counted.
+func calcActivationSplits(manifests AppVersionMap) map[string]map[string]float64 {
+	groups := map[string]bool{activationPercentOtherGroups: true}
+
+	for _, manifest := range manifests {
+		if value, ok := manifest.Extra[userGroupKey]; ok {
+			for _, group := range strings.Split(value, userGroupsSplitSep) {
+				if group != defaultUserGroup {
+					groups[group] = true
+				}
+			}
+		}
+
+		if percents, err := parseActivationPercentByGroup(manifest.Extra[activationPercentByGroupKey]); err == nil {
+			for group := range percents {
+				if group != defaultUserGroup {
+					groups[group] = true
+				}
+			}
+		}
+	}
+
+	splits := map[string]map[string]float64{}
+
+	for versionKey := range manifests {
+		splits[versionKey] = map[string]float64{}
+	}
+
+	for group := range groups {
+		userGroups := []string{group}
+
+		if group == activationPercentOtherGroups {
+			userGroups = []string{defaultUserGroup}
+		}
+
+		matches, defaults := filterUserManifests(manifests, userGroups, nil)
+		items := defaults
+
+		if len(matches) > 0 {
+			items = matches
+		}
+
+		sum := 0
+
+		for _, item := range items {
+			sum += item.ActivationPercent
+		}
+
+		for _, item := range items {
+			split := float64(item.ActivationPercent) * 100 / float64(sum)
+			splits[item.App.GitRevision.GetVersionKey()][group] = math.Round(split*100) / 100
+		}
+	}
+
+	return splits
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func newTestFilterItem(tag string, activationPercent int) AppFilterItem {
+	return AppFilterItem{
+		App: &AppManifest{
+			ServiceName: "rmf-test",
+			GitRevision: GitRevision{Tag: tag},
+		},
+		ActivationPercent: activationPercent,
+	}
+}
+
+func Test_selectAppByActivationPercent_sticky(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	manifests := []AppFilterItem{
+		newTestFilterItem("v1", 80),
+		newTestFilterItem("v2", 20),
+	}
+	reversed := []AppFilterItem{manifests[1], manifests[0]}
+	counts := []int{0, 0}
+
+	for i := 0; i < 2000; i++ {
+		stickyKey := fmt.Sprintf("session-%d/rmf-test", i)
+		selIdx := selectAppByActivationPercent(r, stickyKey, manifests)
+
+		for j := 0; j < 5; j++ {
+			if got := selectAppByActivationPercent(r, stickyKey, manifests); got != selIdx {
+				t.Fatalf("selectAppByActivationPercent(%s) = %d, want sticky %d", stickyKey, got, selIdx)
+			}
+		}
+
+		if got := reversed[selectAppByActivationPercent(r, stickyKey, reversed)].App; got != manifests[selIdx].App {
+			t.Fatalf("selectAppByActivationPercent(%s) depends on the order of manifests", stickyKey)
+		}
+
+		counts[selIdx]++
+	}
+
+	if counts[1] < 300 || counts[1] > 500 {
+		t.Errorf("selected v2 %d times in 2000, want about 400", counts[1])
+	}
+}
+
+func Test_selectAppByActivationPercent_stableOnWeightChange(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	before := []AppFilterItem{
+		newTestFilterItem("v1", 80),
+		newTestFilterItem("v2", 20),
+	}
+	after := []AppFilterItem{
+		newTestFilterItem("v1", 50),
+		newTestFilterItem("v2", 50),
+	}
+
+	for i := 0; i < 2000; i++ {
+		stickyKey := fmt.Sprintf("session-%d/rmf-test", i)
+
+		// ramping v2 up never moves its users back to v1
+		if selectAppByActivationPercent(r, stickyKey, before) == 1 &&
+			selectAppByActivationPercent(r, stickyKey, after) != 1 {
+			t.Fatalf("selectAppByActivationPercent(%s) left v2 after ramping it up", stickyKey)
+		}
+	}
+}
+
+func Test_calcActivationPercent_byGroup(t *testing.T) {
+	manifest := &AppManifest{Extra: MetadataExtra{
+		activationPercentKey:        "20",
+		activationPercentByGroupKey: "tester:100, beta:50, *:5",
+	}}
+	noOthers := &AppManifest{Extra: MetadataExtra{
+		activationPercentKey:        "20",
+		activationPercentByGroupKey: "tester:100",
+	}}
+
+	tests := []struct {
+		name       string
+		manifest   *AppManifest
+		userGroups []string
+		want       int
+	}{
+		{"tester", manifest, []string{"tester"}, 100},
+		{"largest of groups", manifest, []string{"beta", "tester"}, 100},
+		{"beta", manifest, []string{"beta"}, 50},
+		{"others", manifest, []string{defaultUserGroup}, 5},
+		{"fallback to activationPercent", noOthers, []string{"beta"}, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := calcActivationPercent(tt.manifest, tt.userGroups); got != tt.want {
+				t.Errorf("calcActivationPercent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_calcActivationSplits(t *testing.T) {
+	v1 := GitRevision{Tag: "v1"}
+	v2 := GitRevision{Tag: "v2"}
+	manifests := AppVersionMap{
+		v1.GetVersionKey(): &AppManifest{GitRevision: v1, Extra: MetadataExtra{}},
+		v2.GetVersionKey(): &AppManifest{GitRevision: v2, Extra: MetadataExtra{
+			activationPercentByGroupKey: "tester:100,beta:50,*:5",
+		}},
+	}
+
+	splits := calcActivationSplits(manifests)
+	want := map[string]map[string]float64{
+		v1.GetVersionKey(): {"tester": 50, "beta": 66.67, "*": 95.24},
+		v2.GetVersionKey(): {"tester": 50, "beta": 33.33, "*": 4.76},
+	}
+
+	if fmt.Sprint(splits) != fmt.Sprint(want) {
+		t.Errorf("calcActivationSplits() = %v, want %v", splits, want)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	journalOpInstall     = "install"
+	journalOpUninstall   = "uninstall"
+	journalOpUpdateExtra = "updateExtra"
+	journalOpSetRollout  = "setRollout"
+
+	journalOpInstallReleaseSet   = "installReleaseSet"
+	journalOpUninstallReleaseSet = "uninstallReleaseSet"
+	journalOpUpdateReleaseSet    = "updateReleaseSet"
+
+	journalOpRevert   = "revert"
+	journalOpSnapshot = "snapshot"
+)
+
+// JournalRecord one mutation of AppManifestCache, as a line in the journal file
+type JournalRecord struct {
+	Op          string                `json:"op"`
+	Time        time.Time             `json:"time"`
+	Actor       string                `json:"actor,omitempty"` // the admin, or the component making the change
+	Install     *AppInstallParam      `json:"install,omitempty"`
+	Uninstall   *AppUninstallParam    `json:"uninstall,omitempty"`
+	UpdateExtra []AppUpdateExtraParam `json:"updateExtra,omitempty"`
+	Rollout     *AppRolloutParam      `json:"rollout,omitempty"`
+	ReleaseSet  *AppReleaseSetParam   `json:"releaseSet,omitempty"`
+	Revert      *AppRevertParam       `json:"revert,omitempty"`
+	Snapshot    *JournalSnapshot      `json:"snapshot,omitempty"`
+}
+
+// JournalSnapshot the versions and release sets changed at runtime against the files on disk, as After.
+// It replaces the records before it when compacting.
+type JournalSnapshot struct {
+	Versions          []VersionChange    `json:"versions"`
+	ReleaseSets       []ReleaseSetChange `json:"releaseSets,omitempty"`
+	FrameworkRuntimes map[string]string  `json:"frameworkRuntimes,omitempty"` // not on disk
+}
+
+// ManifestJournal append-only JSON lines file for the runtime mutations
+type ManifestJournal struct {
+	mutex    sync.Mutex
+	filename string
+	file     *os.File
+}
+
+// OpenManifestJournal open (or create) the journal file for appending
+func OpenManifestJournal(filename string) (*ManifestJournal, error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ManifestJournal{filename: filename, file: file}, nil
+}
+
+// readJournalRecords read all records in the journal file. A missing file has no records
+func readJournalRecords(filename string) ([]JournalRecord, error) {
+	file, err := os.Open(filename)
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	records := []JournalRecord{}
+	reader := bufio.NewReader(file)
+	lineNo := 0
+
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		if len(line) > 0 {
+			lineNo++
+			var record JournalRecord
+
+			// a broken line is usually the last one, written partly while crashing
+			if jsonErr := json.Unmarshal(line, &record); jsonErr != nil {
+				log.Printf("[ERROR]  Skip broken journal line %d in %s: %v\n", lineNo, filename, jsonErr)
+			} else {
+				records = append(records, record)
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	return records, nil
+}
+
+// Append write the record and flush it to disk
+func (journal *ManifestJournal) Append(record *JournalRecord) error {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+
+	line, err := json.Marshal(record)
+
+	if err != nil {
+		return err
+	}
+
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	if _, err = journal.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	return journal.file.Sync()
+}
+
+// Reopen open the file again, it may be replaced by compacting
+func (journal *ManifestJournal) Reopen() error {
+	file, err := os.OpenFile(journal.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	journal.file.Close()
+	journal.file = file
+	return nil
+}
+
+// Close close the journal file
+func (journal *ManifestJournal) Close() error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	return journal.file.Close()
+}
+
+// ReplayJournal apply the records in journal file, compact it to one snapshot, then write the later mutations
+// to it
+func (cache *AppManifestCache) ReplayJournal(filename string) error {
+	records, err := readJournalRecords(filename)
+
+	if err != nil {
+		return fmt.Errorf("Cannot read journal %s: %v", filename, err)
+	}
+
+	// the state from the files on disk, the snapshot is the difference after replaying
+	before := cache.snapshot(cache.serviceNames(), true)
+	runtimes := map[string]string{}
+
+	cache.FrameworkRuntimes.Range(func(key, value interface{}) bool {
+		runtimes[key.(string)] = value.(string)
+		return true
+	})
+
+	// rebuild the history of the replayed records too
+	cache.replaying = true
+
+	for i := range records {
+		record := &records[i]
+
+		if record.Actor == "" {
+			record.Actor = actorStartup
+		}
+
+		cache.commitMutation(record, func() bool {
+			cache.applyJournalRecord(record)
+			return true
+		})
+	}
+
+	cache.replaying = false
+
+	if len(records) > 0 {
+		if err := compactJournal(filename, cache.journalSnapshot(before, runtimes)); err != nil {
+			log.Printf("[ERROR]  Cannot compact journal %s: %v\n", filename, err)
+		}
+	}
+
+	journal, err := OpenManifestJournal(filename)
+
+	if err != nil {
+		return fmt.Errorf("Cannot open journal %s: %v", filename, err)
+	}
+
+	cache.journal = journal
+	log.Printf("[INFO]  Replayed %d records from journal %s\n", len(records), filename)
+	return nil
+}
+
+// journalSnapshot the changes against the state before replaying, and the framework runtimes added by replaying.
+// NOTE: call it before serving, the services are not locked
+func (cache *AppManifestCache) journalSnapshot(before *cacheSnapshot, runtimes map[string]string) *JournalSnapshot {
+	versions, releaseSets := diffSnapshots(before, cache.snapshot(cache.serviceNames(), true))
+	res := &JournalSnapshot{Versions: versions, ReleaseSets: releaseSets, FrameworkRuntimes: map[string]string{}}
+
+	// only the state after is replayed
+	for i := range res.Versions {
+		res.Versions[i].Before = nil
+	}
+
+	for i := range res.ReleaseSets {
+		res.ReleaseSets[i].Before = nil
+	}
+
+	cache.FrameworkRuntimes.Range(func(key, value interface{}) bool {
+		if content, ok := runtimes[key.(string)]; !ok || content != value.(string) {
+			res.FrameworkRuntimes[key.(string)] = value.(string)
+		}
+
+		return true
+	})
+
+	return res
+}
+
+// compactJournal replace the journal file with the snapshot, or with nothing when there are no changes
+func compactJournal(filename string, snapshot *JournalSnapshot) error {
+	tmpFilename := filename + ".tmp"
+	file, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	if len(snapshot.Versions) > 0 || len(snapshot.ReleaseSets) > 0 || len(snapshot.FrameworkRuntimes) > 0 {
+		var line []byte
+
+		if line, err = json.Marshal(&JournalRecord{Op: journalOpSnapshot, Time: time.Now(), Actor: actorStartup,
+			Snapshot: snapshot}); err == nil {
+			_, err = file.Write(append(line, '\n'))
+		}
+	}
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmpFilename, filename)
+	}
+
+	if err != nil {
+		os.Remove(tmpFilename)
+	}
+
+	return err
+}
+
+// ReopenJournal open the journal file again if the journal is enabled
+func (cache *AppManifestCache) ReopenJournal() {
+	if cache.journal == nil {
+		return
+	}
+
+	if err := cache.journal.Reopen(); err != nil {
+		log.Printf("[ERROR]  Cannot reopen journal %s: %v\n", cache.journal.filename, err)
+	}
+}
+
+// CloseJournal close the journal file if the journal is enabled
+func (cache *AppManifestCache) CloseJournal() {
+	if cache.journal != nil {
+		cache.journal.Close()
+	}
+}
+
+func (cache *AppManifestCache) applyJournalRecord(record *JournalRecord) {
+	switch record.Op {
+	case journalOpInstall:
+		if record.Install != nil {
+			cache.applyInstallAppVersion(record.Install)
+		}
+	case journalOpUninstall:
+		if record.Uninstall != nil {
+			cache.applyUninstallAppVersion(record.Uninstall)
+		}
+	case journalOpUpdateExtra:
+		cache.applyUpdateAppExtra(record.UpdateExtra)
+	case journalOpSetRollout:
+		if record.Rollout != nil {
+			cache.applySetAppRollout(record.Rollout)
+		}
+	case journalOpInstallReleaseSet:
+		if record.ReleaseSet != nil {
+			cache.applyInstallReleaseSet(record.ReleaseSet)
+		}
+	case journalOpUninstallReleaseSet:
+		if record.ReleaseSet != nil {
+			cache.applyUninstallReleaseSet(record.ReleaseSet)
+		}
+	case journalOpUpdateReleaseSet:
+		if record.ReleaseSet != nil {
+			cache.applyUpdateReleaseSet(record.ReleaseSet)
+		}
+	case journalOpRevert:
+		if record.Revert != nil {
+			cache.applyRevert(record.Revert)
+		}
+	case journalOpSnapshot:
+		if record.Snapshot != nil {
+			for url, content := range record.Snapshot.FrameworkRuntimes {
+				cache.FrameworkRuntimes.Store(url, content)
+			}
+
+			cache.applyRevert(&AppRevertParam{Versions: record.Snapshot.Versions, ReleaseSets: record.Snapshot.ReleaseSets})
+		}
+	default:
+		log.Printf("[ERROR]  Unknown journal op '%s'\n", record.Op)
+	}
+}
+
+// JournalWriteError the mutation is not applied, because the journal can't be written
+type JournalWriteError struct {
+	Op  string
+	Err error
+}
+
+func (e *JournalWriteError) Error() string {
+	return fmt.Sprintf("Cannot write journal for '%s': %v", e.Op, e.Err)
+}
+
+// writeJournal append the record if the journal is enabled
+func (cache *AppManifestCache) writeJournal(record *JournalRecord) error {
+	if cache.journal == nil {
+		return nil
+	}
+
+	if err := cache.journal.Append(record); err != nil {
+		log.Printf("[ERROR]  Cannot write journal for '%s': %v\n", record.Op, err)
+		return &JournalWriteError{Op: record.Op, Err: err}
+	}
+
+	return nil
+}
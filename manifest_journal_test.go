@@ -0,0 +1,204 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAppManifestCache_ReplayJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rmf-journal")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "journal.jsonl")
+
+	v1 := GitRevision{Tag: "v1.0.0", Short: "aaaaaaa"}
+	v2 := GitRevision{Tag: "v2.0.0", Short: "bbbbbbb"}
+
+	cache := NewAppManifestCache()
+
+	if err := cache.ReplayJournal(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.InstallAppVersion("tester", &AppInstallParam{
+		Manifest:          AppManifest{ServiceName: frameworkServiceName, GitRevision: v1, Extra: MetadataExtra{}},
+		FrameworkRuntimes: map[string]string{"/rmf-framework/runtime-framework.1.js": "var a = 1;"},
+	})
+	cache.InstallAppVersion("tester", &AppInstallParam{
+		Manifest: AppManifest{ServiceName: frameworkServiceName, GitRevision: v2, Extra: MetadataExtra{}},
+	})
+	cache.UpdateAppExtra("tester", []AppUpdateExtraParam{
+		{ServiceName: frameworkServiceName, GitRevision: v1, Extra: MetadataExtra{activationPercentKey: "20"}},
+	})
+	cache.UninstallAppVersion("tester", &AppUninstallParam{ServiceName: frameworkServiceName, GitRevision: v2})
+	cache.journal.Close()
+
+	restarted := NewAppManifestCache()
+
+	if err := restarted.ReplayJournal(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	defer restarted.journal.Close()
+
+	value, ok := restarted.ServiceManifests.Load(frameworkServiceName)
+
+	if !ok {
+		t.Fatalf("service %s not replayed", frameworkServiceName)
+	}
+
+	versions := value.(AppVersionMap)
+
+	if len(versions) != 1 {
+		t.Errorf("replayed %d versions, want 1", len(versions))
+	}
+
+	if app, ok := versions[v1.GetVersionKey()]; !ok || app.Extra[activationPercentKey] != "20" {
+		t.Errorf("replayed version %s = %+v, want activationPercent 20", v1.GetVersionKey(), app)
+	}
+
+	if content, ok := restarted.FrameworkRuntimes.Load("/rmf-framework/runtime-framework.1.js"); !ok || content != "var a = 1;" {
+		t.Errorf("replayed framework runtime = %v, want 'var a = 1;'", content)
+	}
+}
+
+func TestAppManifestCache_ReplayJournal_compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rmf-journal")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "journal.jsonl")
+
+	onDisk := GitRevision{Tag: "v1.0.0"}
+	atRuntime := GitRevision{Tag: "v2.0.0"}
+
+	// the version loaded from the startup dir
+	newCache := func() *AppManifestCache {
+		cache := NewAppManifestCache()
+		cache.applyInstallAppVersion(&AppInstallParam{Manifest: AppManifest{
+			ServiceName: "rmf-a", GitRevision: onDisk, Extra: MetadataExtra{},
+		}})
+		cache.FrameworkRuntimes.Store("/rmf-framework/runtime-framework.1.js", "var disk = 1;")
+		return cache
+	}
+
+	cache := newCache()
+
+	if err := cache.ReplayJournal(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		cache.InstallAppVersion("tester", &AppInstallParam{
+			Manifest: AppManifest{ServiceName: "rmf-a", GitRevision: atRuntime, Extra: MetadataExtra{}},
+			FrameworkRuntimes: map[string]string{
+				"/rmf-framework/runtime-framework.1.js": "var disk = 1;",
+				"/rmf-framework/runtime-framework.2.js": "var b = 2;",
+			},
+		})
+	}
+
+	cache.UpdateAppExtra("tester", []AppUpdateExtraParam{
+		{ServiceName: "rmf-a", GitRevision: atRuntime, Extra: MetadataExtra{activationPercentKey: "30"}},
+	})
+	cache.UninstallAppVersion("tester", &AppUninstallParam{ServiceName: "rmf-a", GitRevision: onDisk})
+	cache.journal.Close()
+
+	// restart twice: replay the records, then replay the snapshot compacted from them
+	for restart := 1; restart <= 2; restart++ {
+		restarted := newCache()
+
+		if err := restarted.ReplayJournal(filename); err != nil {
+			t.Fatal(err)
+		}
+
+		restarted.journal.Close()
+		records, err := readJournalRecords(filename)
+
+		if err != nil || len(records) != 1 || records[0].Op != journalOpSnapshot {
+			t.Fatalf("restart %d: journal = %+v, %v, want one snapshot", restart, records, err)
+		}
+
+		if runtimes := records[0].Snapshot.FrameworkRuntimes; len(runtimes) != 1 || runtimes["/rmf-framework/runtime-framework.2.js"] != "var b = 2;" {
+			t.Errorf("restart %d: snapshot runtimes = %v, want only the one not on disk", restart, runtimes)
+		}
+
+		versions := restarted.serviceVersions("rmf-a")
+
+		if len(versions) != 1 || versions[0].GitRevision != atRuntime || versions[0].Extra[activationPercentKey] != "30" {
+			t.Errorf("restart %d: versions = %+v, want only %s with activationPercent 30", restart, versions,
+				atRuntime.GetVersionKey())
+		}
+	}
+}
+
+func TestAppManifestCache_writeJournalError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rmf-journal")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "journal.jsonl")
+
+	v1 := GitRevision{Tag: "v1.0.0", Short: "aaaaaaa"}
+	v2 := GitRevision{Tag: "v2.0.0", Short: "bbbbbbb"}
+
+	cache := NewAppManifestCache()
+
+	if err := cache.ReplayJournal(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.InstallAppVersion("tester", &AppInstallParam{
+		Manifest: AppManifest{ServiceName: frameworkServiceName, GitRevision: v1, Extra: MetadataExtra{}},
+	})
+
+	// the writes fail after closing
+	cache.journal.Close()
+	history := len(cache.QueryHistory("", 0))
+
+	if _, err := cache.InstallAppVersion("tester", &AppInstallParam{
+		Manifest: AppManifest{ServiceName: frameworkServiceName, GitRevision: v2, Extra: MetadataExtra{}},
+	}); mutationErrorStatus(err) != http.StatusInternalServerError {
+		t.Errorf("InstallAppVersion() error = %v, want a journal write error", err)
+	}
+
+	if cache.hasAppVersion(frameworkServiceName, &v2) {
+		t.Errorf("InstallAppVersion() should be undone when the journal can't be written")
+	}
+
+	if ok, err := cache.UpdateAppExtra("tester", []AppUpdateExtraParam{
+		{ServiceName: frameworkServiceName, GitRevision: v1, Extra: MetadataExtra{activationPercentKey: "20"}},
+	}); ok || err == nil {
+		t.Errorf("UpdateAppExtra() = %v, want a journal write error", ok)
+	}
+
+	if _, ok := cache.findAppVersion(frameworkServiceName, &v1).Extra[activationPercentKey]; ok {
+		t.Errorf("UpdateAppExtra() should be undone when the journal can't be written")
+	}
+
+	if ok, err := cache.UninstallAppVersion("tester", &AppUninstallParam{ServiceName: frameworkServiceName,
+		GitRevision: v1}); ok || err == nil {
+		t.Errorf("UninstallAppVersion() = %v, want a journal write error", ok)
+	}
+
+	if !cache.hasAppVersion(frameworkServiceName, &v1) {
+		t.Errorf("UninstallAppVersion() should be undone when the journal can't be written")
+	}
+
+	if got := len(cache.QueryHistory("", 0)); got != history {
+		t.Errorf("QueryHistory() has %d revisions, want %d", got, history)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// watchedFile the state of a file when it was scanned last time
+type watchedFile struct {
+	ModTime time.Time
+	Size    int64
+}
+
+// ManifestWatcher poll the startup dir for added, changed and removed manifest files,
+// and the changed framework runtime files
+type ManifestWatcher struct {
+	cache   *AppManifestCache
+	rootDir string
+
+	manifestFiles map[string]watchedFile  // manifest filename to its state
+	manifests     map[string]*AppManifest // manifest filename to the installed manifest
+	runtimeFiles  map[string]watchedFile  // runtime entry URL to its file's state
+}
+
+// NewManifestWatcher new a watcher for the manifests which have been loaded at startup
+func NewManifestWatcher(cache *AppManifestCache, rootDir string) *ManifestWatcher {
+	watcher := &ManifestWatcher{
+		cache:         cache,
+		rootDir:       rootDir,
+		manifestFiles: map[string]watchedFile{},
+		manifests:     map[string]*AppManifest{},
+		runtimeFiles:  map[string]watchedFile{},
+	}
+
+	// baseline: the files on disk have been loaded by main()
+	for _, filename := range walkAppFiles(rootDir).ManifestFiles {
+		if state, ok := statWatchedFile(filename); ok {
+			if manifest, err := readAppManifest(filename); err == nil {
+				watcher.manifestFiles[filename] = state
+				watcher.manifests[filename] = manifest
+				watcher.scanRuntimeFiles(manifest, false)
+			}
+		}
+	}
+
+	return watcher
+}
+
+// Run scan the startup dir in every interval, never returns
+func (watcher *ManifestWatcher) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if mutations.Enter() {
+			watcher.Scan()
+			mutations.Leave()
+		}
+	}
+}
+
+// Scan install the added or changed manifests, uninstall the removed ones
+func (watcher *ManifestWatcher) Scan() {
+	found := map[string]bool{}
+
+	for _, filename := range walkAppFiles(watcher.rootDir).ManifestFiles {
+		found[filename] = true
+		state, ok := statWatchedFile(filename)
+
+		if !ok {
+			continue
+		}
+
+		if old, ok := watcher.manifestFiles[filename]; ok && old == state {
+			if manifest := watcher.manifests[filename]; manifest != nil {
+				watcher.scanRuntimeFiles(manifest, true)
+			}
+
+			continue
+		}
+
+		// a file may be scanned while writing, retry it in the next scan
+		manifest, err := readAppManifest(filename)
+
+		if err != nil {
+			log.Printf("[ERROR]  Watcher: %v\n", err)
+			continue
+		}
+
+		// a failed install (such as an unsatisfied dependency) is retried in the next scan
+		if watcher.installManifest(filename, manifest) {
+			watcher.manifestFiles[filename] = state
+		}
+	}
+
+	for filename := range watcher.manifestFiles {
+		if !found[filename] {
+			watcher.uninstallManifest(filename)
+		}
+	}
+}
+
+// installManifest install the manifest of the file, return false if it fails
+func (watcher *ManifestWatcher) installManifest(filename string, manifest *AppManifest) bool {
+	param := &AppInstallParam{Manifest: *manifest, FrameworkRuntimes: map[string]string{}}
+
+	if manifest.ServiceName == frameworkServiceName {
+		for _, entry := range manifest.Entrypoints {
+			if strings.Contains(entry, frameworkRuntimeFilePrefix) {
+				if content, err := readRuntimeContent(watcher.rootDir, entry); err == nil {
+					param.FrameworkRuntimes[entry] = content
+				}
+			}
+		}
+	}
+
+	if _, err := watcher.cache.InstallAppVersion(actorManifestWatcher, param); err != nil {
+		log.Printf("[ERROR]  Watcher: cannot install %s: %v\n", filename, err)
+		return false
+	}
+
+	log.Printf("[INFO]  Watcher: installed %s (%s)\n", filename, manifest.GitRevision.GetVersionKey())
+
+	// the file is overwritten by another version
+	if old := watcher.manifests[filename]; old != nil &&
+		(old.ServiceName != manifest.ServiceName || !old.GitRevision.Equal(&manifest.GitRevision)) {
+		watcher.cache.UninstallAppVersion(actorManifestWatcher, &AppUninstallParam{GitRevision: old.GitRevision, ServiceName: old.ServiceName})
+		log.Printf("[INFO]  Watcher: uninstalled %s (%s)\n", filename, old.GitRevision.GetVersionKey())
+	}
+
+	watcher.manifests[filename] = manifest
+	watcher.scanRuntimeFiles(manifest, false)
+	return true
+}
+
+func (watcher *ManifestWatcher) uninstallManifest(filename string) {
+	manifest := watcher.manifests[filename]
+	delete(watcher.manifestFiles, filename)
+	delete(watcher.manifests, filename)
+
+	if manifest == nil {
+		return
+	}
+
+	watcher.cache.UninstallAppVersion(actorManifestWatcher, &AppUninstallParam{GitRevision: manifest.GitRevision, ServiceName: manifest.ServiceName})
+	log.Printf("[INFO]  Watcher: uninstalled removed %s (%s)\n", filename, manifest.GitRevision.GetVersionKey())
+}
+
+// scanRuntimeFiles record the framework runtime files' states, and re-cache the changed ones
+func (watcher *ManifestWatcher) scanRuntimeFiles(manifest *AppManifest, refresh bool) {
+	if manifest.ServiceName != frameworkServiceName {
+		return
+	}
+
+	for _, entry := range manifest.Entrypoints {
+		if !strings.Contains(entry, frameworkRuntimeFilePrefix) {
+			continue
+		}
+
+		filename := findRuntimeFile(watcher.rootDir, entry)
+		state, ok := statWatchedFile(filename)
+
+		if filename == "" || !ok {
+			continue
+		}
+
+		old, seen := watcher.runtimeFiles[entry]
+		watcher.runtimeFiles[entry] = state
+
+		if refresh && seen && old != state {
+			if content, err := readRuntimeContent(watcher.rootDir, entry); err == nil {
+				watcher.cache.FrameworkRuntimes.Store(entry, content)
+				log.Printf("[INFO]  Watcher: refreshed framework runtime %s\n", entry)
+			}
+		}
+	}
+}
+
+func statWatchedFile(filename string) (watchedFile, bool) {
+	info, err := os.Stat(filename)
+
+	if err != nil {
+		return watchedFile{}, false
+	}
+
+	return watchedFile{ModTime: info.ModTime(), Size: info.Size()}, true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestManifestWatcher_Scan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rmf-watcher")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	modTime := time.Now().Add(-time.Hour)
+
+	writeManifest := func(serviceName string, tag string, dependencies string) {
+		appDir := filepath.Join(dir, serviceName)
+		filename := filepath.Join(appDir, "rmf-manifest.json")
+		content := fmt.Sprintf(`{"serviceName":"%s","gitRevision":{"tag":"%s"},"dependencies":[%s],"extra":{}}`,
+			serviceName, tag, dependencies)
+
+		if err := os.MkdirAll(appDir, 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		// a changed file of the same size is found by its time
+		modTime = modTime.Add(time.Minute)
+		os.Chtimes(filename, modTime, modTime)
+	}
+
+	cache := NewAppManifestCache()
+	watcher := NewManifestWatcher(cache, dir)
+	versions := func(serviceName string) []string {
+		res := []string{}
+
+		for _, manifest := range cache.serviceVersions(serviceName) {
+			res = append(res, manifest.GitRevision.Tag)
+		}
+
+		return res
+	}
+
+	steps := []struct {
+		name   string
+		change func()
+		rmfA   string
+		rmfB   string
+	}{
+		{"failed install", func() { writeManifest("rmf-b", "v1", `"rmf-a"`) }, "[]", "[]"},
+		{"add the dependency, then retry the failed one", func() { writeManifest("rmf-a", "v1", "") }, "[v1]", "[v1]"},
+		{"change", func() { writeManifest("rmf-a", "v2", "") }, "[v2]", "[v1]"},
+		{"unchanged", func() {}, "[v2]", "[v1]"},
+		{"remove", func() { os.RemoveAll(filepath.Join(dir, "rmf-b")) }, "[v2]", "[]"},
+	}
+	for _, step := range steps {
+		step.change()
+		watcher.Scan()
+
+		if got := fmt.Sprint(versions("rmf-a")); got != step.rmfA {
+			t.Errorf("%s: versions of rmf-a = %s, want %s", step.name, got, step.rmfA)
+		}
+
+		if got := fmt.Sprint(versions("rmf-b")); got != step.rmfB {
+			t.Errorf("%s: versions of rmf-b = %s, want %s", step.name, got, step.rmfB)
+		}
+	}
+}
@@ -17,7 +17,7 @@ type MetadataRender map[string]string
 // MetadataApp App's metadata
 type MetadataApp struct {
 	ID           string           `json:"id"`
-	Dependencies []string         `json:"dependencies"` // NOT implement yet
+	Dependencies []string         `json:"dependencies"` // IDs of the apps loaded before it
 	Entries      []string         `json:"entries"`
 	Renders      []MetadataRender `json:"renders"`
 	Extra        MetadataExtra    `json:"extra"`
@@ -35,6 +35,20 @@ type MetadataInfoForRequest struct {
 	FrameworkApp     MetadataApp
 	FrameworkRuntime string // content of 'runtime-framework.xxx.js'
 	OtherApps        []MetadataApp
+	SelectedVersions map[string]string // service name to version key, some apps may be dropped by dependencies
+}
+
+// DeliveredVersions the version keys of the apps in the metadata, by service name
+func (info *MetadataInfoForRequest) DeliveredVersions() map[string]string {
+	res := map[string]string{}
+
+	for _, app := range append([]MetadataApp{info.PolyfillApp, info.FrameworkApp}, info.OtherApps...) {
+		if version, ok := info.SelectedVersions[app.ID]; ok && app.ID != "" {
+			res[app.ID] = version
+		}
+	}
+
+	return res
 }
 
 // GitRevision Git revision has tag or short SHA
@@ -45,8 +59,8 @@ type GitRevision struct {
 
 // AppManifest App manifest from 'rmf-manifest.json'
 type AppManifest struct {
-	Dependencies []string `json:"dependencies"`
-	Entrypoints  []string `json:"entrypoints"` // NOT implement yet
+	Dependencies []string `json:"dependencies"` // service names of the apps loaded before it
+	Entrypoints  []string `json:"entrypoints"`
 	// Files       map[string]string `json:"files"`
 	GitRevision   GitRevision      `json:"gitRevision"`
 	LibraryExport string           `json:"libraryExport"`
@@ -54,6 +68,9 @@ type AppManifest struct {
 	Renders       []MetadataRender `json:"renders"`
 	ServiceName   string           `json:"serviceName"`
 	Extra         MetadataExtra    `json:"extra"`
+	Rollout       *AppRollout      `json:"rollout,omitempty"` // the schedule of the activation percent
+
+	FrameworkVersion string `json:"frameworkVersion,omitempty"` // the range of compatible framework tags, such as "^1.2.0"
 }
 
 // AppInstallParam App install param
@@ -92,7 +109,7 @@ func (manifest *AppManifest) ConvertToMetadataApp() *MetadataApp {
 		Dependencies: manifest.Dependencies,
 		Entries:      manifest.Entrypoints,
 		Renders:      manifest.Renders,
-		Extra:        globalSiteConfig.SafeExtra(manifest.Extra),
+		Extra:        currentSiteConfig().SafeExtra(manifest.Extra),
 	}
 
 	return &app
@@ -100,6 +117,7 @@ func (manifest *AppManifest) ConvertToMetadataApp() *MetadataApp {
 
 // GenerateIndexHTML Generate index Html for SPA. return (HTML, ServerPushLink)
 func (info *MetadataInfoForRequest) GenerateIndexHTML(userAgent string) (string, string) {
+	conf := currentSiteConfig()
 	resultHTML := strings.Builder{}
 	resultHTML.Grow(6 * 1024)
 
@@ -134,14 +152,14 @@ func (info *MetadataInfoForRequest) GenerateIndexHTML(userAgent string) (string,
 		}
 	}
 
-	resultHTML.WriteString(globalSiteConfig.HTMLBegin)
+	resultHTML.WriteString(conf.HTMLBegin)
 
 	// Links in header
 	resultHTML.WriteString(styleLinks.String())
-	resultHTML.WriteString(globalSiteConfig.HTMLMiddle)
+	resultHTML.WriteString(conf.HTMLMiddle)
 
 	// JSONP: other Apps and Extra
-	metadata := Metadata{Apps: info.OtherApps, Extra: globalSiteConfig.Extra}
+	metadata := Metadata{Apps: info.OtherApps, Extra: conf.Extra}
 	jsonpData, _ := json.Marshal(&metadata)
 	resultHTML.WriteString(`<script>rmfMetadataCallback(`)
 	resultHTML.Write(jsonpData)
@@ -156,7 +174,7 @@ func (info *MetadataInfoForRequest) GenerateIndexHTML(userAgent string) (string,
 	resultHTML.WriteString(scripts.String())
 
 	// HTML End
-	resultHTML.WriteString(globalSiteConfig.HTMLEnd)
+	resultHTML.WriteString(conf.HTMLEnd)
 
 	// HTML & Server Push
 	return resultHTML.String(), GenerateSererPushLink(serverPushStyles, serverPushScripts)
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	metricsRouteGroupKey = "metricsRouteGroup"
+
+	metricsGroupSPA      = "spa"
+	metricsGroupStatic   = "static"
+	metricsGroupMetadata = "metadata"
+	metricsGroupUser     = "user"
+	metricsGroupInternal = "internal"
+
+	metricsOtherUserGroup = "other"
+)
+
+// metricsLatencyBuckets upper bounds of the request latency histogram, in seconds
+var metricsLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type requestMetricKey struct {
+	Group string
+	Code  int
+}
+
+type latencyHistogram struct {
+	Buckets []uint64 // count of each bucket, not cumulative
+	Sum     float64
+	Count   uint64
+}
+
+type selectionMetricKey struct {
+	Service   string
+	Version   string
+	UserGroup string
+}
+
+// ServerMetrics the counters exposed in Prometheus text format
+type ServerMetrics struct {
+	mutex      sync.Mutex
+	requests   map[requestMetricKey]uint64
+	latencies  map[string]*latencyHistogram // route group to histogram
+	selections map[selectionMetricKey]uint64
+}
+
+// NewServerMetrics new a ServerMetrics
+func NewServerMetrics() *ServerMetrics {
+	return &ServerMetrics{
+		requests:   map[requestMetricKey]uint64{},
+		latencies:  map[string]*latencyHistogram{},
+		selections: map[selectionMetricKey]uint64{},
+	}
+}
+
+// serverMetrics the metrics of this process
+var serverMetrics = NewServerMetrics()
+
+// ObserveRequest count a request and its latency
+func (metrics *ServerMetrics) ObserveRequest(group string, code int, latency time.Duration) {
+	seconds := latency.Seconds()
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.requests[requestMetricKey{group, code}]++
+	histogram, ok := metrics.latencies[group]
+
+	if !ok {
+		histogram = &latencyHistogram{Buckets: make([]uint64, len(metricsLatencyBuckets))}
+		metrics.latencies[group] = histogram
+	}
+
+	for i, bound := range metricsLatencyBuckets {
+		if seconds <= bound {
+			histogram.Buckets[i]++
+			break
+		}
+	}
+
+	histogram.Sum += seconds
+	histogram.Count++
+}
+
+// metricsUserGroupLabel the sorted groups joined, the groups not in 'metricsUserGroups' are 'other'. The groups
+// come from the JWT claims and headers, they would make too many series
+func metricsUserGroupLabel(userGroups []string, configured []string) string {
+	seen := map[string]bool{}
+	groups := []string{}
+
+	for _, group := range userGroups {
+		if group != defaultUserGroup && !stringSliceContainsAny(configured, []string{group}) {
+			group = metricsOtherUserGroup
+		}
+
+		if !seen[group] {
+			seen[group] = true
+			groups = append(groups, group)
+		}
+	}
+
+	sort.Strings(groups)
+	return strings.Join(groups, userGroupsSplitSep)
+}
+
+// ObserveSelection count an app version selected by GenerateMetadata
+func (metrics *ServerMetrics) ObserveSelection(service string, version string, userGroups []string) {
+	label := metricsUserGroupLabel(userGroups, currentSiteConfig().MetricsUserGroups)
+	key := selectionMetricKey{service, version, label}
+
+	metrics.mutex.Lock()
+	metrics.selections[key]++
+	metrics.mutex.Unlock()
+}
+
+// metricsMiddleware observe each request in the route group, set by the handlers or by the path
+func metricsMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	group := c.GetString(metricsRouteGroupKey)
+
+	if group == "" {
+		group = metricsRouteGroupByPath(c.Request.URL.Path)
+	}
+
+	serverMetrics.ObserveRequest(group, c.Writer.Status(), time.Since(start))
+}
+
+// metricsRouteGroupByPath NOTE: the SPA handler sets its group, others out of API are static files
+func metricsRouteGroupByPath(urlPath string) string {
+	switch {
+	case strings.HasPrefix(urlPath, "/api/metadata/"):
+		return metricsGroupMetadata
+	case strings.HasPrefix(urlPath, "/api/user/"):
+		return metricsGroupUser
+	case strings.HasPrefix(urlPath, "/api/"), urlPath == "/healthz", urlPath == "/metrics":
+		return metricsGroupInternal
+	default:
+		return metricsGroupStatic
+	}
+}
+
+// WriteMetrics write all metrics in Prometheus text format
+func (metrics *ServerMetrics) WriteMetrics(w io.Writer, cache *AppManifestCache) {
+	metrics.mutex.Lock()
+	requestKeys := make([]requestMetricKey, 0, len(metrics.requests))
+
+	for key := range metrics.requests {
+		requestKeys = append(requestKeys, key)
+	}
+
+	sort.Slice(requestKeys, func(i, j int) bool {
+		if requestKeys[i].Group != requestKeys[j].Group {
+			return requestKeys[i].Group < requestKeys[j].Group
+		}
+
+		return requestKeys[i].Code < requestKeys[j].Code
+	})
+
+	fmt.Fprintln(w, "# HELP rmf_http_requests_total Count of HTTP requests by route group and status code.")
+	fmt.Fprintln(w, "# TYPE rmf_http_requests_total counter")
+
+	for _, key := range requestKeys {
+		fmt.Fprintf(w, "rmf_http_requests_total{group=\"%s\",code=\"%d\"} %d\n",
+			escapeMetricLabel(key.Group), key.Code, metrics.requests[key])
+	}
+
+	groups := make([]string, 0, len(metrics.latencies))
+
+	for group := range metrics.latencies {
+		groups = append(groups, group)
+	}
+
+	sort.Strings(groups)
+
+	fmt.Fprintln(w, "# HELP rmf_http_request_duration_seconds Latency of HTTP requests by route group.")
+	fmt.Fprintln(w, "# TYPE rmf_http_request_duration_seconds histogram")
+
+	for _, group := range groups {
+		histogram := metrics.latencies[group]
+		label := escapeMetricLabel(group)
+		cumulative := uint64(0)
+
+		for i, bound := range metricsLatencyBuckets {
+			cumulative += histogram.Buckets[i]
+			fmt.Fprintf(w, "rmf_http_request_duration_seconds_bucket{group=\"%s\",le=\"%s\"} %d\n",
+				label, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+
+		fmt.Fprintf(w, "rmf_http_request_duration_seconds_bucket{group=\"%s\",le=\"+Inf\"} %d\n", label, histogram.Count)
+		fmt.Fprintf(w, "rmf_http_request_duration_seconds_sum{group=\"%s\"} %g\n", label, histogram.Sum)
+		fmt.Fprintf(w, "rmf_http_request_duration_seconds_count{group=\"%s\"} %d\n", label, histogram.Count)
+	}
+
+	selectionKeys := make([]selectionMetricKey, 0, len(metrics.selections))
+
+	for key := range metrics.selections {
+		selectionKeys = append(selectionKeys, key)
+	}
+
+	sort.Slice(selectionKeys, func(i, j int) bool {
+		a, b := selectionKeys[i], selectionKeys[j]
+
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+
+		if a.UserGroup != b.UserGroup {
+			return a.UserGroup < b.UserGroup
+		}
+
+		return a.Version < b.Version
+	})
+
+	fmt.Fprintln(w, "# HELP rmf_app_selections_total Count of app versions selected for users, by user groups.")
+	fmt.Fprintln(w, "# TYPE rmf_app_selections_total counter")
+
+	for _, key := range selectionKeys {
+		fmt.Fprintf(w, "rmf_app_selections_total{service=\"%s\",version=\"%s\",user_group=\"%s\"} %d\n",
+			escapeMetricLabel(key.Service), escapeMetricLabel(key.Version), escapeMetricLabel(key.UserGroup),
+			metrics.selections[key])
+	}
+
+	metrics.mutex.Unlock()
+
+	cache.writeCacheMetrics(w)
+}
+
+// writeCacheMetrics write the gauges of the cache's current state
+func (cache *AppManifestCache) writeCacheMetrics(w io.Writer) {
+	versions := map[string]int{}
+	services := []string{}
+
+	cache.ServiceManifests.Range(func(key, value interface{}) bool {
+		serviceName := key.(string)
+
+		mtxValue, _ := cache.ServiceMutexes.LoadOrStore(serviceName, &sync.RWMutex{})
+		mtx := mtxValue.(*sync.RWMutex)
+
+		mtx.RLock()
+		versions[serviceName] = len(value.(AppVersionMap))
+		mtx.RUnlock()
+
+		services = append(services, serviceName)
+		return true
+	})
+
+	sort.Strings(services)
+
+	fmt.Fprintln(w, "# HELP rmf_service_versions Count of installed versions by service.")
+	fmt.Fprintln(w, "# TYPE rmf_service_versions gauge")
+
+	for _, service := range services {
+		fmt.Fprintf(w, "rmf_service_versions{service=\"%s\"} %d\n", escapeMetricLabel(service), versions[service])
+	}
+
+	runtimes, runtimeBytes := 0, 0
+
+	cache.FrameworkRuntimes.Range(func(key, value interface{}) bool {
+		runtimes++
+		runtimeBytes += len(value.(string))
+		return true
+	})
+
+	fmt.Fprintln(w, "# HELP rmf_framework_runtimes Count of cached framework runtimes.")
+	fmt.Fprintln(w, "# TYPE rmf_framework_runtimes gauge")
+	fmt.Fprintf(w, "rmf_framework_runtimes %d\n", runtimes)
+	fmt.Fprintln(w, "# HELP rmf_framework_runtimes_bytes Total bytes of cached framework runtimes.")
+	fmt.Fprintln(w, "# TYPE rmf_framework_runtimes_bytes gauge")
+	fmt.Fprintf(w, "rmf_framework_runtimes_bytes %d\n", runtimeBytes)
+}
+
+var metricLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeMetricLabel(value string) string {
+	return metricLabelReplacer.Replace(value)
+}
+
+// metricsHandler the handler of '/metrics'
+func metricsHandler(cache *AppManifestCache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		c.Status(http.StatusOK)
+		serverMetrics.WriteMetrics(c.Writer, cache)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func Test_metricsUserGroupLabel(t *testing.T) {
+	configured := []string{testerUserGroup, "beta"}
+
+	tests := []struct {
+		userGroups []string
+		want       string
+	}{
+		{[]string{defaultUserGroup}, ""},
+		{[]string{"beta", testerUserGroup}, "beta,tester"},
+		{[]string{"team-a", "team-b", "beta"}, "beta,other"},
+		{[]string{"user-12345"}, "other"},
+	}
+	for _, tt := range tests {
+		if got := metricsUserGroupLabel(tt.userGroups, configured); got != tt.want {
+			t.Errorf("metricsUserGroupLabel(%v) = %q, want %q", tt.userGroups, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ReleaseSet versions of several services shipped together. The versions are selected together for a user,
+// by the set's activation percent, and never selected apart from the set.
+type ReleaseSet struct {
+	Name              string                 `json:"name"`
+	ActivationPercent int                    `json:"activationPercent"`
+	Versions          map[string]GitRevision `json:"versions"` // service name to version
+}
+
+// AppReleaseSetParam the param of the release set APIs
+type AppReleaseSetParam struct {
+	Name              string            `json:"name"`
+	ActivationPercent int               `json:"activationPercent"`
+	Apps              []AppInstallParam `json:"apps,omitempty"` // only for installing
+}
+
+// lockServices lock the sorted services' mutexes in order (never deadlocks), return the unlock function
+func (cache *AppManifestCache) lockServices(services []string) func() {
+	mutexes := make([]*sync.RWMutex, 0, len(services))
+
+	for _, serviceName := range services {
+		mtxValue, _ := cache.ServiceMutexes.LoadOrStore(serviceName, &sync.RWMutex{})
+		mtx := mtxValue.(*sync.RWMutex)
+		mtx.Lock()
+		mutexes = append(mutexes, mtx)
+	}
+
+	return func() {
+		for i := len(mutexes) - 1; i >= 0; i-- {
+			mutexes[i].Unlock()
+		}
+	}
+}
+
+// checkReleaseSet check the set can be installed. NOTE: lock the release sets before calling
+func (cache *AppManifestCache) checkReleaseSet(param *AppReleaseSetParam) error {
+	if param.Name == "" {
+		return fmt.Errorf("Missing release set name")
+	}
+
+	if _, ok := cache.releaseSets[param.Name]; ok {
+		return fmt.Errorf("Release set '%s' is installed", param.Name)
+	}
+
+	if len(param.Apps) == 0 {
+		return fmt.Errorf("Release set '%s' has no apps", param.Name)
+	}
+
+	if param.ActivationPercent < 0 || param.ActivationPercent > 100 {
+		return fmt.Errorf("Invalid activation percent %d, require from 0 to 100", param.ActivationPercent)
+	}
+
+	services := map[string]bool{}
+
+	for i := range param.Apps {
+		manifest := &param.Apps[i].Manifest
+
+		if services[manifest.ServiceName] {
+			return fmt.Errorf("Release set '%s' has more than one version of '%s'", param.Name, manifest.ServiceName)
+		}
+
+		services[manifest.ServiceName] = true
+
+		if err := checkAppManifest(manifest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkReleaseSetConflicts check the dependencies out of the set are installed, and no version of the set is.
+// NOTE: lock the set's services before calling
+func (cache *AppManifestCache) checkReleaseSetConflicts(param *AppReleaseSetParam) error {
+	services := map[string]bool{}
+
+	for i := range param.Apps {
+		services[param.Apps[i].Manifest.ServiceName] = true
+	}
+
+	for i := range param.Apps {
+		manifest := &param.Apps[i].Manifest
+		missing := []string{}
+
+		for _, dep := range manifest.Dependencies {
+			if !services[dep] && !cache.hasInstalledVersion(dep) {
+				missing = append(missing, dep)
+			}
+		}
+
+		if len(missing) > 0 {
+			return fmt.Errorf("Unsatisfied dependencies of '%s': %s", manifest.ServiceName, strings.Join(missing, ", "))
+		}
+
+		if cache.findAppVersion(manifest.ServiceName, &manifest.GitRevision) != nil {
+			return fmt.Errorf("Version '%s' of '%s' is installed", manifest.GitRevision.GetVersionKey(), manifest.ServiceName)
+		}
+	}
+
+	return nil
+}
+
+func (cache *AppManifestCache) hasAppVersion(serviceName string, gitRevision *GitRevision) bool {
+	mtxValue, _ := cache.ServiceMutexes.LoadOrStore(serviceName, &sync.RWMutex{})
+	mtx := mtxValue.(*sync.RWMutex)
+
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	return cache.findAppVersion(serviceName, gitRevision) != nil
+}
+
+// InstallReleaseSet install all versions in the set, or none of them
+func (cache *AppManifestCache) InstallReleaseSet(actor string, param *AppReleaseSetParam) error {
+	cache.releaseSetMutex.Lock()
+	defer cache.releaseSetMutex.Unlock()
+
+	if err := cache.checkReleaseSet(param); err != nil {
+		return err
+	}
+
+	var conflict error
+
+	_, err := cache.commitReleaseSetMutation(&JournalRecord{Op: journalOpInstallReleaseSet, Actor: actor, ReleaseSet: param},
+		func() bool {
+			// checked under the services' locks, then a single install can't land before applying
+			if conflict = cache.checkReleaseSetConflicts(param); conflict != nil {
+				return false
+			}
+
+			cache.applyInstallReleaseSet(param)
+			return true
+		})
+
+	if conflict != nil {
+		return conflict
+	}
+
+	return err
+}
+
+// commitReleaseSetMutation lock the set's services, then commit the change. NOTE: lock the release sets before calling
+func (cache *AppManifestCache) commitReleaseSetMutation(record *JournalRecord, apply func() bool) (bool, error) {
+	services, _ := cache.journalRecordScope(record)
+	unlock := cache.lockServices(services)
+	defer unlock()
+
+	_, ok, err := cache.commitMutation(record, apply)
+	return ok, err
+}
+
+func (cache *AppManifestCache) applyInstallReleaseSet(param *AppReleaseSetParam) {
+	set := &ReleaseSet{Name: param.Name, ActivationPercent: param.ActivationPercent, Versions: map[string]GitRevision{}}
+
+	for i := range param.Apps {
+		manifest := &param.Apps[i].Manifest
+		set.Versions[manifest.ServiceName] = manifest.GitRevision
+	}
+
+	for i := range param.Apps {
+		app := param.Apps[i]
+		app.Manifest.Extra = MetadataExtra{}
+
+		for key, value := range param.Apps[i].Manifest.Extra {
+			app.Manifest.Extra[key] = value
+		}
+
+		app.Manifest.Extra[releaseSetKey] = param.Name
+		cache.applyInstallAppVersion(&app)
+	}
+
+	if cache.releaseSets == nil {
+		cache.releaseSets = map[string]*ReleaseSet{}
+	}
+
+	cache.releaseSets[param.Name] = set
+}
+
+// UninstallReleaseSet uninstall all versions in the set, as the rollback of the release
+func (cache *AppManifestCache) UninstallReleaseSet(actor string, param *AppReleaseSetParam) (bool, error) {
+	cache.releaseSetMutex.Lock()
+	defer cache.releaseSetMutex.Unlock()
+
+	record := &JournalRecord{Op: journalOpUninstallReleaseSet, Actor: actor, ReleaseSet: &AppReleaseSetParam{Name: param.Name}}
+
+	return cache.commitReleaseSetMutation(record, func() bool {
+		return cache.applyUninstallReleaseSet(param)
+	})
+}
+
+func (cache *AppManifestCache) applyUninstallReleaseSet(param *AppReleaseSetParam) bool {
+	set, ok := cache.releaseSets[param.Name]
+
+	if !ok {
+		return false
+	}
+
+	for serviceName, gitRevision := range set.Versions {
+		cache.applyUninstallAppVersion(&AppUninstallParam{GitRevision: gitRevision, ServiceName: serviceName})
+	}
+
+	delete(cache.releaseSets, param.Name)
+	return true
+}
+
+// UpdateReleaseSet change the set's activation percent, 0 to stop selecting it
+func (cache *AppManifestCache) UpdateReleaseSet(actor string, param *AppReleaseSetParam) error {
+	if param.ActivationPercent < 0 || param.ActivationPercent > 100 {
+		return fmt.Errorf("Invalid activation percent %d, require from 0 to 100", param.ActivationPercent)
+	}
+
+	cache.releaseSetMutex.Lock()
+	defer cache.releaseSetMutex.Unlock()
+
+	record := &JournalRecord{Op: journalOpUpdateReleaseSet, Actor: actor, ReleaseSet: &AppReleaseSetParam{
+		Name:              param.Name,
+		ActivationPercent: param.ActivationPercent,
+	}}
+
+	ok, err := cache.commitReleaseSetMutation(record, func() bool { return cache.applyUpdateReleaseSet(param) })
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("Release set '%s' not found", param.Name)
+	}
+
+	return nil
+}
+
+func (cache *AppManifestCache) applyUpdateReleaseSet(param *AppReleaseSetParam) bool {
+	set, ok := cache.releaseSets[param.Name]
+
+	if !ok {
+		return false
+	}
+
+	// replace the set, GenerateMetadata may be reading the old one
+	updated := *set
+	updated.ActivationPercent = param.ActivationPercent
+	cache.releaseSets[param.Name] = &updated
+	return true
+}
+
+// QueryReleaseSets all installed release sets, by name
+func (cache *AppManifestCache) QueryReleaseSets() []*ReleaseSet {
+	cache.releaseSetMutex.RLock()
+	defer cache.releaseSetMutex.RUnlock()
+
+	res := make([]*ReleaseSet, 0, len(cache.releaseSets))
+
+	for _, set := range cache.releaseSets {
+		res = append(res, set)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// isInReleaseSet check the user gets the set. With the session ID, the result is sticky for the session
+func isInReleaseSet(r *rand.Rand, sessionID string, set *ReleaseSet) bool {
+	if set.ActivationPercent >= 100 {
+		return true
+	}
+
+	if sessionID == "" {
+		return r.Intn(100) < set.ActivationPercent
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(sessionID))
+	hash.Write([]byte{0})
+	hash.Write([]byte(set.Name))
+
+	return mixHash64(hash.Sum64())%10000 < uint64(set.ActivationPercent)*100
+}
+
+// selectReleaseSets the sets the user gets. The sets are checked by name, a set sharing a service with an
+// earlier selected set is skipped.
+func (cache *AppManifestCache) selectReleaseSets(r *rand.Rand, sessionID string) []*ReleaseSet {
+	selected := []*ReleaseSet{}
+	services := map[string]bool{}
+
+	for _, set := range cache.QueryReleaseSets() {
+		conflicted := false
+
+		for serviceName := range set.Versions {
+			if services[serviceName] {
+				conflicted = true
+			}
+		}
+
+		if conflicted || !isInReleaseSet(r, sessionID, set) {
+			continue
+		}
+
+		for serviceName := range set.Versions {
+			services[serviceName] = true
+		}
+
+		selected = append(selected, set)
+	}
+
+	return selected
+}
+
+// isReleaseSetCompatible check every version in the set is installed and compatible with the framework,
+// a set is never selected in part
+func (cache *AppManifestCache) isReleaseSetCompatible(set *ReleaseSet, frameworkTag string) bool {
+	for serviceName, gitRevision := range set.Versions {
+		mtxValue, _ := cache.ServiceMutexes.LoadOrStore(serviceName, &sync.RWMutex{})
+		mtx := mtxValue.(*sync.RWMutex)
+
+		mtx.RLock()
+		manifest := cache.findAppVersion(serviceName, &gitRevision)
+		compatible := manifest != nil && isFrameworkCompatible(manifest, frameworkTag)
+		mtx.RUnlock()
+
+		if !compatible {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAppManifestCache_releaseSet(t *testing.T) {
+	cache := NewAppManifestCache()
+	v1 := GitRevision{Tag: "v1"}
+	v2 := GitRevision{Tag: "v2"}
+	app := func(serviceName string, git GitRevision) AppInstallParam {
+		return AppInstallParam{Manifest: AppManifest{
+			ServiceName: serviceName,
+			GitRevision: git,
+			Entrypoints: []string{git.Tag + ".js"},
+			Extra:       MetadataExtra{},
+		}}
+	}
+
+	for _, param := range []AppInstallParam{app("rmf-a", v1), app("rmf-b", v1)} {
+		if _, err := cache.InstallAppVersion("tester", &param); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	set := &AppReleaseSetParam{Name: "feature-x", ActivationPercent: 100, Apps: []AppInstallParam{
+		app("rmf-a", v2), app("rmf-b", v2),
+	}}
+
+	if err := cache.InstallReleaseSet("tester", set); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.InstallReleaseSet("tester", set); err == nil {
+		t.Errorf("InstallReleaseSet() twice, want error")
+	}
+
+	conflicted := &AppReleaseSetParam{Name: "feature-y", ActivationPercent: 100, Apps: []AppInstallParam{app("rmf-a", v1)}}
+
+	if err := cache.InstallReleaseSet("tester", conflicted); err == nil {
+		t.Errorf("InstallReleaseSet() of an installed version, want error")
+	}
+
+	checkEntries := func(want string) {
+		info := cache.GenerateMetadata(GenMetadataParam{UserGroups: []string{defaultUserGroup}, SessionID: "session-1"})
+
+		if len(info.OtherApps) != 2 {
+			t.Fatalf("GenerateMetadata() got %d apps, want 2", len(info.OtherApps))
+		}
+
+		for _, app := range info.OtherApps {
+			if app.Entries[0] != want {
+				t.Errorf("GenerateMetadata() %s got %s, want %s", app.ID, app.Entries[0], want)
+			}
+		}
+	}
+
+	checkEntries("v2.js")
+
+	if err := cache.UpdateReleaseSet("tester", &AppReleaseSetParam{Name: "feature-x", ActivationPercent: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	checkEntries("v1.js")
+
+	// a member is only changed with its set
+	v2App := app("rmf-a", v2)
+
+	if _, err := cache.InstallAppVersion("tester", &v2App); err == nil {
+		t.Errorf("InstallAppVersion() over a member of a release set, want error")
+	}
+
+	if ok, err := cache.UninstallAppVersion("tester", &AppUninstallParam{ServiceName: "rmf-a", GitRevision: v2}); ok || err == nil {
+		t.Errorf("UninstallAppVersion() of a member of a release set = %v, want error", ok)
+	}
+
+	if ok, err := cache.UpdateAppExtra("tester", []AppUpdateExtraParam{
+		{ServiceName: "rmf-a", GitRevision: v1, Extra: MetadataExtra{activationPercentKey: "50"}},
+		{ServiceName: "rmf-b", GitRevision: v2, Extra: MetadataExtra{activationPercentKey: "50"}},
+	}); ok || err == nil {
+		t.Errorf("UpdateAppExtra() of a member of a release set = %v, want error", ok)
+	}
+
+	if _, ok := cache.findAppVersion("rmf-a", &v1).Extra[activationPercentKey]; ok {
+		t.Errorf("UpdateAppExtra() should update none when rejected")
+	}
+
+	if _, err := cache.SetAppRollout("tester", &AppRolloutParam{ServiceName: "rmf-a", GitRevision: v2, Rollout: &AppRollout{
+		Steps: []RolloutStep{{After: "0s", Percent: 5}},
+	}}); err == nil {
+		t.Errorf("SetAppRollout() of a member of a release set, want error")
+	}
+
+	if err := checkAppExtra(MetadataExtra{releaseSetKey: "feature-x"}); err == nil {
+		t.Errorf("checkAppExtra() with %s, want error", releaseSetKey)
+	}
+
+	if ok, err := cache.UninstallReleaseSet("tester", set); !ok || err != nil || cache.hasAppVersion("rmf-a", &v2) || cache.hasAppVersion("rmf-b", &v2) {
+		t.Errorf("UninstallReleaseSet() should uninstall all versions in the set")
+	}
+
+	if len(cache.QueryReleaseSets()) != 0 {
+		t.Errorf("QueryReleaseSets() should be empty after uninstalling")
+	}
+}
+
+func TestAppManifestCache_releaseSetFrameworkCompatibility(t *testing.T) {
+	cache := NewAppManifestCache()
+	app := func(serviceName string, tag string, frameworkVersion string) AppInstallParam {
+		return AppInstallParam{Manifest: AppManifest{
+			ServiceName:      serviceName,
+			GitRevision:      GitRevision{Tag: tag},
+			Entrypoints:      []string{serviceName + "-" + tag + ".js"},
+			FrameworkVersion: frameworkVersion,
+			Extra:            MetadataExtra{},
+		}}
+	}
+
+	for _, param := range []AppInstallParam{
+		app(frameworkServiceName, "v2.0.0", ""), app("rmf-a", "v1.0.0", ""), app("rmf-b", "v1.0.0", ""),
+	} {
+		if _, err := cache.InstallAppVersion("tester", &param); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkEntries := func(want map[string]string) {
+		info := cache.GenerateMetadata(GenMetadataParam{UserGroups: []string{defaultUserGroup}, SessionID: "session-1"})
+		got := map[string]string{}
+
+		for _, app := range info.OtherApps {
+			got[app.ID] = app.Entries[0]
+		}
+
+		got[frameworkServiceName] = info.SelectedVersions[frameworkServiceName]
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("GenerateMetadata() = %v, want %v", got, want)
+		}
+	}
+
+	// rmf-b is not compatible with framework v2, the whole set is dropped
+	partial := &AppReleaseSetParam{Name: "feature-x", ActivationPercent: 100, Apps: []AppInstallParam{
+		app("rmf-a", "v2.0.0", "^2.0.0"), app("rmf-b", "v2.0.0", "^1.0.0"),
+	}}
+
+	if err := cache.InstallReleaseSet("tester", partial); err != nil {
+		t.Fatal(err)
+	}
+
+	checkEntries(map[string]string{
+		frameworkServiceName: "v2.0.0_", "rmf-a": "rmf-a-v1.0.0.js", "rmf-b": "rmf-b-v1.0.0.js",
+	})
+
+	// a set with the framework is checked against its own framework version
+	withFramework := &AppReleaseSetParam{Name: "feature-y", ActivationPercent: 100, Apps: []AppInstallParam{
+		app(frameworkServiceName, "v3.0.0", ""), app("rmf-a", "v3.0.0", "^3.0.0"), app("rmf-b", "v3.0.0", "^3.0.0"),
+	}}
+
+	cache.UninstallReleaseSet("tester", partial)
+
+	if err := cache.InstallReleaseSet("tester", withFramework); err != nil {
+		t.Fatal(err)
+	}
+
+	checkEntries(map[string]string{
+		frameworkServiceName: "v3.0.0_", "rmf-a": "rmf-a-v3.0.0.js", "rmf-b": "rmf-b-v3.0.0.js",
+	})
+}
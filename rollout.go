@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	rolloutStateRunning = "running"
+	rolloutStatePaused  = "paused"
+	rolloutStateAborted = "aborted"
+)
+
+// RolloutStep the activation percent from 'After' the start of the rollout
+type RolloutStep struct {
+	After   string `json:"after"` // duration, such as "0s", "30m" or "24h"
+	Percent int    `json:"percent"`
+}
+
+// AppRollout the schedule of a version's activation percent, such as 5% now, 25% after 1h and 100% after 24h.
+// Without steps, the percent ramps linearly from 0 at StartAt to 100 at EndAt. Without both, the rollout only
+// holds the version until ActivateAt. The percent of the groups in 'activationPercentByGroup' is not changed.
+type AppRollout struct {
+	ActivateAt *time.Time    `json:"activateAt,omitempty"` // the version is never selected before it
+	StartAt    *time.Time    `json:"startAt,omitempty"`    // the steps are after it, default: when installing or setting
+	EndAt      *time.Time    `json:"endAt,omitempty"`
+	Steps      []RolloutStep `json:"steps,omitempty"`
+
+	State         string     `json:"state,omitempty"` // running, paused or aborted
+	PausedAt      *time.Time `json:"pausedAt,omitempty"`
+	PausedSeconds int64      `json:"pausedSeconds,omitempty"` // total seconds paused before PausedAt
+}
+
+// AppRolloutParam the param of the rollout APIs
+type AppRolloutParam struct {
+	GitRevision GitRevision `json:"gitRevision"`
+	ServiceName string      `json:"serviceName"`
+	Rollout     *AppRollout `json:"rollout,omitempty"`
+}
+
+// Clone copy the rollout, the copy is changed then replaces the one in use
+func (rollout *AppRollout) Clone() *AppRollout {
+	res := *rollout
+	res.Steps = append([]RolloutStep{}, rollout.Steps...)
+	return &res
+}
+
+// Validate check the schedule
+func (rollout *AppRollout) Validate() error {
+	last := time.Duration(-1)
+
+	for _, step := range rollout.Steps {
+		after, err := time.ParseDuration(step.After)
+
+		if err != nil || after < 0 {
+			return fmt.Errorf("Invalid rollout step after '%s'", step.After)
+		}
+
+		if after <= last {
+			return fmt.Errorf("Rollout steps must be in increasing order of 'after'")
+		}
+
+		if step.Percent < 0 || step.Percent > 100 {
+			return fmt.Errorf("Invalid rollout step percent %d, require from 0 to 100", step.Percent)
+		}
+
+		last = after
+	}
+
+	if rollout.EndAt != nil && rollout.StartAt != nil && !rollout.EndAt.After(*rollout.StartAt) {
+		return fmt.Errorf("Rollout endAt must be after startAt")
+	}
+
+	switch rollout.State {
+	case "", rolloutStateRunning, rolloutStatePaused, rolloutStateAborted:
+	default:
+		return fmt.Errorf("Invalid rollout state '%s'", rollout.State)
+	}
+
+	return nil
+}
+
+// normalize fill the default start time and state
+func (rollout *AppRollout) normalize(now time.Time) {
+	if rollout.StartAt == nil {
+		rollout.StartAt = &now
+	}
+
+	if rollout.State == "" {
+		rollout.State = rolloutStateRunning
+	}
+
+	if rollout.State == rolloutStatePaused && rollout.PausedAt == nil {
+		rollout.PausedAt = &now
+	}
+}
+
+// IsActive check the version can be selected: activated, and not aborted
+func (rollout *AppRollout) IsActive(now time.Time) bool {
+	if rollout.State == rolloutStateAborted {
+		return false
+	}
+
+	return rollout.ActivateAt == nil || !now.Before(*rollout.ActivateAt)
+}
+
+// elapsed the running time since the start, the paused time is excluded
+func (rollout *AppRollout) elapsed(now time.Time) time.Duration {
+	if rollout.StartAt == nil {
+		return 0
+	}
+
+	if rollout.State == rolloutStatePaused && rollout.PausedAt != nil {
+		now = *rollout.PausedAt
+	}
+
+	return now.Sub(*rollout.StartAt) - time.Duration(rollout.PausedSeconds)*time.Second
+}
+
+// Percent the scheduled percent at the time, false if there is no schedule
+func (rollout *AppRollout) Percent(now time.Time) (int, bool) {
+	elapsed := rollout.elapsed(now)
+
+	if len(rollout.Steps) > 0 {
+		percent := 0
+
+		for _, step := range rollout.Steps {
+			if after, err := time.ParseDuration(step.After); err != nil || elapsed < after {
+				break
+			}
+
+			percent = step.Percent
+		}
+
+		return percent, true
+	}
+
+	if rollout.EndAt != nil && rollout.StartAt != nil {
+		total := rollout.EndAt.Sub(*rollout.StartAt)
+
+		switch {
+		case elapsed <= 0:
+			return 0, true
+		case elapsed >= total:
+			return 100, true
+		}
+
+		// at least 1% once started, then some users get it soon
+		percent := int(100 * elapsed / total)
+
+		if percent < 1 {
+			percent = 1
+		}
+
+		return percent, true
+	}
+
+	return 0, false
+}
+
+// SetAppRollout set (or replace) the rollout of an installed version
+func (cache *AppManifestCache) SetAppRollout(actor string, param *AppRolloutParam) (*AppRollout, error) {
+	if param.Rollout == nil {
+		return nil, fmt.Errorf("Missing rollout")
+	}
+
+	if err := param.Rollout.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cache.changeAppRollout(actor, param, func(_ *AppRollout, now time.Time) (*AppRollout, error) {
+		rollout := param.Rollout.Clone()
+		rollout.normalize(now)
+		return rollout, nil
+	})
+}
+
+// PauseAppRollout freeze the percent of a running rollout
+func (cache *AppManifestCache) PauseAppRollout(actor string, param *AppRolloutParam) (*AppRollout, error) {
+	return cache.changeAppRollout(actor, param, func(old *AppRollout, now time.Time) (*AppRollout, error) {
+		if old == nil || old.State != rolloutStateRunning {
+			return nil, fmt.Errorf("No running rollout")
+		}
+
+		rollout := old.Clone()
+		rollout.State = rolloutStatePaused
+		rollout.PausedAt = &now
+		return rollout, nil
+	})
+}
+
+// ResumeAppRollout continue a paused rollout, the steps are delayed by the paused time
+func (cache *AppManifestCache) ResumeAppRollout(actor string, param *AppRolloutParam) (*AppRollout, error) {
+	return cache.changeAppRollout(actor, param, func(old *AppRollout, now time.Time) (*AppRollout, error) {
+		if old == nil || old.State != rolloutStatePaused {
+			return nil, fmt.Errorf("No paused rollout")
+		}
+
+		rollout := old.Clone()
+		rollout.State = rolloutStateRunning
+
+		if rollout.PausedAt != nil {
+			rollout.PausedSeconds += int64(now.Sub(*rollout.PausedAt) / time.Second)
+			rollout.PausedAt = nil
+		}
+
+		return rollout, nil
+	})
+}
+
+// AbortAppRollout stop selecting the version, it is kept installed
+func (cache *AppManifestCache) AbortAppRollout(actor string, param *AppRolloutParam) (*AppRollout, error) {
+	return cache.changeAppRollout(actor, param, func(old *AppRollout, now time.Time) (*AppRollout, error) {
+		if old == nil || old.State == rolloutStateAborted {
+			return nil, fmt.Errorf("No rollout to abort")
+		}
+
+		rollout := old.Clone()
+		rollout.State = rolloutStateAborted
+		return rollout, nil
+	})
+}
+
+// changeAppRollout replace the version's rollout by the changed copy, and write the journal
+func (cache *AppManifestCache) changeAppRollout(actor string, param *AppRolloutParam,
+	change func(old *AppRollout, now time.Time) (*AppRollout, error)) (*AppRollout, error) {
+	// lock AppVersionMap when changing it's content
+	mtxValue, _ := cache.ServiceMutexes.LoadOrStore(param.ServiceName, &sync.RWMutex{})
+	mtx := mtxValue.(*sync.RWMutex)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	manifest := cache.findAppVersion(param.ServiceName, &param.GitRevision)
+
+	if manifest == nil {
+		return nil, fmt.Errorf("Version not found")
+	}
+
+	if err := cache.releaseSetMemberError(param.ServiceName, &param.GitRevision); err != nil {
+		return nil, err
+	}
+
+	rollout, err := change(manifest.Rollout, time.Now())
+
+	if err != nil {
+		return nil, err
+	}
+
+	record := &JournalRecord{Op: journalOpSetRollout, Actor: actor, Rollout: &AppRolloutParam{
+		GitRevision: param.GitRevision,
+		ServiceName: param.ServiceName,
+		Rollout:     rollout,
+	}}
+
+	if _, _, err := cache.commitMutation(record, func() bool {
+		manifest.Rollout = rollout
+		return true
+	}); err != nil {
+		return nil, err
+	}
+
+	return rollout, nil
+}
+
+// applySetAppRollout set the rollout when replaying the journal
+func (cache *AppManifestCache) applySetAppRollout(param *AppRolloutParam) {
+	if manifest := cache.findAppVersion(param.ServiceName, &param.GitRevision); manifest != nil {
+		manifest.Rollout = param.Rollout
+	}
+}
+
+// findAppVersion the installed version, nil if not found. NOTE: lock the service's mutex before calling
+func (cache *AppManifestCache) findAppVersion(serviceName string, gitRevision *GitRevision) *AppManifest {
+	return cache.findAppVersionByKey(serviceName, gitRevision.GetVersionKey())
+}
+
+// rolloutVersion a version having a rollout
+type rolloutVersion struct {
+	ServiceName string
+	GitRevision GitRevision
+}
+
+// rolloutPercents the current percents of the scheduled rollouts, 0 if not active
+func (cache *AppManifestCache) rolloutPercents(now time.Time) map[rolloutVersion]int {
+	res := map[rolloutVersion]int{}
+
+	for _, serviceName := range cache.serviceNames() {
+		for _, manifest := range cache.serviceVersions(serviceName) {
+			if manifest.Rollout == nil {
+				continue
+			}
+
+			percent, ok := manifest.Rollout.Percent(now)
+
+			if !manifest.Rollout.IsActive(now) {
+				percent, ok = 0, true
+			}
+
+			if ok {
+				res[rolloutVersion{serviceName, manifest.GitRevision}] = percent
+			}
+		}
+	}
+
+	return res
+}
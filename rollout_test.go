@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAppRollout_Percent(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(10 * time.Hour)
+	pausedAt := start.Add(2 * time.Hour)
+	steps := []RolloutStep{{"0s", 5}, {"1h", 25}, {"24h", 100}}
+
+	tests := []struct {
+		name    string
+		rollout AppRollout
+		after   time.Duration
+		want    int
+		active  bool
+	}{
+		{"first step", AppRollout{StartAt: &start, Steps: steps}, 30 * time.Minute, 5, true},
+		{"second step", AppRollout{StartAt: &start, Steps: steps}, 2 * time.Hour, 25, true},
+		{"last step", AppRollout{StartAt: &start, Steps: steps}, 48 * time.Hour, 100, true},
+		{"before start", AppRollout{StartAt: &start, Steps: steps}, -time.Hour, 0, true},
+		{"linear", AppRollout{StartAt: &start, EndAt: &end}, 5 * time.Hour, 50, true},
+		{"linear started", AppRollout{StartAt: &start, EndAt: &end}, time.Second, 1, true},
+		{"linear ended", AppRollout{StartAt: &start, EndAt: &end}, 11 * time.Hour, 100, true},
+		{"paused", AppRollout{StartAt: &start, Steps: steps, State: rolloutStatePaused, PausedAt: &start},
+			48 * time.Hour, 5, true},
+		{"resumed", AppRollout{StartAt: &start, Steps: steps, State: rolloutStateRunning, PausedSeconds: 3600},
+			90 * time.Minute, 5, true},
+		{"paused later", AppRollout{StartAt: &start, Steps: steps, State: rolloutStatePaused, PausedAt: &pausedAt},
+			30 * time.Hour, 25, true},
+		{"not activated", AppRollout{ActivateAt: &end}, time.Hour, 0, false},
+		{"aborted", AppRollout{StartAt: &start, Steps: steps, State: rolloutStateAborted}, 48 * time.Hour, 100, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := start.Add(tt.after)
+
+			if got, _ := tt.rollout.Percent(now); got != tt.want {
+				t.Errorf("Percent() = %v, want %v", got, tt.want)
+			}
+
+			if got := tt.rollout.IsActive(now); got != tt.active {
+				t.Errorf("IsActive() = %v, want %v", got, tt.active)
+			}
+		})
+	}
+}
+
+func TestAppManifestCache_rollout(t *testing.T) {
+	cache := NewAppManifestCache()
+	git := GitRevision{Tag: "v2"}
+	manifest := AppManifest{ServiceName: "rmf-test", GitRevision: git, Extra: MetadataExtra{}}
+
+	if _, err := cache.InstallAppVersion("tester", &AppInstallParam{Manifest: manifest}); err != nil {
+		t.Fatal(err)
+	}
+
+	param := &AppRolloutParam{ServiceName: "rmf-test", GitRevision: git, Rollout: &AppRollout{
+		Steps: []RolloutStep{{"0s", 5}, {"1h", 100}},
+	}}
+
+	if _, err := cache.SetAppRollout("tester", param); err != nil {
+		t.Fatal(err)
+	}
+
+	installed := cache.findAppVersion("rmf-test", &git)
+
+	if got := calcActivationPercent(installed, []string{defaultUserGroup}); got != 5 {
+		t.Errorf("calcActivationPercent() = %v, want 5", got)
+	}
+
+	if _, err := cache.ResumeAppRollout("tester", param); err == nil {
+		t.Errorf("ResumeAppRollout() of a running rollout, want error")
+	}
+
+	if rollout, err := cache.PauseAppRollout("tester", param); err != nil || rollout.State != rolloutStatePaused {
+		t.Errorf("PauseAppRollout() = %+v, %v", rollout, err)
+	}
+
+	if rollout, err := cache.AbortAppRollout("tester", param); err != nil || rollout.State != rolloutStateAborted {
+		t.Errorf("AbortAppRollout() = %+v, %v", rollout, err)
+	}
+
+	if got := calcActivationPercent(installed, []string{defaultUserGroup}); got != 0 {
+		t.Errorf("calcActivationPercent() after abort = %v, want 0", got)
+	}
+
+	param.GitRevision = GitRevision{Tag: "v3"}
+
+	if _, err := cache.SetAppRollout("tester", param); err == nil {
+		t.Errorf("SetAppRollout() of a missing version, want error")
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// semver a version such as '1.2.3' or 'v2.0.0-beta.1', the build metadata is ignored
+type semver struct {
+	Major, Minor, Patch int
+	Prerelease          string
+}
+
+// parseSemverPartial parse the version, also partial ones such as '1', '1.2' and '1.x'. Return the count of
+// the numbers given, the others are 0.
+func parseSemverPartial(text string) (semver, int, error) {
+	version := semver{}
+	text = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(text), "v"), "V")
+
+	if i := strings.IndexByte(text, '+'); i >= 0 {
+		text = text[:i]
+	}
+
+	if i := strings.IndexByte(text, '-'); i >= 0 {
+		version.Prerelease = text[i+1:]
+		text = text[:i]
+	}
+
+	parts := strings.Split(text, ".")
+
+	if len(parts) > 3 || text == "" {
+		return version, 0, fmt.Errorf("invalid version '%s'", text)
+	}
+
+	numbers := []*int{&version.Major, &version.Minor, &version.Patch}
+	count := 0
+
+	for i, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			continue
+		}
+
+		number, err := strconv.Atoi(part)
+
+		// no number after a wildcard, such as '1.x.2'
+		if err != nil || number < 0 || count < i {
+			return version, 0, fmt.Errorf("invalid version '%s'", text)
+		}
+
+		*numbers[i] = number
+		count++
+	}
+
+	return version, count, nil
+}
+
+// parseSemver parse a full version, the missing minor and patch are 0
+func parseSemver(text string) (semver, bool) {
+	version, count, err := parseSemverPartial(text)
+	return version, err == nil && count > 0
+}
+
+// compare -1, 0 or 1. A prerelease is before its release
+func (v semver) compare(other semver) int {
+	for _, diff := range []int{v.Major - other.Major, v.Minor - other.Minor, v.Patch - other.Patch} {
+		if diff < 0 {
+			return -1
+		} else if diff > 0 {
+			return 1
+		}
+	}
+
+	switch {
+	case v.Prerelease == other.Prerelease:
+		return 0
+	case v.Prerelease == "":
+		return 1
+	case other.Prerelease == "":
+		return -1
+	case v.Prerelease < other.Prerelease:
+		return -1
+	}
+
+	return 1
+}
+
+type semverComparator struct {
+	op      string // >=, >, <=, < or =
+	version semver
+}
+
+func (c semverComparator) match(v semver) bool {
+	result := v.compare(c.version)
+
+	switch c.op {
+	case ">=":
+		return result >= 0
+	case ">":
+		return result > 0
+	case "<=":
+		return result <= 0
+	case "<":
+		return result < 0
+	}
+
+	return result == 0
+}
+
+// semverRange the ranges joined by '||', each is the comparators joined by spaces, such as
+// '^1.2.0 || >=2.0.0 <2.5.0', '~1.4', '1.x' or '*'
+type semverRange [][]semverComparator
+
+// semverRanges compiled ranges by expression, as map[expr string]semverRange
+var semverRanges sync.Map
+
+// compileSemverRange compile the range, the result is cached
+func compileSemverRange(expr string) (semverRange, error) {
+	if value, ok := semverRanges.Load(expr); ok {
+		return value.(semverRange), nil
+	}
+
+	res := semverRange{}
+
+	for _, part := range strings.Split(expr, "||") {
+		comparators := []semverComparator{}
+
+		for _, field := range strings.Fields(part) {
+			items, err := parseSemverComparator(field)
+
+			if err != nil {
+				return nil, err
+			}
+
+			comparators = append(comparators, items...)
+		}
+
+		res = append(res, comparators)
+	}
+
+	semverRanges.Store(expr, res)
+	return res, nil
+}
+
+func parseSemverComparator(field string) ([]semverComparator, error) {
+	if field == "*" || field == "x" || field == "X" {
+		return nil, nil
+	}
+
+	op := ""
+
+	for _, candidate := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(field, candidate) {
+			op = candidate
+			break
+		}
+	}
+
+	version, count, err := parseSemverPartial(field[len(op):])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if count == 0 && op != "" {
+		return nil, fmt.Errorf("invalid version '%s' of '%s'", field[len(op):], op)
+	}
+
+	// the upper bound (exclusive) of a partial version, such as '<2.0.0' for '1.x'
+	next := func(count int) semver {
+		switch count {
+		case 1:
+			return semver{Major: version.Major + 1}
+		case 2:
+			return semver{Major: version.Major, Minor: version.Minor + 1}
+		}
+
+		return semver{Major: version.Major, Minor: version.Minor, Patch: version.Patch + 1}
+	}
+	lower := semverComparator{">=", version}
+
+	switch op {
+	case ">=", ">", "<=", "<":
+		return []semverComparator{{op, version}}, nil
+	case "^":
+		// the first non-zero number is fixed
+		switch {
+		case version.Major > 0 || count == 1:
+			return []semverComparator{lower, {"<", next(1)}}, nil
+		case version.Minor > 0 || count == 2:
+			return []semverComparator{lower, {"<", next(2)}}, nil
+		}
+
+		return []semverComparator{lower, {"<", next(3)}}, nil
+	case "~":
+		if count == 1 {
+			return []semverComparator{lower, {"<", next(1)}}, nil
+		}
+
+		return []semverComparator{lower, {"<", next(2)}}, nil
+	}
+
+	if count == 0 {
+		return nil, nil
+	} else if count < 3 {
+		return []semverComparator{lower, {"<", next(count)}}, nil
+	}
+
+	return []semverComparator{{"=", version}}, nil
+}
+
+// Match check the version is in any range
+func (r semverRange) Match(v semver) bool {
+	for _, comparators := range r {
+		matched := true
+
+		for _, c := range comparators {
+			if !c.match(v) {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_compileSemverRange(t *testing.T) {
+	tests := []struct {
+		expr    string
+		version string
+		want    bool
+		wantErr bool
+	}{
+		{expr: "^1.2.0", version: "v1.9.3", want: true},
+		{expr: "^1.2.0", version: "2.0.0", want: false},
+		{expr: "^1.2.0", version: "1.1.9", want: false},
+		{expr: "^0.2.1", version: "0.2.9", want: true},
+		{expr: "^0.2.1", version: "0.3.0", want: false},
+		{expr: "~1.4", version: "1.4.7", want: true},
+		{expr: "~1.4", version: "1.5.0", want: false},
+		{expr: "1.x", version: "1.99.0", want: true},
+		{expr: "1.x", version: "2.0.0", want: false},
+		{expr: ">=1.0.0 <2.0.0 || >=3.0.0", version: "3.1.0", want: true},
+		{expr: ">=1.0.0 <2.0.0 || >=3.0.0", version: "2.1.0", want: false},
+		{expr: "2.0.0", version: "2.0.0-beta.1", want: false},
+		{expr: ">=2.0.0-beta.1", version: "2.0.0", want: true},
+		{expr: "*", version: "0.0.1", want: true},
+		{expr: "^1.a", wantErr: true},
+		{expr: ">=1.2.3.4", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr+" "+tt.version, func(t *testing.T) {
+			versionRange, err := compileSemverRange(tt.expr)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("compileSemverRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			version, ok := parseSemver(tt.version)
+
+			if !ok {
+				t.Fatalf("parseSemver(%s) failed", tt.version)
+			}
+
+			if got := versionRange.Match(version); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAppManifestCache_frameworkCompatibility(t *testing.T) {
+	cache := NewAppManifestCache()
+	install := func(serviceName string, tag string, frameworkVersion string, extra MetadataExtra) []string {
+		warnings, err := cache.InstallAppVersion("tester", &AppInstallParam{Manifest: AppManifest{
+			ServiceName:      serviceName,
+			GitRevision:      GitRevision{Tag: tag},
+			Entrypoints:      []string{serviceName + "-" + tag + ".js"},
+			FrameworkVersion: frameworkVersion,
+			Extra:            extra,
+		}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return warnings
+	}
+
+	install(frameworkServiceName, "v2.0.0", "", MetadataExtra{})
+	install("rmf-a", "v1.0.0", "^1.0.0", MetadataExtra{})
+	install("rmf-a", "v1.1.0", "^1.0.0 || ^2.0.0", MetadataExtra{activationPercentKey: "0"})
+	install("rmf-a", "v1.2.0", "^2.0.0", MetadataExtra{userGroupKey: testerUserGroup})
+
+	// the default version is not compatible with framework v2, and the compatible ones are killed or tester-only
+	info := cache.GenerateMetadata(GenMetadataParam{UserGroups: []string{defaultUserGroup}, SessionID: "session-1"})
+
+	if len(info.OtherApps) != 0 {
+		t.Errorf("GenerateMetadata() = %+v, want none", info.OtherApps)
+	}
+
+	info = cache.GenerateMetadata(GenMetadataParam{UserGroups: []string{testerUserGroup}, SessionID: "session-1"})
+
+	if len(info.OtherApps) != 1 || info.OtherApps[0].Entries[0] != "rmf-a-v1.2.0.js" {
+		t.Errorf("GenerateMetadata() for tester = %+v, want rmf-a v1.2.0", info.OtherApps)
+	}
+
+	// the beta version is not compatible, fall back to the newest compatible default one
+	install("rmf-d", "v0.9.0", "^2.0.0", MetadataExtra{})
+	install("rmf-d", "v1.0.0", "^1.0.0", MetadataExtra{userGroupKey: "beta"})
+	install("rmf-d", "v1.1.0", "^2.0.0", MetadataExtra{userGroupKey: testerUserGroup})
+	info = cache.GenerateMetadata(GenMetadataParam{UserGroups: []string{defaultUserGroup, "beta"}, SessionID: "session-1"})
+
+	if len(info.OtherApps) != 1 || info.OtherApps[0].Entries[0] != "rmf-d-v0.9.0.js" {
+		t.Errorf("GenerateMetadata() for beta = %+v, want rmf-d v0.9.0", info.OtherApps)
+	}
+
+	warnings := install("rmf-b", "v1.0.0", "^1.0.0", MetadataExtra{})
+	want := []string{"No version of 'rmf-b' is compatible with framework 'v2.0.0_'"}
+
+	if !reflect.DeepEqual(warnings, want) {
+		t.Errorf("InstallAppVersion() warnings = %v, want %v", warnings, want)
+	}
+
+	if _, err := cache.InstallAppVersion("tester", &AppInstallParam{Manifest: AppManifest{
+		ServiceName: "rmf-c", FrameworkVersion: "^x.1",
+	}}); err == nil {
+		t.Errorf("InstallAppVersion() with invalid frameworkVersion, want error")
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -64,11 +67,13 @@ func walkServeFiles(rootDir string) WalkServeFilesResult {
 	return result
 }
 
-func serveDirsAndFiles(router *gin.Engine, walkAppsResult *WalkAppsResult, startupInitDir string) {
-	serveDirs := append([]string{}, walkAppsResult.AppDirs...)
-	serveFiles := append([]string{}, globalSiteConfig.ServeStaticFiles...)
+// serveDirsAndFiles serve the static files and dirs at root. NOTE: 'rmf-xxx' dirs are served by appStaticMiddleware
+func serveDirsAndFiles(router *gin.Engine, startupInitDir string) {
+	conf := currentSiteConfig()
+	serveDirs := []string{}
+	serveFiles := append([]string{}, conf.ServeStaticFiles...)
 
-	if globalSiteConfig.ServeAllInDir {
+	if conf.ServeAllInDir {
 		walkServeFilesResult := walkServeFiles(startupInitDir)
 
 		serveDirs = append(serveDirs, walkServeFilesResult.Dirs...)
@@ -78,6 +83,10 @@ func serveDirsAndFiles(router *gin.Engine, walkAppsResult *WalkAppsResult, start
 	servedDirsMap := map[string]bool{}
 
 	for _, appDir := range serveDirs {
+		if strings.HasPrefix(appDir, appDirPrefix) {
+			continue
+		}
+
 		if _, ok := servedDirsMap[appDir]; !ok {
 			router.Static("/"+appDir, path.Join(startupInitDir, appDir))
 			servedDirsMap[appDir] = true
@@ -93,3 +102,89 @@ func serveDirsAndFiles(router *gin.Engine, walkAppsResult *WalkAppsResult, start
 		}
 	}
 }
+
+// appStaticMiddleware serve the files in 'rmf-xxx' dirs, which are resolved per request. So the apps
+// deployed after startup are served without a restart. Other requests go to the next handlers.
+func appStaticMiddleware(startupInitDir string) gin.HandlerFunc {
+	fileSystem := gin.Dir(startupInitDir, false)
+	fileServer := http.FileServer(fileSystem)
+
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			c.Next()
+			return
+		}
+
+		urlPath := path.Clean("/" + c.Request.URL.Path)
+		appDir := strings.SplitN(strings.TrimPrefix(urlPath, "/"), "/", 2)[0]
+
+		if !strings.HasPrefix(appDir, appDirPrefix) || !isServableFile(fileSystem, urlPath) {
+			c.Next()
+			return
+		}
+
+		fileServer.ServeHTTP(c.Writer, c.Request)
+		c.Abort()
+	}
+}
+
+func isServableFile(fileSystem http.FileSystem, name string) bool {
+	file, err := fileSystem.Open(name)
+
+	if err != nil {
+		return false
+	}
+
+	defer file.Close()
+	info, err := file.Stat()
+
+	return err == nil && !info.IsDir()
+}
+
+// isNavigationRequest check the request is for the SPA document: not under 'rmf-xxx' dirs, not a static
+// file by extension, and a navigation by Sec-Fetch-Mode, or accepts HTML when the browser doesn't send it
+func isNavigationRequest(c *gin.Context, staticExtensions map[string]bool) bool {
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		return false
+	}
+
+	urlPath := path.Clean("/" + c.Request.URL.Path)
+
+	if strings.HasPrefix(strings.TrimPrefix(urlPath, "/"), appDirPrefix) {
+		return false
+	}
+
+	if staticExtensions[strings.ToLower(path.Ext(urlPath))] {
+		return false
+	}
+
+	if mode := c.GetHeader("Sec-Fetch-Mode"); mode != "" {
+		return strings.EqualFold(mode, "navigate")
+	}
+
+	accept := strings.ToLower(c.GetHeader("Accept"))
+	return strings.Contains(accept, "text/html") || strings.Contains(accept, "application/xhtml+xml")
+}
+
+// notFoundMiddleware response 404 with the configured page for non-navigation requests
+func notFoundMiddleware(c *gin.Context) {
+	conf := currentSiteConfig()
+
+	if isNavigationRequest(c, conf.StaticExtensionsMap) {
+		c.Next()
+		return
+	}
+
+	content := []byte("404 page not found")
+	contentType := "text/plain; charset=utf-8"
+
+	if conf.NotFoundFile != "" {
+		if data, err := ioutil.ReadFile(path.Join(conf.StartupInitDir, conf.NotFoundFile)); err == nil {
+			content = data
+			contentType = "text/html; charset=utf-8"
+		}
+	}
+
+	c.Data(http.StatusNotFound, contentType, content)
+	c.Abort()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_appStaticMiddleware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rmf-static")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.NoRoute(appStaticMiddleware(dir), func(c *gin.Context) {
+		c.String(http.StatusOK, "next")
+	})
+
+	// deployed after the routes are registered
+	appDir := filepath.Join(dir, "rmf-new", "static", "js")
+
+	if err := os.MkdirAll(appDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(appDir, "main.js"), []byte("var main = 1;"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+		body   string
+	}{
+		{http.MethodGet, "/rmf-new/static/js/main.js", http.StatusOK, "var main = 1;"},
+		{http.MethodGet, "/rmf-new/static/js/../js/main.js", http.StatusOK, "var main = 1;"},
+		{http.MethodGet, "/rmf-new/static/js/missing.js", http.StatusOK, "next"},
+		{http.MethodGet, "/rmf-new/static/js", http.StatusOK, "next"},
+		{http.MethodPost, "/rmf-new/static/js/main.js", http.StatusOK, "next"},
+		{http.MethodGet, "/home", http.StatusOK, "next"},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.path, nil))
+
+		if recorder.Code != tt.code || recorder.Body.String() != tt.body {
+			t.Errorf("%s %s = %d %s, want %d %s", tt.method, tt.path, recorder.Code, recorder.Body.String(), tt.code, tt.body)
+		}
+	}
+}
+
+func Test_isNavigationRequest(t *testing.T) {
+	const htmlAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+	staticExtensions := map[string]bool{".js": true, ".png": true}
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		accept        string
+		secFetchMode  string
+		wantNavigated bool
+	}{
+		{"page by Accept", http.MethodGet, "/home/profile", htmlAccept, "", true},
+		{"page by Sec-Fetch-Mode", http.MethodGet, "/home", htmlAccept, "navigate", true},
+		{"HEAD page", http.MethodHead, "/home", htmlAccept, "", true},
+		{"fetch accepting HTML", http.MethodGet, "/home", htmlAccept, "cors", false},
+		{"script", http.MethodGet, "/home", "*/*", "no-cors", false},
+		{"XHR without Sec-Fetch-Mode", http.MethodGet, "/api/unknown", "application/json", "", false},
+		{"missing chunk", http.MethodGet, "/rmf-foo/static/js/missing.chunk.js", htmlAccept, "navigate", false},
+		{"app dir", http.MethodGet, "/rmf-foo/about", htmlAccept, "navigate", false},
+		{"static extension", http.MethodGet, "/favicon.PNG", htmlAccept, "navigate", false},
+		{"POST", http.MethodPost, "/home", htmlAccept, "navigate", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(tt.method, tt.path, nil)
+			c.Request.Header.Set("Accept", tt.accept)
+
+			if tt.secFetchMode != "" {
+				c.Request.Header.Set("Sec-Fetch-Mode", tt.secFetchMode)
+			}
+
+			if got := isNavigationRequest(c, staticExtensions); got != tt.wantNavigated {
+				t.Errorf("isNavigationRequest() = %v, want %v", got, tt.wantNavigated)
+			}
+		})
+	}
+}
+
+func Test_notFoundMiddleware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rmf-not-found")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "404.html"), []byte("<p>Not Found</p>"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := currentSiteConfig()
+	defer storeSiteConfig(previous)
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.NoRoute(notFoundMiddleware, func(c *gin.Context) {
+		c.String(http.StatusOK, "spa")
+	})
+
+	tests := []struct {
+		name         string
+		notFoundFile string
+		path         string
+		accept       string
+		code         int
+		body         string
+	}{
+		{"SPA fallback", "404.html", "/home", "text/html", http.StatusOK, "spa"},
+		{"configured page", "404.html", "/rmf-foo/static/js/missing.chunk.js", "*/*", http.StatusNotFound, "<p>Not Found</p>"},
+		{"missing page", "missing.html", "/favicon.png", "*/*", http.StatusNotFound, "404 page not found"},
+		{"no page", "", "/api/unknown", "application/json", http.StatusNotFound, "404 page not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := previous.Clone()
+			conf.StartupInitDir = dir
+			conf.NotFoundFile = tt.notFoundFile
+			storeSiteConfig(conf)
+
+			request := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			request.Header.Set("Accept", tt.accept)
+			recorder := httptest.NewRecorder()
+			engine.ServeHTTP(recorder, request)
+
+			if recorder.Code != tt.code || recorder.Body.String() != tt.body {
+				t.Errorf("GET %s = %d %s, want %d %s", tt.path, recorder.Code, recorder.Body.String(), tt.code, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// shutdownAcceptGrace the time to read the requests of the accepted connections before shutdown
+const shutdownAcceptGrace = 500 * time.Millisecond
+
+// mutationGate hold the mutations of AppManifestCache while upgrading. The new process replays the journal
+// at startup, a mutation of the old process after it would be lost.
+type mutationGate struct {
+	mutex  sync.RWMutex
+	closed bool
+}
+
+// mutations the gate of this process
+var mutations = &mutationGate{}
+
+// Enter return false when the gate is closed, otherwise call Leave() after the mutation
+func (gate *mutationGate) Enter() bool {
+	gate.mutex.RLock()
+
+	if gate.closed {
+		gate.mutex.RUnlock()
+		return false
+	}
+
+	return true
+}
+
+// Leave the mutation is done
+func (gate *mutationGate) Leave() {
+	gate.mutex.RUnlock()
+}
+
+// Close wait for the mutations in progress, then reject the later ones
+func (gate *mutationGate) Close() {
+	gate.mutex.Lock()
+	gate.closed = true
+	gate.mutex.Unlock()
+}
+
+// Open accept the mutations again
+func (gate *mutationGate) Open() {
+	gate.mutex.Lock()
+	gate.closed = false
+	gate.mutex.Unlock()
+}
+
+// mutationGateMiddleware response 503 for the changing admin calls while upgrading
+func mutationGateMiddleware(ctx *gin.Context) {
+	if ctx.Request.Method == http.MethodGet || ctx.Request.Method == http.MethodHead {
+		ctx.Next()
+		return
+	}
+
+	if !mutations.Enter() {
+		ctx.Header("Retry-After", "5")
+		ctx.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+			"error": "The server is upgrading, try again later",
+		})
+		return
+	}
+
+	defer mutations.Leave()
+	ctx.Next()
+}
+
+// runServer serve until SIGTERM or SIGINT, then drain the in-flight requests in the shutdown timeout.
+// The listener is inherited from systemd or the old process when possible, see listen().
+// 'onUpgradeAborted' is called when the new process fails, before accepting the mutations again.
+func runServer(handler http.Handler, conf *SiteConfig, onUpgradeAborted func()) error {
+	listener, inherited, err := listen(conf.ListenAddress)
+
+	if err != nil {
+		return err
+	}
+
+	listener = &onceCloseListener{Listener: listener}
+
+	server := &http.Server{Handler: handler}
+	serveErrors := make(chan error, 1)
+
+	go func() {
+		serveErrors <- server.Serve(listener)
+	}()
+
+	writePidFile(conf.PidFile)
+	fmt.Println("Serve on: ", listener.Addr())
+
+	// the old process stops accepting after the new one is serving
+	if inherited {
+		notifyUpgradeParent()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	notifyUpgradeSignal(signals)
+
+	upgradeAborted := func() {
+		onUpgradeAborted()
+		mutations.Open()
+		log.Printf("[WARN]  Upgrading aborted, accept the mutations again\n")
+	}
+
+	for {
+		select {
+		case err := <-serveErrors:
+			return err
+		case sig := <-signals:
+			if isUpgradeSignal(sig) {
+				// keep serving until the new process is ready and sends SIGTERM, but without mutations
+				mutations.Close()
+
+				if err := upgradeServer(listener.(*onceCloseListener).Listener, upgradeAborted); err != nil {
+					log.Printf("[ERROR]  Cannot start the new server process: %v\n", err)
+					upgradeAborted()
+				}
+
+				continue
+			}
+
+			timeout := time.Duration(conf.ShutdownTimeout) * time.Second
+			log.Printf("[INFO]  %v received, shutdown in %v\n", sig, timeout)
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			// Shutdown closes the accepted connections whose requests are read after it starts, without reply.
+			// So stop accepting first (the new process keeps accepting after upgrading), then read them.
+			listener.Close()
+			time.Sleep(shutdownAcceptGrace)
+
+			return server.Shutdown(ctx)
+		}
+	}
+}
+
+// onceCloseListener close the listener once, for both runServer and http.Server
+type onceCloseListener struct {
+	net.Listener
+	once sync.Once
+	err  error
+}
+
+func (listener *onceCloseListener) Close() error {
+	listener.once.Do(func() {
+		listener.err = listener.Listener.Close()
+	})
+
+	return listener.err
+}
+
+func listen(address string) (net.Listener, bool, error) {
+	listener, err := inheritListener()
+
+	if err != nil {
+		log.Printf("[ERROR]  Cannot inherit the listener, listen on %s: %v\n", address, err)
+	} else if listener != nil {
+		return listener, true, nil
+	}
+
+	listener, err = net.Listen("tcp", address)
+	return listener, false, err
+}
+
+// writePidFile write the PID, for the init script after upgrading the process. The file is replaced by renaming,
+// so a file created by root (start-stop-daemon --make-pidfile) is replaced in a directory writable by the server
+func writePidFile(filename string) {
+	if filename == "" {
+		return
+	}
+
+	tmpFilename := filename + ".tmp"
+	err := ioutil.WriteFile(tmpFilename, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+
+	if err == nil {
+		err = os.Rename(tmpFilename, filename)
+	}
+
+	if err != nil {
+		log.Printf("[ERROR]  Cannot write PID file %s: %v\n", filename, err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_mutationGateMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(mutationGateMiddleware)
+	engine.GET("/api/metadata/query-app-versions", func(c *gin.Context) { c.Status(http.StatusOK) })
+	engine.POST("/api/metadata/install-app-version", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	request := func(method string, path string) int {
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		return recorder.Code
+	}
+
+	defer mutations.Open()
+
+	tests := []struct {
+		closed bool
+		method string
+		path   string
+		want   int
+	}{
+		{false, http.MethodPost, "/api/metadata/install-app-version", http.StatusOK},
+		{true, http.MethodPost, "/api/metadata/install-app-version", http.StatusServiceUnavailable},
+		{true, http.MethodGet, "/api/metadata/query-app-versions", http.StatusOK},
+		{false, http.MethodPost, "/api/metadata/install-app-version", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if tt.closed {
+			mutations.Close()
+		} else {
+			mutations.Open()
+		}
+
+		if got := request(tt.method, tt.path); got != tt.want {
+			t.Errorf("%s %s with the gate closed %v = %d, want %d", tt.method, tt.path, tt.closed, got, tt.want)
+		}
+	}
+}
+
+func Test_writePidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rmf-pid")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "rmf.pid")
+
+	// created by start-stop-daemon before, not writable by the server
+	if err := ioutil.WriteFile(filename, []byte("1\n"), 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	writePidFile(filename)
+
+	if content, _ := ioutil.ReadFile(filename); string(content) != strconv.Itoa(os.Getpid())+"\n" {
+		t.Errorf("writePidFile() wrote %q, want the PID %d", content, os.Getpid())
+	}
+}
@@ -0,0 +1,118 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+)
+
+const (
+	listenFDEnv    = "RMF_LISTEN_FD"
+	parentPIDEnv   = "RMF_PARENT_PID"
+	systemdFDStart = 3
+)
+
+// inheritListener the listener passed by systemd socket activation, or by the old process in upgrading.
+// Return nil without error when nothing is passed.
+func inheritListener() (net.Listener, error) {
+	fd := 0
+
+	if os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) && os.Getenv("LISTEN_FDS") != "" {
+		// systemd socket activation, use the first socket
+		fd = systemdFDStart
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	} else if value := os.Getenv(listenFDEnv); value != "" {
+		var err error
+
+		if fd, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("Invalid %s '%s'", listenFDEnv, value)
+		}
+
+		os.Unsetenv(listenFDEnv)
+	}
+
+	if fd == 0 {
+		return nil, nil
+	}
+
+	file := os.NewFile(uintptr(fd), "rmf-listener")
+	defer file.Close()
+
+	return net.FileListener(file)
+}
+
+func notifyUpgradeSignal(signals chan<- os.Signal) {
+	signal.Notify(signals, syscall.SIGUSR2)
+}
+
+func isUpgradeSignal(sig os.Signal) bool {
+	return sig == syscall.SIGUSR2
+}
+
+// upgradeServer re-execute the binary (may be replaced by a new version) with the listener's FD.
+// 'onExit' is called if the new process exits, such as failing to start.
+func upgradeServer(listener net.Listener, onExit func()) error {
+	tcpListener, ok := listener.(*net.TCPListener)
+
+	if !ok {
+		return fmt.Errorf("Cannot pass a %T", listener)
+	}
+
+	file, err := tcpListener.File()
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	executable, err := os.Executable()
+
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{file} // as FD 3
+	cmd.Env = append(os.Environ(),
+		listenFDEnv+"="+strconv.Itoa(systemdFDStart),
+		parentPIDEnv+"="+strconv.Itoa(os.Getpid()))
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	log.Printf("[INFO]  Started the new server process %d, waiting for it\n", cmd.Process.Pid)
+
+	go func() {
+		err := cmd.Wait()
+		log.Printf("[ERROR]  The new server process %d exited: %v\n", cmd.Process.Pid, err)
+		onExit()
+	}()
+
+	return nil
+}
+
+// notifyUpgradeParent ask the old process to shutdown gracefully
+func notifyUpgradeParent() {
+	value := os.Getenv(parentPIDEnv)
+	os.Unsetenv(parentPIDEnv)
+
+	if pid, err := strconv.Atoi(value); err == nil && pid > 1 {
+		if err = syscall.Kill(pid, syscall.SIGTERM); err != nil {
+			log.Printf("[ERROR]  Cannot stop the old server process %d: %v\n", pid, err)
+		}
+	}
+}
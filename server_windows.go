@@ -0,0 +1,27 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// inheritListener passing the listener is not supported on Windows
+func inheritListener() (net.Listener, error) {
+	return nil, nil
+}
+
+func notifyUpgradeSignal(signals chan<- os.Signal) {}
+
+func isUpgradeSignal(sig os.Signal) bool {
+	return false
+}
+
+func upgradeServer(listener net.Listener, onExit func()) error {
+	return fmt.Errorf("Upgrading is not supported on Windows")
+}
+
+func notifyUpgradeParent() {}
@@ -2,8 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-session/session"
@@ -13,8 +20,97 @@ const sessionManagerKey = "sessionManager"
 const sessionStoreKey = "sessionStore"
 const sessionCookieName = "sessionId"
 
+const stickyCookieName = "rmfStickyId"
+const stickyIDKey = "stickyId"
+const stickyCookieMaxAge = 3600 * 24 * 365
+
+var stickyIDRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// SessionCookieConfig the attributes of the session cookie
+type SessionCookieConfig struct {
+	Secure   *bool  `yaml:"secure"`
+	HTTPOnly *bool  `yaml:"httpOnly"`
+	SameSite string `yaml:"sameSite"` // lax, strict or none
+	Domain   string `yaml:"domain"`
+	Path     string `yaml:"path"`
+	MaxAge   *int   `yaml:"maxAge"` // seconds, 0 for a browser session cookie
+}
+
+var sessionCookieSameSites = map[string]http.SameSite{
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+// Apply set the attributes (except MaxAge) to the cookie
+func (conf *SessionCookieConfig) Apply(cookie *http.Cookie) {
+	cookie.Secure = conf.Secure == nil || *conf.Secure
+	cookie.HttpOnly = conf.HTTPOnly == nil || *conf.HTTPOnly
+	cookie.SameSite = sessionCookieSameSites[strings.ToLower(conf.SameSite)]
+	cookie.Domain = conf.Domain
+	cookie.Path = conf.Path
+}
+
+// MergeFrom Merge the set attributes from 'other'
+func (conf *SessionCookieConfig) MergeFrom(other *SessionCookieConfig) {
+	if other.Secure != nil {
+		conf.Secure = other.Secure
+	}
+
+	if other.HTTPOnly != nil {
+		conf.HTTPOnly = other.HTTPOnly
+	}
+
+	if other.SameSite != "" {
+		conf.SameSite = other.SameSite
+	}
+
+	if other.Domain != "" {
+		conf.Domain = other.Domain
+	}
+
+	if other.Path != "" {
+		conf.Path = other.Path
+	}
+
+	if other.MaxAge != nil {
+		conf.MaxAge = other.MaxAge
+	}
+}
+
+// CookieMaxAge the seconds of MaxAge, 0 if it's not set
+func (conf *SessionCookieConfig) CookieMaxAge() int {
+	if conf.MaxAge == nil {
+		return 0
+	}
+
+	return *conf.MaxAge
+}
+
+// rewriteSessionCookie apply the configured attributes to the session cookie set by go-session. Each header
+// value is parsed alone, the others are kept as they are
+func rewriteSessionCookie(header http.Header, conf *SessionCookieConfig) {
+	values := header["Set-Cookie"]
+
+	for i, value := range values {
+		cookies := (&http.Response{Header: http.Header{"Set-Cookie": {value}}}).Cookies()
+
+		if len(cookies) == 1 && cookies[0].Name == sessionCookieName {
+			conf.Apply(cookies[0])
+			values[i] = cookies[0].String()
+		}
+	}
+}
+
+// warnSessionSign log the empty sign, anyone can forge the session cookie with it
+func warnSessionSign(conf *SiteConfig) {
+	if conf.SessionSign == "" {
+		log.Printf("[WARN]  Empty sessionSign in site config, the session cookie can be forged. Set a random secret\n")
+	}
+}
+
 // NewSessionMiddleware create a session middleware
-func NewSessionMiddleware(opt ...session.Option) gin.HandlerFunc {
+func NewSessionMiddleware(cookieConf *SessionCookieConfig, opt ...session.Option) gin.HandlerFunc {
 	manager := session.NewManager(opt...)
 
 	return func(ctx *gin.Context) {
@@ -31,6 +127,9 @@ func NewSessionMiddleware(opt ...session.Option) gin.HandlerFunc {
 			log.Printf("[ERROR] Session start:  %+v\n", err)
 		}
 
+		rewriteSessionCookie(ctx.Writer.Header(), cookieConf)
+
+		// a session is saved only when it has state, such as the user groups
 		if store != nil {
 			ctx.Set(sessionStoreKey, store)
 		}
@@ -57,13 +156,88 @@ func sessionStoreFromContext(ctx *gin.Context) session.Store {
 }
 
 func createSessionMiddleware() gin.HandlerFunc {
-	return NewSessionMiddleware(
-		session.SetSign([]byte(globalSiteConfig.SessionSign)),
+	conf := currentSiteConfig()
+
+	switch conf.SessionStore {
+	case sessionStoreCookie:
+		codec, err := NewCookieSessionCodec(conf.SessionSign, sessionCookieName, &conf.SessionCookie, conf.SessionExpired)
+
+		if err == nil {
+			return NewCookieSessionMiddleware(codec)
+		}
+
+		log.Printf("[ERROR]  Cannot create cookie session store, use memory store: %v\n", err)
+	case sessionStoreFile:
+		store, err := NewFileSessionStore(conf.SessionDir, conf.SessionExpired,
+			time.Duration(conf.SessionCleanupInterval)*time.Second)
+
+		if err == nil {
+			return NewSessionMiddleware(&conf.SessionCookie,
+				session.SetSign([]byte(conf.SessionSign)),
+				session.SetCookieName(sessionCookieName),
+				session.SetCookieLifeTime(conf.SessionCookie.CookieMaxAge()),
+				session.SetExpired(conf.SessionExpired),
+				session.SetStore(store),
+			)
+		}
+
+		log.Printf("[ERROR]  Cannot create file session store in %s, use memory store: %v\n", conf.SessionDir, err)
+	}
+
+	return NewSessionMiddleware(&conf.SessionCookie,
+		session.SetSign([]byte(conf.SessionSign)),
 		session.SetCookieName(sessionCookieName),
+		session.SetCookieLifeTime(conf.SessionCookie.CookieMaxAge()),
+		session.SetExpired(conf.SessionExpired),
 	)
 }
 
-func getUserGroups(c *gin.Context) []string {
+// stickyIDMiddleware keep a random ID in a long-lived cookie. The selected versions are sticky by it on any
+// server instance and across restarts, without server state
+func stickyIDMiddleware(ctx *gin.Context) {
+	if stickyID := stickyIDFromCookie(ctx); stickyID != "" {
+		ctx.Set(stickyIDKey, stickyID)
+		ctx.Next()
+		return
+	}
+
+	id := make([]byte, 16)
+
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		log.Printf("[ERROR]  Cannot generate sticky ID: %v\n", err)
+		ctx.Next()
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:    stickyCookieName,
+		Value:   hex.EncodeToString(id),
+		MaxAge:  stickyCookieMaxAge,
+		Expires: time.Now().Add(stickyCookieMaxAge * time.Second),
+	}
+
+	currentSiteConfig().SessionCookie.Apply(cookie)
+	http.SetCookie(ctx.Writer, cookie)
+	ctx.Set(stickyIDKey, cookie.Value)
+	ctx.Next()
+}
+
+// stickyIDFromCookie the valid sticky ID sent by the client, or "". A new one is never set
+func stickyIDFromCookie(ctx *gin.Context) string {
+	if cookie, err := ctx.Request.Cookie(stickyCookieName); err == nil && stickyIDRegexp.MatchString(cookie.Value) {
+		return cookie.Value
+	}
+
+	return ""
+}
+
+// getStickyID the client's sticky ID, or "" when it's unknown
+func getStickyID(c *gin.Context) string {
+	return c.GetString(stickyIDKey)
+}
+
+// getSessionUserGroups the user groups saved in the session, see getUserGroups() for all user groups
+func getSessionUserGroups(c *gin.Context) []string {
 	store := sessionStoreFromContext(c)
 
 	if store == nil {
@@ -72,8 +246,24 @@ func getUserGroups(c *gin.Context) []string {
 
 	userGroup, ok := store.Get(userGroupKey)
 
-	if ok {
-		return userGroup.([]string)
+	if !ok {
+		return []string{defaultUserGroup}
+	}
+
+	switch groups := userGroup.(type) {
+	case []string:
+		return groups
+	case []interface{}:
+		// decoded from JSON by the file and cookie stores
+		res := []string{}
+
+		for _, group := range groups {
+			if value, ok := group.(string); ok {
+				res = append(res, value)
+			}
+		}
+
+		return res
 	}
 
 	return []string{defaultUserGroup}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-session/session"
+)
+
+const (
+	sessionStoreMemory = "memory"
+	sessionStoreFile   = "file"
+	sessionStoreCookie = "cookie"
+
+	sessionFileSuffix = ".json"
+
+	cookieSessionMinSignLength = 32
+)
+
+var (
+	_ session.ManagerStore = &FileSessionStore{}
+	_ session.Store        = &fileSession{}
+	_ session.Store        = &cookieSession{}
+)
+
+var sessionIDRegexp = regexp.MustCompile(`^[0-9A-Za-z_\-]+$`)
+
+// sessionValues the values of a session, shared by the stores
+type sessionValues struct {
+	sync.RWMutex
+	sid    string
+	values map[string]interface{}
+}
+
+func (s *sessionValues) SessionID() string {
+	return s.sid
+}
+
+func (s *sessionValues) Set(key string, value interface{}) {
+	s.Lock()
+	s.values[key] = value
+	s.Unlock()
+}
+
+func (s *sessionValues) Get(key string) (interface{}, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	value, ok := s.values[key]
+	return value, ok
+}
+
+func (s *sessionValues) Delete(key string) interface{} {
+	s.Lock()
+	defer s.Unlock()
+
+	value := s.values[key]
+	delete(s.values, key)
+	return value
+}
+
+func (s *sessionValues) marshalValues() ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	return json.Marshal(s.values)
+}
+
+// FileSessionStore a go-session ManagerStore saving each session as a JSON file. A session expires at
+// the file's modification time plus 'expired' seconds, and the file is touched when the session is used.
+type FileSessionStore struct {
+	dir    string
+	ticker *time.Ticker
+}
+
+// NewFileSessionStore new a FileSessionStore in the dir, removing the expired files in each cleanup interval
+func NewFileSessionStore(dir string, expired int64, cleanupInterval time.Duration) (*FileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	store := &FileSessionStore{dir: dir, ticker: time.NewTicker(cleanupInterval)}
+	go store.gc(time.Duration(expired) * time.Second)
+
+	return store, nil
+}
+
+func (s *FileSessionStore) filename(sid string) (string, error) {
+	if !sessionIDRegexp.MatchString(sid) {
+		return "", session.ErrInvalidSessionID
+	}
+
+	return filepath.Join(s.dir, sid+sessionFileSuffix), nil
+}
+
+func (s *FileSessionStore) gc(expired time.Duration) {
+	for range s.ticker.C {
+		files, err := ioutil.ReadDir(s.dir)
+
+		if err != nil {
+			log.Printf("[ERROR]  Cannot read session dir %s: %v\n", s.dir, err)
+			continue
+		}
+
+		for _, info := range files {
+			if strings.HasSuffix(info.Name(), sessionFileSuffix) && time.Since(info.ModTime()) > expired {
+				os.Remove(filepath.Join(s.dir, info.Name()))
+			}
+		}
+	}
+}
+
+// Check the session file exists
+func (s *FileSessionStore) Check(_ context.Context, sid string) (bool, error) {
+	filename, err := s.filename(sid)
+
+	if err != nil {
+		return false, nil
+	}
+
+	exist, err := pathExists(filename)
+	return exist, err
+}
+
+// Create a session, the file is written when saving
+func (s *FileSessionStore) Create(ctx context.Context, sid string, expired int64) (session.Store, error) {
+	if _, err := s.filename(sid); err != nil {
+		return nil, err
+	}
+
+	return &fileSession{sessionValues: sessionValues{sid: sid, values: map[string]interface{}{}}, ctx: ctx, mstore: s}, nil
+}
+
+// Update load the session, and renew its expiration time
+func (s *FileSessionStore) Update(ctx context.Context, sid string, expired int64) (session.Store, error) {
+	filename, err := s.filename(sid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(filename)
+
+	if os.IsNotExist(err) {
+		return s.Create(ctx, sid, expired)
+	} else if err != nil {
+		return nil, err
+	}
+
+	values := map[string]interface{}{}
+
+	if err = json.Unmarshal(content, &values); err != nil {
+		log.Printf("[ERROR]  Drop broken session file %s: %v\n", filename, err)
+		values = map[string]interface{}{}
+	}
+
+	now := time.Now()
+	os.Chtimes(filename, now, now)
+
+	return &fileSession{sessionValues: sessionValues{sid: sid, values: values}, ctx: ctx, mstore: s}, nil
+}
+
+// Delete the session file
+func (s *FileSessionStore) Delete(_ context.Context, sid string) error {
+	filename, err := s.filename(sid)
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Refresh move the session to the new ID
+func (s *FileSessionStore) Refresh(ctx context.Context, oldsid, sid string, expired int64) (session.Store, error) {
+	oldFilename, err := s.filename(oldsid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	filename, err := s.filename(sid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.Rename(oldFilename, filename); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return s.Update(ctx, sid, expired)
+}
+
+// Close stop the cleanup
+func (s *FileSessionStore) Close() error {
+	s.ticker.Stop()
+	return nil
+}
+
+func (s *FileSessionStore) save(sid string, content []byte) error {
+	filename, err := s.filename(sid)
+
+	if err != nil {
+		return err
+	}
+
+	// write then rename, a concurrent reader never gets a partial file
+	tmpFile, err := ioutil.TempFile(s.dir, sid+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tmpFile.Write(content)
+
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), filename)
+	}
+
+	if err != nil {
+		os.Remove(tmpFile.Name())
+	}
+
+	return err
+}
+
+type fileSession struct {
+	sessionValues
+	ctx    context.Context
+	mstore *FileSessionStore
+}
+
+func (s *fileSession) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fileSession) Save() error {
+	content, err := s.marshalValues()
+
+	if err != nil {
+		return err
+	}
+
+	return s.mstore.save(s.sid, content)
+}
+
+func (s *fileSession) Flush() error {
+	s.Lock()
+	s.values = map[string]interface{}{}
+	s.Unlock()
+
+	return s.Save()
+}
+
+// cookieSessionPayload the encrypted content of the session cookie
+type cookieSessionPayload struct {
+	SessionID string                 `json:"sid"`
+	ExpiredAt int64                  `json:"exp"`
+	Values    map[string]interface{} `json:"values"`
+}
+
+// CookieSessionCodec encrypt the whole session into the cookie by AES-GCM, no state in the server
+type CookieSessionCodec struct {
+	aead       cipher.AEAD
+	cookieName string
+	cookieConf *SessionCookieConfig
+	expired    int64
+}
+
+// NewCookieSessionCodec new a CookieSessionCodec, the AES-256 key is derived from the secret
+func NewCookieSessionCodec(secret string, cookieName string, cookieConf *SessionCookieConfig, expired int64) (
+	*CookieSessionCodec, error) {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &CookieSessionCodec{aead: aead, cookieName: cookieName, cookieConf: cookieConf, expired: expired}, nil
+}
+
+func (codec *CookieSessionCodec) encode(payload *cookieSessionPayload) (string, error) {
+	plain, err := json.Marshal(payload)
+
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, codec.aead.NonceSize())
+
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := codec.aead.Seal(nonce, nonce, plain, []byte(codec.cookieName))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (codec *CookieSessionCodec) decode(value string) (*cookieSessionPayload, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+
+	if err != nil || len(sealed) < codec.aead.NonceSize() {
+		return nil, session.ErrInvalidSessionID
+	}
+
+	nonceSize := codec.aead.NonceSize()
+	plain, err := codec.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(codec.cookieName))
+
+	if err != nil {
+		return nil, session.ErrInvalidSessionID
+	}
+
+	payload := &cookieSessionPayload{}
+
+	if err = json.Unmarshal(plain, payload); err != nil || payload.Values == nil {
+		return nil, session.ErrInvalidSessionID
+	}
+
+	return payload, nil
+}
+
+// Start read the session from the request's cookie, or start a new one
+func (codec *CookieSessionCodec) Start(ctx context.Context, w http.ResponseWriter, r *http.Request) *cookieSession {
+	now := time.Now().Unix()
+
+	if cookie, err := r.Cookie(codec.cookieName); err == nil {
+		if payload, err := codec.decode(cookie.Value); err == nil && payload.ExpiredAt > now {
+			s := &cookieSession{
+				sessionValues: sessionValues{sid: payload.SessionID, values: payload.Values},
+				ctx:           ctx,
+				codec:         codec,
+				writer:        w,
+			}
+
+			// renew the expiration time when half of it has passed
+			if payload.ExpiredAt-now < codec.expired/2 {
+				s.Save()
+			}
+
+			return s
+		}
+	}
+
+	sid := make([]byte, 16)
+	io.ReadFull(rand.Reader, sid)
+
+	return &cookieSession{
+		sessionValues: sessionValues{sid: hex.EncodeToString(sid), values: map[string]interface{}{}},
+		ctx:           ctx,
+		codec:         codec,
+		writer:        w,
+	}
+}
+
+type cookieSession struct {
+	sessionValues
+	ctx    context.Context
+	codec  *CookieSessionCodec
+	writer http.ResponseWriter
+}
+
+func (s *cookieSession) Context() context.Context {
+	return s.ctx
+}
+
+// Save write the session to the response's cookie, before writing the response body
+func (s *cookieSession) Save() error {
+	s.RLock()
+	payload := &cookieSessionPayload{
+		SessionID: s.sid,
+		ExpiredAt: time.Now().Unix() + s.codec.expired,
+		Values:    s.values,
+	}
+	value, err := s.codec.encode(payload)
+	s.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	if len(value) > 4000 {
+		return fmt.Errorf("Session cookie is too large: %d bytes", len(value))
+	}
+
+	// the cookie lives as long as the session in it
+	cookie := &http.Cookie{
+		Name:    s.codec.cookieName,
+		Value:   value,
+		MaxAge:  int(s.codec.expired),
+		Expires: time.Now().Add(time.Duration(s.codec.expired) * time.Second),
+	}
+
+	s.codec.cookieConf.Apply(cookie)
+	http.SetCookie(s.writer, cookie)
+
+	return nil
+}
+
+func (s *cookieSession) Flush() error {
+	s.Lock()
+	s.values = map[string]interface{}{}
+	s.Unlock()
+
+	return s.Save()
+}
+
+// NewCookieSessionMiddleware create a session middleware without server state
+func NewCookieSessionMiddleware(codec *CookieSessionCodec) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		store := codec.Start(context.Background(), ctx.Writer, ctx.Request)
+		ctx.Set(sessionStoreKey, store)
+		ctx.Next()
+	}
+}
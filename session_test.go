@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-session/session"
+	"gopkg.in/yaml.v2"
+)
+
+func Test_stickyIDMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// two server instances with the same versions, 50% for each
+	newEngine := func() *gin.Engine {
+		cache := NewAppManifestCache()
+
+		for _, tag := range []string{"v1", "v2"} {
+			cache.InstallAppVersion("tester", &AppInstallParam{Manifest: AppManifest{
+				ServiceName: "rmf-a", GitRevision: GitRevision{Tag: tag}, Extra: MetadataExtra{activationPercentKey: "50"},
+			}})
+		}
+
+		engine := gin.New()
+		engine.GET("/api/metadata/info", stickyIDMiddleware, func(c *gin.Context) {
+			info := cache.GenerateMetadata(GenMetadataParam{UserGroups: []string{defaultUserGroup}, SessionID: getStickyID(c)})
+			c.String(http.StatusOK, info.SelectedVersions["rmf-a"])
+		})
+		return engine
+	}
+
+	engines := []*gin.Engine{newEngine(), newEngine()}
+	recorder := httptest.NewRecorder()
+	engines[0].ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/metadata/info", nil))
+	cookies := (&http.Response{Header: recorder.Header()}).Cookies()
+
+	if len(cookies) != 1 || cookies[0].Name != stickyCookieName || !stickyIDRegexp.MatchString(cookies[0].Value) {
+		t.Fatalf("first request set cookies %v, want a sticky ID", cookies)
+	}
+
+	selected := recorder.Body.String()
+
+	for i := 0; i < 20; i++ {
+		request := httptest.NewRequest(http.MethodGet, "/api/metadata/info", nil)
+		request.AddCookie(&http.Cookie{Name: stickyCookieName, Value: cookies[0].Value})
+		recorder := httptest.NewRecorder()
+		engines[i%2].ServeHTTP(recorder, request)
+
+		if got := recorder.Body.String(); got != selected {
+			t.Fatalf("request %d with the cookie selected %s, want sticky %s", i, got, selected)
+		}
+
+		if header := recorder.Header().Get("Set-Cookie"); header != "" {
+			t.Fatalf("request %d with the cookie set cookie %s again", i, header)
+		}
+	}
+}
+
+func TestNewSessionMiddleware_saveWithState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rmf-sessions")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	store, err := NewFileSessionStore(dir, 3600, time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store.Close()
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(NewSessionMiddleware(&SessionCookieConfig{}, session.SetCookieName(sessionCookieName), session.SetStore(store)))
+	engine.GET("/api/metadata/info", func(c *gin.Context) { c.Status(http.StatusOK) })
+	engine.POST("/api/user/login", func(c *gin.Context) {
+		if err := setUserGroups(c, []string{testerUserGroup}); err != nil {
+			t.Error(err)
+		}
+	})
+
+	sessionFiles := func() int {
+		files, _ := ioutil.ReadDir(dir)
+		return len(files)
+	}
+
+	for i := 0; i < 10; i++ {
+		engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/metadata/info", nil))
+	}
+
+	if n := sessionFiles(); n != 0 {
+		t.Errorf("saved %d sessions without state, want 0", n)
+	}
+
+	engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/user/login", nil))
+
+	if n := sessionFiles(); n != 1 {
+		t.Errorf("saved %d sessions after login, want 1", n)
+	}
+}
+
+func Test_rewriteSessionCookie(t *testing.T) {
+	secure := false
+	conf := &SessionCookieConfig{Secure: &secure, SameSite: "strict", Path: "/app"}
+	header := http.Header{"Set-Cookie": {
+		"=broken",
+		"other=1; Path=/",
+		sessionCookieName + "=abc; Path=/; Max-Age=60; Secure",
+	}}
+
+	rewriteSessionCookie(header, conf)
+
+	want := []string{"=broken", "other=1; Path=/", sessionCookieName + "=abc; Path=/app; Max-Age=60; HttpOnly; SameSite=Strict"}
+
+	if got := header["Set-Cookie"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("rewriteSessionCookie() = %q, want %q", got, want)
+	}
+}
+
+func TestSessionCookieConfig_MergeFrom_maxAge(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want int
+	}{
+		{"secure: true", 3600 * 24 * 7},
+		{"maxAge: 0", 0},
+		{"maxAge: 600", 600},
+	}
+	for _, tt := range tests {
+		other := SessionCookieConfig{}
+
+		if err := yaml.Unmarshal([]byte(tt.yaml), &other); err != nil {
+			t.Fatal(err)
+		}
+
+		conf := defaultSiteConfig.Clone().SessionCookie
+		conf.MergeFrom(&other)
+
+		if got := conf.CookieMaxAge(); got != tt.want {
+			t.Errorf("MergeFrom(%s) maxAge = %d, want %d", tt.yaml, got, tt.want)
+		}
+	}
+}
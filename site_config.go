@@ -1,9 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
-	"log"
-	"os"
+	"net"
+	"strings"
+	"sync/atomic"
 
 	"gopkg.in/yaml.v2"
 )
@@ -16,19 +18,58 @@ type SiteConfig struct {
 	HTMLEnd    string        `yaml:"htmlEnd"`
 
 	ListenAddress     string   `yaml:"listenAddress"`
+	ShutdownTimeout   int      `yaml:"shutdownTimeout"` // seconds
+	PidFile           string   `yaml:"pidFile"`
 	StartupInitDir    string   `yaml:"startupInitDir"`
 	EnableServeStatic bool     `yaml:"enableServeStatic"`
 	ServeStaticFiles  []string `yaml:"serveStaticFiles"`
 	ServeAllInDir     bool     `yaml:"serveAllInDir"`
+	NotFoundFile      string   `yaml:"notFoundFile"`
+	StaticExtensions  []string `yaml:"staticExtensions"`
+
+	WatchStartupInitDir bool `yaml:"watchStartupInitDir"`
+	WatchInterval       int  `yaml:"watchInterval"` // seconds
+	WatchSiteConfig     bool `yaml:"watchSiteConfig"`
+
+	GinReleaseMode    bool     `yaml:"ginReleaseMode"`
+	EnableMetrics     bool     `yaml:"enableMetrics"`
+	MetricsUserGroups []string `yaml:"metricsUserGroups"` // labeled in the metrics, the others are 'other'
+	SessionSign       string   `yaml:"sessionSign"`
+
+	SessionStore           string `yaml:"sessionStore"`
+	SessionDir             string `yaml:"sessionDir"`
+	SessionExpired         int64  `yaml:"sessionExpired"`         // seconds
+	SessionCleanupInterval int    `yaml:"sessionCleanupInterval"` // seconds
+
+	SessionCookie SessionCookieConfig `yaml:"sessionCookie"`
+
+	Identity          IdentityConfig `yaml:"identity"`
+	EnableTesterLogin bool           `yaml:"enableTesterLogin"`
 
-	GinReleaseMode  bool     `yaml:"ginReleaseMode"`
-	SessionSign     string   `yaml:"sessionSign"`
 	ExtraKeysHidden []string `yaml:"extraKeysHidden"`
 
-	ExtraKeysHiddenMap map[string]bool
+	ManifestJournalFile string `yaml:"manifestJournalFile"`
+	HistoryLimit        int    `yaml:"historyLimit"` // revisions kept for reverting
+	AuditLogFile        string `yaml:"auditLogFile"`
+
+	ExposureLog ExposureLogConfig `yaml:"exposureLog"`
+
+	EnableBeacon  bool                `yaml:"enableBeacon"`
+	VersionHealth VersionHealthConfig `yaml:"versionHealth"`
+	CanaryGuard   CanaryGuardConfig   `yaml:"canaryGuard"`
+
+	Webhooks       []WebhookConfig `yaml:"webhooks"`
+	WebhookRetries int             `yaml:"webhookRetries"`
+
+	AdminTokens   []AdminToken   `yaml:"adminTokens"`
+	AdminHMACKeys []AdminHMACKey `yaml:"adminHMACKeys"`
+
+	ExtraKeysHiddenMap  map[string]bool
+	StaticExtensionsMap map[string]bool
 }
 
-var globalSiteConfig = SiteConfig{
+// defaultSiteConfig the config before merging the YAML file. NOTE: use currentSiteConfig() for the config in use
+var defaultSiteConfig = SiteConfig{
 	Extra: MetadataExtra{
 		"defaultRoute": "/home",
 	},
@@ -45,6 +86,7 @@ function rmfMetadataCallback(data) { rmfMetadataJSONP = data }</script>`,
 	HTMLEnd: `</body></html>`,
 
 	ListenAddress:     "127.0.0.1:8080",
+	ShutdownTimeout:   30,
 	StartupInitDir:    ".",
 	EnableServeStatic: true,
 
@@ -52,37 +94,225 @@ function rmfMetadataCallback(data) { rmfMetadataJSONP = data }</script>`,
 		"favicon.ico",
 	},
 	ServeAllInDir: false,
+	NotFoundFile:  "404.html",
+
+	StaticExtensions: []string{
+		".js", ".mjs", ".css", ".map", ".json", ".txt", ".xml", ".webmanifest", ".wasm",
+		".ico", ".png", ".jpg", ".jpeg", ".gif", ".svg", ".webp", ".avif",
+		".woff", ".woff2", ".ttf", ".otf", ".eot",
+		".mp3", ".mp4", ".webm",
+	},
+
+	WatchStartupInitDir: false,
+	WatchInterval:       5,
 
-	GinReleaseMode: false,
-	SessionSign:    "",
+	GinReleaseMode:    false,
+	EnableMetrics:     true,
+	MetricsUserGroups: []string{testerUserGroup},
+	SessionSign:       "",
 
-	ExtraKeysHidden: []string{
-		"userGroup",
-		"activationPercent",
+	SessionStore:           sessionStoreMemory,
+	SessionDir:             "sessions",
+	SessionExpired:         7200,
+	SessionCleanupInterval: 600,
+
+	SessionCookie: SessionCookieConfig{
+		SameSite: "lax",
+		Path:     "/",
+		MaxAge:   intPointer(3600 * 24 * 7),
+	},
+
+	Identity: IdentityConfig{
+		GroupsClaim: "groups",
 	},
+	EnableTesterLogin: false,
+
+	ExtraKeysHidden: []string{},
+
+	ManifestJournalFile: "",
+	HistoryLimit:        1000,
+	AuditLogFile:        "",
+
+	ExposureLog: ExposureLogConfig{
+		MaxSize:    100,
+		MaxBackups: 5,
+		SampleRate: floatPointer(1),
+	},
+
+	EnableBeacon: false,
+	VersionHealth: VersionHealthConfig{
+		Retention:    180,
+		File:         "",
+		SaveInterval: 60,
+		RateLimit:    60,
+		MaxClients:   200000,
+
+		MaxErrorsPerSubnet: 1,
+	},
+	CanaryGuard: CanaryGuardConfig{
+		Interval:      canaryGuardDefaultInterval,
+		Window:        15,
+		MaxErrorRatio: 2,
+		MinErrorRate:  0.01,
+		MinDeliveries: 100,
+	},
+
+	Webhooks:       []WebhookConfig{},
+	WebhookRetries: webhookDefaultRetries,
 }
 
-// LoadSiteConfig Load site's config form YAML file
-func LoadSiteConfig(filename string) {
-	file, err := os.OpenFile(filename, os.O_RDONLY, 0600)
-	defer file.Close()
+// siteConfigValue holds the *SiteConfig in use, swapped as a whole when reloading
+var siteConfigValue atomic.Value
 
+func init() {
+	conf := defaultSiteConfig.Clone()
+	conf.UpdateExtraKeysHiddenMap()
+	conf.UpdateStaticExtensionsMap()
+	siteConfigValue.Store(conf)
+}
+
+// currentSiteConfig the config in use. Never change it, it's shared by the concurrent requests
+func currentSiteConfig() *SiteConfig {
+	return siteConfigValue.Load().(*SiteConfig)
+}
+
+// storeSiteConfig swap the config in use
+func storeSiteConfig(conf *SiteConfig) {
+	siteConfigValue.Store(conf)
+}
+
+// LoadSiteConfig Load site's config form YAML file, merged to the default config
+func LoadSiteConfig(filename string) (*SiteConfig, error) {
 	content, err := ioutil.ReadFile(filename)
 
 	if err != nil {
-		log.Printf("[ERROR]  Cannot read file %s\n", filename)
-		return
+		return nil, fmt.Errorf("Cannot read file %s", filename)
 	}
 
 	siteConfig := SiteConfig{}
 	err = yaml.Unmarshal(content, &siteConfig)
 
 	if err != nil {
-		log.Printf("[ERROR]  Cannot convert file %s to SiteConfig\n", filename)
-		return
+		return nil, fmt.Errorf("Cannot convert file %s to SiteConfig: %v", filename, err)
 	}
 
-	globalSiteConfig.MergeFrom(&siteConfig)
+	conf := defaultSiteConfig.Clone()
+	conf.MergeFrom(&siteConfig)
+
+	if err = conf.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid site config %s: %v", filename, err)
+	}
+
+	return conf, nil
+}
+
+// Clone deep copy the config, then changing the copy never affects 'conf'
+func (conf *SiteConfig) Clone() *SiteConfig {
+	res := *conf
+	res.Extra = MetadataExtra{}
+
+	for key, value := range conf.Extra {
+		res.Extra[key] = value
+	}
+
+	res.ServeStaticFiles = append([]string{}, conf.ServeStaticFiles...)
+	res.StaticExtensions = append([]string{}, conf.StaticExtensions...)
+	res.ExtraKeysHidden = append([]string{}, conf.ExtraKeysHidden...)
+	res.MetricsUserGroups = append([]string{}, conf.MetricsUserGroups...)
+	res.AdminTokens = append([]AdminToken{}, conf.AdminTokens...)
+	res.AdminHMACKeys = append([]AdminHMACKey{}, conf.AdminHMACKeys...)
+	res.Identity.GroupMap = map[string]string{}
+
+	for key, value := range conf.Identity.GroupMap {
+		res.Identity.GroupMap[key] = value
+	}
+
+	res.Webhooks = make([]WebhookConfig, len(conf.Webhooks))
+
+	for i, webhook := range conf.Webhooks {
+		res.Webhooks[i] = webhook
+		res.Webhooks[i].Events = append([]string{}, webhook.Events...)
+	}
+
+	res.Identity.TrustedProxies = append([]string{}, conf.Identity.TrustedProxies...)
+	res.Identity.UpdateTrustedProxyNets()
+
+	res.UpdateExtraKeysHiddenMap()
+	res.UpdateStaticExtensionsMap()
+	return &res
+}
+
+// Validate check the values which cannot work
+func (conf *SiteConfig) Validate() error {
+	if _, _, err := net.SplitHostPort(conf.ListenAddress); err != nil {
+		return fmt.Errorf("listenAddress '%s': %v", conf.ListenAddress, err)
+	}
+
+	if conf.WatchInterval < 1 {
+		return fmt.Errorf("watchInterval %d, require at least 1 second", conf.WatchInterval)
+	}
+
+	switch conf.SessionStore {
+	case sessionStoreMemory, sessionStoreFile, sessionStoreCookie:
+	default:
+		return fmt.Errorf("sessionStore '%s', require one of memory, file and cookie", conf.SessionStore)
+	}
+
+	// the key of the cookie store is derived from it, a short one is guessed
+	if conf.SessionStore == sessionStoreCookie && len(conf.SessionSign) < cookieSessionMinSignLength {
+		return fmt.Errorf("sessionStore 'cookie' requires a random sessionSign of at least %d bytes",
+			cookieSessionMinSignLength)
+	}
+
+	if _, ok := sessionCookieSameSites[strings.ToLower(conf.SessionCookie.SameSite)]; !ok {
+		return fmt.Errorf("sessionCookie.sameSite '%s', require one of lax, strict and none", conf.SessionCookie.SameSite)
+	}
+
+	if conf.SessionCookie.CookieMaxAge() < 0 {
+		return fmt.Errorf("sessionCookie.maxAge %d, require 0 (browser session) or more seconds",
+			conf.SessionCookie.CookieMaxAge())
+	}
+
+	if strings.EqualFold(conf.SessionCookie.SameSite, "none") &&
+		conf.SessionCookie.Secure != nil && !*conf.SessionCookie.Secure {
+		return fmt.Errorf("sessionCookie.sameSite 'none' requires sessionCookie.secure")
+	}
+
+	if conf.Identity.Enabled() && conf.Identity.SharedKey == "" && conf.Identity.JWKSFile == "" {
+		return fmt.Errorf("identity requires sharedKey or jwksFile to verify JWT")
+	}
+
+	if _, err := parseTrustedProxies(conf.Identity.TrustedProxies); err != nil {
+		return fmt.Errorf("identity.trustedProxies: %v", err)
+	}
+
+	if conf.Identity.GroupsHeader != "" && len(conf.Identity.TrustedProxies) == 0 {
+		return fmt.Errorf("identity.groupsHeader requires identity.trustedProxies")
+	}
+
+	if rate := conf.ExposureLog.LogSampleRate(); rate < 0 || rate > 1 {
+		return fmt.Errorf("exposureLog.sampleRate %v, require from 0 to 1", rate)
+	}
+
+	for i := range conf.Webhooks {
+		if err := conf.Webhooks[i].check(); err != nil {
+			return err
+		}
+	}
+
+	for _, item := range conf.AdminTokens {
+		if _, ok := adminRoleLevels[item.Role]; !ok {
+			return fmt.Errorf("admin token '%s' has an unknown role '%s'", item.Name, item.Role)
+		}
+	}
+
+	for _, item := range conf.AdminHMACKeys {
+		if _, ok := adminRoleLevels[item.Role]; !ok {
+			return fmt.Errorf("admin HMAC key '%s' has an unknown role '%s'", item.KeyID, item.Role)
+		}
+	}
+
+	return nil
 }
 
 // MergeFrom Merge the config to 'conf' from 'other'
@@ -107,6 +337,14 @@ func (conf *SiteConfig) MergeFrom(other *SiteConfig) {
 		conf.ListenAddress = other.ListenAddress
 	}
 
+	if other.ShutdownTimeout > 0 {
+		conf.ShutdownTimeout = other.ShutdownTimeout
+	}
+
+	if other.PidFile != "" {
+		conf.PidFile = other.PidFile
+	}
+
 	conf.StartupInitDir = other.StartupInitDir
 	conf.EnableServeStatic = other.EnableServeStatic
 
@@ -115,25 +353,128 @@ func (conf *SiteConfig) MergeFrom(other *SiteConfig) {
 	}
 
 	conf.ServeAllInDir = other.ServeAllInDir
+
+	if other.NotFoundFile != "" {
+		conf.NotFoundFile = other.NotFoundFile
+	}
+
+	if len(other.StaticExtensions) > 0 {
+		conf.StaticExtensions = other.StaticExtensions
+	}
+
+	conf.WatchStartupInitDir = other.WatchStartupInitDir
+	conf.WatchSiteConfig = other.WatchSiteConfig
+
+	if other.WatchInterval > 0 {
+		conf.WatchInterval = other.WatchInterval
+	}
+
 	conf.GinReleaseMode = other.GinReleaseMode
+	conf.EnableMetrics = other.EnableMetrics
+
+	if len(other.MetricsUserGroups) > 0 {
+		conf.MetricsUserGroups = other.MetricsUserGroups
+	}
+
 	conf.SessionSign = other.SessionSign
 
+	if other.SessionStore != "" {
+		conf.SessionStore = other.SessionStore
+	}
+
+	if other.SessionDir != "" {
+		conf.SessionDir = other.SessionDir
+	}
+
+	if other.SessionExpired > 0 {
+		conf.SessionExpired = other.SessionExpired
+	}
+
+	if other.SessionCleanupInterval > 0 {
+		conf.SessionCleanupInterval = other.SessionCleanupInterval
+	}
+
+	conf.SessionCookie.MergeFrom(&other.SessionCookie)
+	conf.Identity.MergeFrom(&other.Identity)
+	conf.EnableTesterLogin = other.EnableTesterLogin
+
 	if len(other.ExtraKeysHidden) > 0 {
 		conf.ExtraKeysHidden = other.ExtraKeysHidden
 	}
 
+	if other.ManifestJournalFile != "" {
+		conf.ManifestJournalFile = other.ManifestJournalFile
+	}
+
+	if other.AuditLogFile != "" {
+		conf.AuditLogFile = other.AuditLogFile
+	}
+
+	conf.ExposureLog.MergeFrom(&other.ExposureLog)
+	conf.EnableBeacon = other.EnableBeacon
+	conf.VersionHealth.MergeFrom(&other.VersionHealth)
+	conf.CanaryGuard.MergeFrom(&other.CanaryGuard)
+	conf.Webhooks = other.Webhooks
+
+	if other.WebhookRetries > 0 {
+		conf.WebhookRetries = other.WebhookRetries
+	}
+
+	if other.HistoryLimit > 0 {
+		conf.HistoryLimit = other.HistoryLimit
+	}
+
+	conf.AdminTokens = other.AdminTokens
+	conf.AdminHMACKeys = other.AdminHMACKeys
+
 	conf.UpdateExtraKeysHiddenMap()
+	conf.UpdateStaticExtensionsMap()
+}
+
+func intPointer(value int) *int {
+	return &value
+}
+
+func floatPointer(value float64) *float64 {
+	return &value
+}
+
+func int64Pointer(value int64) *int64 {
+	return &value
+}
+
+// serverExtraKeys the keys read by the server to select the versions, always hidden from user
+var serverExtraKeys = []string{
+	userGroupKey,
+	activationPercentKey,
+	activationPercentByGroupKey,
+	targetingKey,
+	releaseSetKey,
+	autoRollbackKey,
 }
 
-// UpdateExtraKeysHiddenMap update the map of ExtraKeysHidden
+// UpdateExtraKeysHiddenMap update the map of ExtraKeysHidden, with the server's keys
 func (conf *SiteConfig) UpdateExtraKeysHiddenMap() {
 	conf.ExtraKeysHiddenMap = map[string]bool{}
 
+	for _, key := range serverExtraKeys {
+		conf.ExtraKeysHiddenMap[key] = true
+	}
+
 	for _, key := range conf.ExtraKeysHidden {
 		conf.ExtraKeysHiddenMap[key] = true
 	}
 }
 
+// UpdateStaticExtensionsMap update the map of StaticExtensions, in lower case
+func (conf *SiteConfig) UpdateStaticExtensionsMap() {
+	conf.StaticExtensionsMap = map[string]bool{}
+
+	for _, ext := range conf.StaticExtensions {
+		conf.StaticExtensionsMap[strings.ToLower(ext)] = true
+	}
+}
+
 // SafeExtra hidden some keys from user
 func (conf *SiteConfig) SafeExtra(extra MetadataExtra) MetadataExtra {
 	res := MetadataExtra{}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// siteConfigRestartFields the YAML keys used only at startup, they keep the running values when reloading
+var siteConfigRestartFields = map[string]bool{
+	"listenAddress":          true,
+	"shutdownTimeout":        true,
+	"pidFile":                true,
+	"startupInitDir":         true,
+	"enableServeStatic":      true,
+	"serveStaticFiles":       true,
+	"serveAllInDir":          true,
+	"watchStartupInitDir":    true,
+	"watchInterval":          true,
+	"watchSiteConfig":        true,
+	"ginReleaseMode":         true,
+	"enableMetrics":          true,
+	"sessionSign":            true,
+	"sessionStore":           true,
+	"sessionDir":             true,
+	"sessionExpired":         true,
+	"sessionCleanupInterval": true,
+	"sessionCookie":          true,
+	"manifestJournalFile":    true,
+	"auditLogFile":           true,
+	"exposureLog":            true,
+	"enableBeacon":           true,
+	"versionHealth":          true,
+}
+
+// SiteConfigReloadResult the changed YAML keys of a reload
+type SiteConfigReloadResult struct {
+	Changed     []string `json:"changed"`     // applied to the running server
+	NeedRestart []string `json:"needRestart"` // ignored until restart
+}
+
+// siteConfigReloadMutex serialize the reloads, then no reload is lost
+var siteConfigReloadMutex sync.Mutex
+
+// ReloadSiteConfig load and validate the file, then swap the config in use as a whole
+func ReloadSiteConfig(filename string) (*SiteConfigReloadResult, error) {
+	siteConfigReloadMutex.Lock()
+	defer siteConfigReloadMutex.Unlock()
+
+	conf, err := LoadSiteConfig(filename)
+
+	if err != nil {
+		log.Printf("[ERROR]  Reload site config: %v\n", err)
+		return nil, err
+	}
+
+	result := applySiteConfigFields(conf, currentSiteConfig())
+	conf.UpdateExtraKeysHiddenMap()
+	conf.UpdateStaticExtensionsMap()
+	storeSiteConfig(conf)
+
+	log.Printf("[INFO]  Reloaded site config %s, changed: [%s], need restart: [%s]\n", filename,
+		strings.Join(result.Changed, ", "), strings.Join(result.NeedRestart, ", "))
+	webhooks.Dispatch(webhookEventSiteConfigReload, result)
+	return result, nil
+}
+
+// applySiteConfigFields compare each YAML field, and keep the running values of the restart fields in 'conf'
+func applySiteConfigFields(conf *SiteConfig, running *SiteConfig) *SiteConfigReloadResult {
+	result := &SiteConfigReloadResult{Changed: []string{}, NeedRestart: []string{}}
+	newValue := reflect.ValueOf(conf).Elem()
+	runningValue := reflect.ValueOf(running).Elem()
+	configType := newValue.Type()
+
+	for i := 0; i < configType.NumField(); i++ {
+		name := strings.Split(configType.Field(i).Tag.Get("yaml"), ",")[0]
+
+		if name == "" || reflect.DeepEqual(newValue.Field(i).Interface(), runningValue.Field(i).Interface()) {
+			continue
+		}
+
+		if siteConfigRestartFields[name] {
+			result.NeedRestart = append(result.NeedRestart, name)
+			newValue.Field(i).Set(runningValue.Field(i))
+		} else {
+			result.Changed = append(result.Changed, name)
+		}
+	}
+
+	return result
+}
+
+// reloadSiteConfigOnSignal reload the file on each SIGHUP, never returns
+func reloadSiteConfigOnSignal(filename string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		log.Printf("[INFO]  SIGHUP received, reload site config %s\n", filename)
+		ReloadSiteConfig(filename)
+	}
+}
+
+// reloadSiteConfigOnChange poll the file, reload it when it's changed, never returns
+func reloadSiteConfigOnChange(filename string, interval time.Duration) {
+	last, _ := statWatchedFile(filename)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		state, ok := statWatchedFile(filename)
+
+		if !ok || state == last {
+			continue
+		}
+
+		last = state
+		ReloadSiteConfig(filename)
+	}
+}
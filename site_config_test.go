@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_applySiteConfigFields(t *testing.T) {
+	running := defaultSiteConfig.Clone()
+	conf := running.Clone()
+	conf.ShutdownTimeout = running.ShutdownTimeout + 30
+	conf.HistoryLimit = running.HistoryLimit + 1
+
+	result := applySiteConfigFields(conf, running)
+
+	if !reflect.DeepEqual(result.Changed, []string{"historyLimit"}) ||
+		!reflect.DeepEqual(result.NeedRestart, []string{"shutdownTimeout"}) {
+		t.Errorf("applySiteConfigFields() = %+v, want historyLimit changed and shutdownTimeout needing restart", result)
+	}
+
+	if conf.ShutdownTimeout != running.ShutdownTimeout {
+		t.Errorf("applySiteConfigFields() should keep the running shutdownTimeout, got %d", conf.ShutdownTimeout)
+	}
+}
+
+func TestSiteConfig_Validate_sessionSign(t *testing.T) {
+	tests := []struct {
+		store   string
+		sign    string
+		wantErr bool
+	}{
+		{sessionStoreCookie, "", true},
+		{sessionStoreCookie, "short-secret", true},
+		{sessionStoreCookie, "0123456789abcdef0123456789abcdef", false},
+		{sessionStoreMemory, "", false},
+	}
+	for _, tt := range tests {
+		conf := defaultSiteConfig.Clone()
+		conf.SessionStore = tt.store
+		conf.SessionSign = tt.sign
+
+		if err := conf.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate() of %s store with sessionSign %q error = %v, wantErr %v", tt.store, tt.sign, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSiteConfig_SafeExtra(t *testing.T) {
+	conf := defaultSiteConfig.Clone()
+	conf.MergeFrom(&SiteConfig{ExtraKeysHidden: []string{"internalNote"}})
+
+	extra := conf.SafeExtra(MetadataExtra{
+		"internalNote":       "hidden",
+		targetingKey:         "ua.browser == 'Chrome'",
+		activationPercentKey: "20",
+		"theme":              "dark",
+	})
+
+	if !reflect.DeepEqual(extra, MetadataExtra{"theme": "dark"}) {
+		t.Errorf("SafeExtra() = %v, want only theme, the server's keys are always hidden", extra)
+	}
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mssola/user_agent"
+)
+
+// The targeting expression in manifest's Extra, such as:
+//   ua.browser == 'Chrome' && header['X-App-Platform'] == 'webview'
+//   'beta' in groups || ip in ['10.0.0.0/8', '192.168.0.0/16']
+//   !ua.mobile && ua.browserVersion >= 100 && (cookie['lang'] == 'en' || query['lang'] == 'en')
+//
+// Values: strings in single or double quotes, numbers, true, false, lists in [], and the request fields:
+//   groups, ip, ua.browser, ua.browserVersion, ua.os, ua.platform, ua.mobile, ua.bot,
+//   header['Name'], cookie['name'], query['name']
+// Operators by precedence: !, then == != < <= > >= in, then &&, then ||. Use () for grouping.
+// '<' and the like compare numbers, such as the major version of '120.0.6099.71'.
+// 'in' checks a list (or a string) contains the left value, an IP is in a CIDR too.
+
+// targetingValue string, float64, bool or []string
+type targetingValue interface{}
+
+// TargetingContext the request fields for targeting expressions
+type TargetingContext struct {
+	Request    *http.Request
+	ClientIP   string
+	UserGroups []string
+
+	uaOnce sync.Once
+	ua     *user_agent.UserAgent
+}
+
+// NewTargetingContext the context of the request. The client IP is only taken from the forwarded headers
+// of the trusted proxies, see IdentityConfig.TrustedProxies
+func NewTargetingContext(c *gin.Context, userGroups []string) *TargetingContext {
+	return &TargetingContext{Request: c.Request, ClientIP: getClientIP(c), UserGroups: userGroups}
+}
+
+func (ctx *TargetingContext) userAgent() *user_agent.UserAgent {
+	ctx.uaOnce.Do(func() {
+		ctx.ua = user_agent.New(ctx.Request.UserAgent())
+	})
+
+	return ctx.ua
+}
+
+// TargetingRule a compiled targeting expression
+type TargetingRule struct {
+	root targetingNode
+}
+
+// Match evaluate the rule for the request
+func (rule *TargetingRule) Match(ctx *TargetingContext) bool {
+	return targetingTruthy(rule.root.eval(ctx))
+}
+
+// targetingRules compiled rules by expression, as map[expr string]*TargetingRule
+var targetingRules sync.Map
+
+// CompileTargeting compile the expression, the result is cached
+func CompileTargeting(expr string) (*TargetingRule, error) {
+	if value, ok := targetingRules.Load(expr); ok {
+		return value.(*TargetingRule), nil
+	}
+
+	parser := &targetingParser{}
+
+	if err := parser.tokenize(expr); err != nil {
+		return nil, err
+	}
+
+	root, err := parser.parseOr()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.pos < len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected '%s' at %d", parser.tokens[parser.pos].text, parser.tokens[parser.pos].offset)
+	}
+
+	rule := &TargetingRule{root: root}
+	targetingRules.Store(expr, rule)
+	return rule, nil
+}
+
+// checkTargeting check the targeting expression in the extra can be compiled
+func checkTargeting(extra MetadataExtra) error {
+	expr, ok := extra[targetingKey]
+
+	if !ok {
+		return nil
+	}
+
+	if _, err := CompileTargeting(expr); err != nil {
+		return fmt.Errorf("Invalid targeting \"%s\": %v", expr, err)
+	}
+
+	return nil
+}
+
+// matchTargeting check the manifest targets the request. A rule failed to compile never matches,
+// it can only come from the manifest files loaded at startup
+func matchTargeting(manifest *AppManifest, ctx *TargetingContext) (targeted bool, matched bool) {
+	expr, ok := manifest.Extra[targetingKey]
+
+	if !ok {
+		return false, true
+	}
+
+	if ctx == nil {
+		return true, false
+	}
+
+	rule, err := CompileTargeting(expr)
+
+	if err != nil {
+		return true, false
+	}
+
+	return true, rule.Match(ctx)
+}
+
+const (
+	tokenString = iota
+	tokenNumber
+	tokenIdent
+	tokenOp
+)
+
+type targetingToken struct {
+	kind   int
+	text   string
+	offset int
+}
+
+var targetingNumberRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?`)
+
+type targetingParser struct {
+	tokens []targetingToken
+	pos    int
+}
+
+func (parser *targetingParser) tokenize(expr string) error {
+	for i := 0; i < len(expr); {
+		ch := rune(expr[i])
+
+		switch {
+		case unicode.IsSpace(ch):
+			i++
+		case ch == '\'' || ch == '"':
+			end := strings.IndexRune(expr[i+1:], ch)
+
+			if end < 0 {
+				return fmt.Errorf("unterminated string at %d", i)
+			}
+
+			parser.tokens = append(parser.tokens, targetingToken{tokenString, expr[i+1 : i+1+end], i})
+			i += end + 2
+		case ch >= '0' && ch <= '9':
+			number := targetingNumberRegexp.FindString(expr[i:])
+			parser.tokens = append(parser.tokens, targetingToken{tokenNumber, number, i})
+			i += len(number)
+		case ch == '_' || unicode.IsLetter(ch):
+			start := i
+
+			for i < len(expr) && (expr[i] == '_' || expr[i] == '.' ||
+				unicode.IsLetter(rune(expr[i])) || unicode.IsDigit(rune(expr[i]))) {
+				i++
+			}
+
+			parser.tokens = append(parser.tokens, targetingToken{tokenIdent, expr[start:i], start})
+		default:
+			op := ""
+
+			for _, candidate := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ","} {
+				if strings.HasPrefix(expr[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+
+			if op == "" {
+				return fmt.Errorf("unexpected '%c' at %d", ch, i)
+			}
+
+			parser.tokens = append(parser.tokens, targetingToken{tokenOp, op, i})
+			i += len(op)
+		}
+	}
+
+	return nil
+}
+
+func (parser *targetingParser) peek(kind int, text string) bool {
+	if parser.pos >= len(parser.tokens) {
+		return false
+	}
+
+	token := parser.tokens[parser.pos]
+	return token.kind == kind && token.text == text
+}
+
+func (parser *targetingParser) expect(text string) error {
+	if !parser.peek(tokenOp, text) {
+		return parser.unexpected()
+	}
+
+	parser.pos++
+	return nil
+}
+
+func (parser *targetingParser) unexpected() error {
+	if parser.pos >= len(parser.tokens) {
+		return fmt.Errorf("unexpected end")
+	}
+
+	token := parser.tokens[parser.pos]
+	return fmt.Errorf("unexpected '%s' at %d", token.text, token.offset)
+}
+
+func (parser *targetingParser) parseOr() (targetingNode, error) {
+	left, err := parser.parseAnd()
+
+	for err == nil && parser.peek(tokenOp, "||") {
+		parser.pos++
+		var right targetingNode
+
+		if right, err = parser.parseAnd(); err == nil {
+			left = &logicalNode{op: "||", left: left, right: right}
+		}
+	}
+
+	return left, err
+}
+
+func (parser *targetingParser) parseAnd() (targetingNode, error) {
+	left, err := parser.parseComparison()
+
+	for err == nil && parser.peek(tokenOp, "&&") {
+		parser.pos++
+		var right targetingNode
+
+		if right, err = parser.parseComparison(); err == nil {
+			left = &logicalNode{op: "&&", left: left, right: right}
+		}
+	}
+
+	return left, err
+}
+
+func (parser *targetingParser) parseComparison() (targetingNode, error) {
+	left, err := parser.parseUnary()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if parser.peek(tokenOp, op) {
+			parser.pos++
+			right, err := parser.parseUnary()
+
+			if err != nil {
+				return nil, err
+			}
+
+			return &compareNode{op: op, left: left, right: right}, nil
+		}
+	}
+
+	if parser.peek(tokenIdent, "in") {
+		parser.pos++
+		right, err := parser.parseUnary()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &inNode{left: left, right: right}, nil
+	}
+
+	return left, nil
+}
+
+func (parser *targetingParser) parseUnary() (targetingNode, error) {
+	if parser.peek(tokenOp, "!") {
+		parser.pos++
+		operand, err := parser.parseUnary()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &notNode{operand: operand}, nil
+	}
+
+	return parser.parsePrimary()
+}
+
+func (parser *targetingParser) parsePrimary() (targetingNode, error) {
+	if parser.pos >= len(parser.tokens) {
+		return nil, parser.unexpected()
+	}
+
+	token := parser.tokens[parser.pos]
+	parser.pos++
+
+	switch token.kind {
+	case tokenString:
+		return &literalNode{value: token.text}, nil
+	case tokenNumber:
+		number, _ := strconv.ParseFloat(token.text, 64)
+		return &literalNode{value: number}, nil
+	case tokenIdent:
+		return parser.parseField(token)
+	}
+
+	switch token.text {
+	case "(":
+		node, err := parser.parseOr()
+
+		if err == nil {
+			err = parser.expect(")")
+		}
+
+		return node, err
+	case "[":
+		items := []string{}
+
+		for !parser.peek(tokenOp, "]") {
+			if len(items) > 0 {
+				if err := parser.expect(","); err != nil {
+					return nil, err
+				}
+			}
+
+			if parser.pos >= len(parser.tokens) || parser.tokens[parser.pos].kind == tokenOp ||
+				parser.tokens[parser.pos].kind == tokenIdent {
+				return nil, parser.unexpected()
+			}
+
+			items = append(items, parser.tokens[parser.pos].text)
+			parser.pos++
+		}
+
+		parser.pos++
+		return &literalNode{value: items}, nil
+	}
+
+	parser.pos--
+	return nil, parser.unexpected()
+}
+
+// targetingFields the request fields without argument
+var targetingFields = map[string]func(ctx *TargetingContext) targetingValue{
+	"groups": func(ctx *TargetingContext) targetingValue { return ctx.UserGroups },
+	"ip":     func(ctx *TargetingContext) targetingValue { return ctx.ClientIP },
+	"ua.browser": func(ctx *TargetingContext) targetingValue {
+		name, _ := ctx.userAgent().Browser()
+		return name
+	},
+	"ua.browserVersion": func(ctx *TargetingContext) targetingValue {
+		_, version := ctx.userAgent().Browser()
+		return version
+	},
+	"ua.os":       func(ctx *TargetingContext) targetingValue { return ctx.userAgent().OSInfo().Name },
+	"ua.platform": func(ctx *TargetingContext) targetingValue { return ctx.userAgent().Platform() },
+	"ua.mobile":   func(ctx *TargetingContext) targetingValue { return ctx.userAgent().Mobile() },
+	"ua.bot":      func(ctx *TargetingContext) targetingValue { return ctx.userAgent().Bot() },
+}
+
+// targetingMapFields the request fields with a name, such as header['X-App-Platform']
+var targetingMapFields = map[string]func(ctx *TargetingContext, name string) targetingValue{
+	"header": func(ctx *TargetingContext, name string) targetingValue { return ctx.Request.Header.Get(name) },
+	"cookie": func(ctx *TargetingContext, name string) targetingValue {
+		if cookie, err := ctx.Request.Cookie(name); err == nil {
+			return cookie.Value
+		}
+
+		return ""
+	},
+	"query": func(ctx *TargetingContext, name string) targetingValue { return ctx.Request.URL.Query().Get(name) },
+}
+
+func (parser *targetingParser) parseField(token targetingToken) (targetingNode, error) {
+	switch token.text {
+	case "true":
+		return &literalNode{value: true}, nil
+	case "false":
+		return &literalNode{value: false}, nil
+	}
+
+	if getter, ok := targetingFields[token.text]; ok {
+		return &fieldNode{get: getter}, nil
+	}
+
+	getter, ok := targetingMapFields[token.text]
+
+	if !ok {
+		return nil, fmt.Errorf("unknown field '%s' at %d", token.text, token.offset)
+	}
+
+	if err := parser.expect("["); err != nil {
+		return nil, err
+	}
+
+	if parser.pos >= len(parser.tokens) || parser.tokens[parser.pos].kind != tokenString {
+		return nil, parser.unexpected()
+	}
+
+	name := parser.tokens[parser.pos].text
+	parser.pos++
+
+	if err := parser.expect("]"); err != nil {
+		return nil, err
+	}
+
+	return &fieldNode{get: func(ctx *TargetingContext) targetingValue { return getter(ctx, name) }}, nil
+}
+
+type targetingNode interface {
+	eval(ctx *TargetingContext) targetingValue
+}
+
+type literalNode struct {
+	value targetingValue
+}
+
+func (node *literalNode) eval(_ *TargetingContext) targetingValue {
+	return node.value
+}
+
+type fieldNode struct {
+	get func(ctx *TargetingContext) targetingValue
+}
+
+func (node *fieldNode) eval(ctx *TargetingContext) targetingValue {
+	return node.get(ctx)
+}
+
+type notNode struct {
+	operand targetingNode
+}
+
+func (node *notNode) eval(ctx *TargetingContext) targetingValue {
+	return !targetingTruthy(node.operand.eval(ctx))
+}
+
+type logicalNode struct {
+	op          string
+	left, right targetingNode
+}
+
+func (node *logicalNode) eval(ctx *TargetingContext) targetingValue {
+	left := targetingTruthy(node.left.eval(ctx))
+
+	if node.op == "&&" {
+		return left && targetingTruthy(node.right.eval(ctx))
+	}
+
+	return left || targetingTruthy(node.right.eval(ctx))
+}
+
+type compareNode struct {
+	op          string
+	left, right targetingNode
+}
+
+func (node *compareNode) eval(ctx *TargetingContext) targetingValue {
+	left, right := node.left.eval(ctx), node.right.eval(ctx)
+
+	switch node.op {
+	case "==":
+		return targetingString(left) == targetingString(right)
+	case "!=":
+		return targetingString(left) != targetingString(right)
+	}
+
+	a, okA := targetingNumber(left)
+	b, okB := targetingNumber(right)
+
+	if !okA || !okB {
+		return false
+	}
+
+	switch node.op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	default:
+		return a >= b
+	}
+}
+
+type inNode struct {
+	left, right targetingNode
+}
+
+func (node *inNode) eval(ctx *TargetingContext) targetingValue {
+	left, right := node.left.eval(ctx), node.right.eval(ctx)
+	lefts, ok := left.([]string)
+
+	if !ok {
+		lefts = []string{targetingString(left)}
+	}
+
+	switch container := right.(type) {
+	case []string:
+		for _, item := range container {
+			for _, value := range lefts {
+				if targetingContains(item, value) {
+					return true
+				}
+			}
+		}
+	default:
+		text := targetingString(container)
+
+		for _, value := range lefts {
+			if targetingContains(text, value) || (value != "" && strings.Contains(text, value)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// targetingContains check the item is the value, or the item is a CIDR including the IP value
+func targetingContains(item string, value string) bool {
+	if item == value {
+		return true
+	}
+
+	if !strings.Contains(item, "/") {
+		return false
+	}
+
+	ip := net.ParseIP(value)
+
+	if ip == nil {
+		return false
+	}
+
+	_, ipNet, err := net.ParseCIDR(item)
+	return err == nil && ipNet.Contains(ip)
+}
+
+func targetingTruthy(value targetingValue) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case float64:
+		return v != 0
+	case []string:
+		return len(v) > 0
+	}
+
+	return false
+}
+
+func targetingString(value targetingValue) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []string:
+		return strings.Join(v, userGroupsSplitSep)
+	}
+
+	return ""
+}
+
+// targetingNumber the number, or the leading number of a string such as the '120.0' of '120.0.6099.71'
+func targetingNumber(value targetingValue) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		number, err := strconv.ParseFloat(targetingNumberRegexp.FindString(v), 64)
+		return number, err == nil
+	}
+
+	return 0, false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompileTargeting(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/home?lang=en", nil)
+	request.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 "+
+		"(KHTML, like Gecko) Chrome/120.0.6099.71 Safari/537.36")
+	request.Header.Set("X-App-Platform", "webview")
+	request.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+
+	ctx := &TargetingContext{Request: request, ClientIP: "10.1.2.3", UserGroups: []string{"beta"}}
+
+	tests := []struct {
+		expr    string
+		want    bool
+		wantErr bool
+	}{
+		{expr: "ua.browser == 'Chrome' && header['X-App-Platform'] == 'webview'", want: true},
+		{expr: `ua.browser != "Chrome" || header['X-App-Platform'] == 'ios'`, want: false},
+		{expr: "ua.browserVersion >= 100 && ua.browserVersion < 121", want: true},
+		{expr: "!ua.mobile && !ua.bot && ua.os == 'Windows'", want: true},
+		{expr: "'beta' in groups && !('tester' in groups)", want: true},
+		{expr: "groups in ['tester', 'admin']", want: false},
+		{expr: "ip in ['192.168.0.0/16', '10.0.0.0/8']", want: true},
+		{expr: "ip in '172.16.0.0/12'", want: false},
+		{expr: "cookie['theme'] == 'dark' && query['lang'] in ['en', 'fr'] && cookie['missing'] == ''", want: true},
+		{expr: "header['X-App-Platform']", want: true},
+		{expr: "ua.browser ==", wantErr: true},
+		{expr: "user.name == 'a'", wantErr: true},
+		{expr: "header.x == 'a'", wantErr: true},
+		{expr: "(ua.mobile", wantErr: true},
+		{expr: "ua.bot == 'true", wantErr: true},
+		{expr: "ua.bot ; true", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			rule, err := CompileTargeting(tt.expr)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CompileTargeting() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err == nil && rule.Match(ctx) != tt.want {
+				t.Errorf("Match() = %v, want %v", !tt.want, tt.want)
+			}
+		})
+	}
+}
+
+func Test_filterUserManifests_targeting(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("X-App-Platform", "webview")
+	ctx := &TargetingContext{Request: request, UserGroups: []string{"beta"}}
+
+	manifest := func(version string, extra MetadataExtra) *AppManifest {
+		return &AppManifest{ServiceName: "rmf-a", GitRevision: GitRevision{Short: version}, Extra: extra}
+	}
+	manifests := AppVersionMap{
+		"stable":  manifest("stable", MetadataExtra{}),
+		"webview": manifest("webview", MetadataExtra{targetingKey: "header['X-App-Platform'] == 'webview'"}),
+		"ios":     manifest("ios", MetadataExtra{targetingKey: "header['X-App-Platform'] == 'ios'"}),
+	}
+
+	matches, defaults := filterUserManifests(manifests, ctx.UserGroups, ctx)
+
+	if len(matches) != 1 || matches[0].App.GitRevision.Short != "webview" {
+		t.Errorf("filterUserManifests() matches = %+v, want the webview version", matches)
+	}
+
+	if len(defaults) != 1 || defaults[0].App.GitRevision.Short != "stable" {
+		t.Errorf("filterUserManifests() defaults = %+v, want the stable version", defaults)
+	}
+
+	matches, defaults = filterUserManifests(manifests, ctx.UserGroups, nil)
+
+	if len(matches) != 0 || len(defaults) != 1 {
+		t.Errorf("filterUserManifests() without request = %+v, %+v, want the stable version only", matches, defaults)
+	}
+}
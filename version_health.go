@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	beaconTypeLoadError  = "loadError"
+	beaconTypeChunkError = "chunkError"
+	beaconTypeException  = "exception"
+	beaconTypeWebVital   = "webVital"
+
+	beaconMaxBodySize = 64 * 1024
+	beaconMaxReports  = 50
+
+	healthBucketDuration = time.Minute
+)
+
+// beaconErrorTypes the report types counted as errors of the version
+var beaconErrorTypes = map[string]bool{
+	beaconTypeLoadError:  true,
+	beaconTypeChunkError: true,
+	beaconTypeException:  true,
+}
+
+// webVitalNames the Web Vitals aggregated, others are ignored
+var webVitalNames = map[string]bool{
+	"CLS":  true,
+	"FCP":  true,
+	"FID":  true,
+	"INP":  true,
+	"LCP":  true,
+	"TTFB": true,
+}
+
+// VersionHealthConfig the aggregation of the client reports by version
+type VersionHealthConfig struct {
+	Retention    int    `yaml:"retention"`    // minutes of the reports kept
+	File         string `yaml:"file"`         // persist the aggregation, empty to keep it in memory only
+	SaveInterval int    `yaml:"saveInterval"` // seconds
+	RateLimit    int    `yaml:"rateLimit"`    // beacon requests per client IP per minute
+	MaxClients   int    `yaml:"maxClients"`   // the client and version pairs kept, the oldest half is dropped when full
+
+	MaxErrorsPerSubnet int `yaml:"maxErrorsPerSubnet"` // errors of a version counted from a /24 (IPv6 /64) in the retention
+}
+
+// MergeFrom merge the values set in the YAML file
+func (conf *VersionHealthConfig) MergeFrom(other *VersionHealthConfig) {
+	if other.Retention > 0 {
+		conf.Retention = other.Retention
+	}
+
+	if other.File != "" {
+		conf.File = other.File
+	}
+
+	if other.SaveInterval > 0 {
+		conf.SaveInterval = other.SaveInterval
+	}
+
+	if other.RateLimit > 0 {
+		conf.RateLimit = other.RateLimit
+	}
+
+	if other.MaxClients > 0 {
+		conf.MaxClients = other.MaxClients
+	}
+
+	if other.MaxErrorsPerSubnet > 0 {
+		conf.MaxErrorsPerSubnet = other.MaxErrorsPerSubnet
+	}
+}
+
+// BeaconReport one client report of an app version, sent by the framework
+type BeaconReport struct {
+	Type        string      `json:"type"` // loadError, chunkError, exception or webVital
+	ServiceName string      `json:"serviceName"`
+	GitRevision GitRevision `json:"gitRevision"`
+	Name        string      `json:"name,omitempty"`  // the Web Vital, such as LCP
+	Value       float64     `json:"value,omitempty"` // the Web Vital's value
+}
+
+func checkBeaconReport(report *BeaconReport) error {
+	if report.ServiceName == "" {
+		return fmt.Errorf("Missing service name")
+	}
+
+	if report.Type == beaconTypeWebVital {
+		if !webVitalNames[report.Name] || math.IsNaN(report.Value) || math.IsInf(report.Value, 0) {
+			return fmt.Errorf("Unknown Web Vital '%s'", report.Name)
+		}
+	} else if !beaconErrorTypes[report.Type] {
+		return fmt.Errorf("Unknown report type '%s'", report.Type)
+	}
+
+	return nil
+}
+
+// parseBeaconReports parse one report, or an array of them
+func parseBeaconReports(body []byte) ([]BeaconReport, error) {
+	body = bytes.TrimSpace(body)
+	reports := []BeaconReport{}
+
+	if len(body) > 0 && body[0] == '[' {
+		if err := json.Unmarshal(body, &reports); err != nil {
+			return nil, err
+		}
+	} else {
+		var report BeaconReport
+
+		if err := json.Unmarshal(body, &report); err != nil {
+			return nil, err
+		}
+
+		reports = append(reports, report)
+	}
+
+	if len(reports) > beaconMaxReports {
+		return nil, fmt.Errorf("Too many reports %d, require at most %d", len(reports), beaconMaxReports)
+	}
+
+	return reports, nil
+}
+
+type vitalStat struct {
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+}
+
+// healthBucket the counters of a version in one minute
+type healthBucket struct {
+	Minute     int64                 `json:"minute"` // Unix time in minutes
+	Deliveries int64                 `json:"deliveries"`
+	Errors     map[string]int64      `json:"errors"`
+	Vitals     map[string]*vitalStat `json:"vitals"`
+}
+
+// VersionHealthStore the client reports and the deliveries of each version, by minute.
+//
+// The reports are sent by anyone, so only the reports of a client which was delivered the version count: the
+// client is known by the sticky ID cookie, set by the metadata calls which deliver the versions. A forged
+// sticky ID never delivered anything counts nothing, and a real client counts each error type of a version once.
+// But anyone can get new sticky IDs from the metadata calls, so the errors of a version are also counted at most
+// maxErrorsPerSubnet times from each client subnet: faking an error rate takes as many subnets as errors needed
+// divided by maxErrorsPerSubnet.
+type VersionHealthStore struct {
+	mutex    sync.Mutex
+	versions map[string][]*healthBucket // service name + "\x00" + version key to buckets, the oldest first
+
+	// sticky ID + "\x00" + health key (+ "\x00" + error type)
+	deliveredClients *clientKeys
+	reportedErrors   *clientKeys
+	subnetErrors     *clientKeys // subnet + "\x00" + health key
+}
+
+// NewVersionHealthStore new a VersionHealthStore
+func NewVersionHealthStore() *VersionHealthStore {
+	return &VersionHealthStore{
+		versions:         map[string][]*healthBucket{},
+		deliveredClients: newClientKeys(),
+		reportedErrors:   newClientKeys(),
+		subnetErrors:     newClientKeys(),
+	}
+}
+
+// clientSubnet the /24 of an IPv4 address, or the /64 of an IPv6 one. The IP itself if it's invalid
+func clientSubnet(clientIP string) string {
+	ip := net.ParseIP(clientIP)
+
+	if ip == nil {
+		return clientIP
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// clientKeys the keys counted for the clients, such as the sticky IDs delivered a version. The keys are kept in
+// two generations, and the older one is dropped as a whole: when the newer one is full, or by expire() on the
+// ticker. So the size is bounded, and the keys are never scanned on the requests
+type clientKeys struct {
+	current     map[string]int
+	previous    map[string]int
+	startMinute int64 // of the current generation
+}
+
+func newClientKeys() *clientKeys {
+	return &clientKeys{current: map[string]int{}, previous: map[string]int{}}
+}
+
+// count the key's count in both generations
+func (keys *clientKeys) count(key string) int {
+	return keys.current[key] + keys.previous[key]
+}
+
+// add count the key, a full generation (half of maxSize) is rotated first
+func (keys *clientKeys) add(key string, maxSize int, minute int64) {
+	if _, ok := keys.current[key]; !ok && len(keys.current) >= maxSize/2 {
+		keys.rotate(minute)
+	}
+
+	keys.current[key]++
+}
+
+func (keys *clientKeys) rotate(minute int64) {
+	keys.previous = keys.current
+	keys.current = map[string]int{}
+	keys.startMinute = minute
+}
+
+// expire rotate the current generation once it's half the retention old, then a key is kept from half the
+// retention to the retention
+func (keys *clientKeys) expire(minute int64, retention int64) {
+	if minute-keys.startMinute >= retention/2 {
+		keys.rotate(minute)
+	}
+}
+
+// versionHealth the version health of this process
+var versionHealth = NewVersionHealthStore()
+
+func healthKey(serviceName string, versionKey string) string {
+	return serviceName + "\x00" + versionKey
+}
+
+// bucket the version's bucket of the time, the expired buckets are dropped. NOTE: lock the store before calling
+func (store *VersionHealthStore) bucket(key string, now time.Time) *healthBucket {
+	minute := now.Unix() / int64(healthBucketDuration/time.Second)
+	buckets := store.versions[key]
+
+	if n := len(buckets); n > 0 && buckets[n-1].Minute == minute {
+		return buckets[n-1]
+	}
+
+	bucket := &healthBucket{Minute: minute, Errors: map[string]int64{}, Vitals: map[string]*vitalStat{}}
+	store.versions[key] = append(dropExpiredBuckets(buckets, minute), bucket)
+	return bucket
+}
+
+// dropExpiredBuckets the buckets in the retention, up to the minute
+func dropExpiredBuckets(buckets []*healthBucket, minute int64) []*healthBucket {
+	retention := int64(currentSiteConfig().VersionHealth.Retention)
+	expired := 0
+
+	for expired < len(buckets) && buckets[expired].Minute <= minute-retention {
+		expired++
+	}
+
+	return buckets[expired:]
+}
+
+// dropExpired drop the expired buckets, and the versions without reports, such as the uninstalled ones.
+// NOTE: lock the store before calling
+func (store *VersionHealthStore) dropExpired(now time.Time) {
+	minute := now.Unix() / int64(healthBucketDuration/time.Second)
+
+	for key, buckets := range store.versions {
+		if buckets = dropExpiredBuckets(buckets, minute); len(buckets) > 0 {
+			store.versions[key] = buckets
+		} else {
+			delete(store.versions, key)
+		}
+	}
+}
+
+// ObserveDeliveries count the versions delivered to a user, as service name to version key. The reports of the
+// versions are accepted from the sticky ID, if it's not empty
+func (store *VersionHealthStore) ObserveDeliveries(stickyID string, versions map[string]string, now time.Time) {
+	minute := now.Unix() / int64(healthBucketDuration/time.Second)
+
+	maxClients := currentSiteConfig().VersionHealth.MaxClients
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for serviceName, versionKey := range versions {
+		key := healthKey(serviceName, versionKey)
+		store.bucket(key, now).Deliveries++
+
+		if stickyID != "" {
+			store.deliveredClients.add(stickyID+"\x00"+key, maxClients, minute)
+		}
+	}
+}
+
+// ExpireClients drop the delivered clients and the reported errors older than the retention, call it on a ticker
+func (store *VersionHealthStore) ExpireClients(now time.Time) {
+	minute := now.Unix() / int64(healthBucketDuration/time.Second)
+	retention := int64(currentSiteConfig().VersionHealth.Retention)
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.deliveredClients.expire(minute, retention)
+	store.reportedErrors.expire(minute, retention)
+	store.subnetErrors.expire(minute, retention)
+}
+
+// ObserveReport count a checked client report of the sticky ID from the client IP, false if it's not counted: the
+// version was not delivered to the sticky ID in the retention, the error type is already counted for them, or
+// the subnet of the client IP has counted maxErrorsPerSubnet errors of the version
+func (store *VersionHealthStore) ObserveReport(stickyID string, clientIP string, report *BeaconReport,
+	now time.Time) bool {
+	if stickyID == "" {
+		return false
+	}
+
+	minute := now.Unix() / int64(healthBucketDuration/time.Second)
+	versionKey := healthKey(report.ServiceName, report.GitRevision.GetVersionKey())
+	conf := currentSiteConfig().VersionHealth
+	maxClients := conf.MaxClients
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.deliveredClients.count(stickyID+"\x00"+versionKey) == 0 {
+		return false
+	}
+
+	if report.Type != beaconTypeWebVital {
+		reportedKey := stickyID + "\x00" + versionKey + "\x00" + report.Type
+
+		subnetKey := clientSubnet(clientIP) + "\x00" + versionKey
+
+		if store.reportedErrors.count(reportedKey) > 0 || store.subnetErrors.count(subnetKey) >= conf.MaxErrorsPerSubnet {
+			return false
+		}
+
+		store.reportedErrors.add(reportedKey, maxClients, minute)
+		store.subnetErrors.add(subnetKey, maxClients, minute)
+		store.bucket(versionKey, now).Errors[report.Type]++
+		return true
+	}
+
+	bucket := store.bucket(versionKey, now)
+
+	stat, ok := bucket.Vitals[report.Name]
+
+	if !ok {
+		stat = &vitalStat{}
+		bucket.Vitals[report.Name] = stat
+	}
+
+	stat.Count++
+	stat.Sum += report.Value
+	return true
+}
+
+// VitalSummary a Web Vital of a version
+type VitalSummary struct {
+	Count int64   `json:"count"`
+	Mean  float64 `json:"mean"`
+}
+
+// VersionHealthSummary the reports of a version in the time window
+type VersionHealthSummary struct {
+	ServiceName string                  `json:"serviceName"`
+	VersionKey  string                  `json:"versionKey"`
+	Deliveries  int64                   `json:"deliveries"`
+	Errors      map[string]int64        `json:"errors"`
+	ErrorCount  int64                   `json:"errorCount"`
+	ErrorRate   float64                 `json:"errorRate"` // errors per delivery, at most 1
+	Vitals      map[string]VitalSummary `json:"vitals"`
+}
+
+// Summary the versions' reports since the time, by service name and version key. All services if the
+// service name is empty
+func (store *VersionHealthStore) Summary(serviceName string, since time.Time) []VersionHealthSummary {
+	sinceMinute := since.Unix() / int64(healthBucketDuration/time.Second)
+	res := []VersionHealthSummary{}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.dropExpired(time.Now())
+
+	for key, buckets := range store.versions {
+		parts := strings.SplitN(key, "\x00", 2)
+
+		if serviceName != "" && parts[0] != serviceName {
+			continue
+		}
+
+		summary := VersionHealthSummary{
+			ServiceName: parts[0],
+			VersionKey:  parts[1],
+			Errors:      map[string]int64{},
+			Vitals:      map[string]VitalSummary{},
+		}
+		vitals := map[string]*vitalStat{}
+
+		for _, bucket := range buckets {
+			if bucket.Minute < sinceMinute {
+				continue
+			}
+
+			summary.Deliveries += bucket.Deliveries
+
+			for errorType, count := range bucket.Errors {
+				summary.Errors[errorType] += count
+				summary.ErrorCount += count
+			}
+
+			for name, stat := range bucket.Vitals {
+				if _, ok := vitals[name]; !ok {
+					vitals[name] = &vitalStat{}
+				}
+
+				vitals[name].Count += stat.Count
+				vitals[name].Sum += stat.Sum
+			}
+		}
+
+		// a delivery may have errors of several types
+		if summary.Deliveries > 0 {
+			summary.ErrorRate = math.Min(float64(summary.ErrorCount)/float64(summary.Deliveries), 1)
+		}
+
+		for name, stat := range vitals {
+			summary.Vitals[name] = VitalSummary{Count: stat.Count, Mean: stat.Sum / float64(stat.Count)}
+		}
+
+		res = append(res, summary)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].ServiceName != res[j].ServiceName {
+			return res[i].ServiceName < res[j].ServiceName
+		}
+
+		return res[i].VersionKey < res[j].VersionKey
+	})
+
+	return res
+}
+
+// Save write the store to the file, replaced as a whole
+func (store *VersionHealthStore) Save(filename string) error {
+	store.mutex.Lock()
+	store.dropExpired(time.Now())
+	content, err := json.Marshal(store.versions)
+	store.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	tmpFilename := filename + ".tmp"
+
+	if err := ioutil.WriteFile(tmpFilename, content, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFilename, filename)
+}
+
+// Load read the store saved before. A missing file has nothing
+func (store *VersionHealthStore) Load(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	versions := map[string][]*healthBucket{}
+
+	if err := json.Unmarshal(content, &versions); err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	store.versions = versions
+	store.mutex.Unlock()
+	return nil
+}
+
+// saveVersionHealthPeriodically save the store on each interval, never returns
+func saveVersionHealthPeriodically(filename string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := versionHealth.Save(filename); err != nil {
+			log.Printf("[ERROR]  Cannot save version health %s: %v\n", filename, err)
+		}
+	}
+}
+
+// beaconRateLimiter count the requests of each client IP in the current minute
+type beaconRateLimiter struct {
+	mutex  sync.Mutex
+	minute int64
+	counts map[string]int
+}
+
+// allow count the request, false if the client has sent the limit in this minute
+func (limiter *beaconRateLimiter) allow(clientIP string, limit int, now time.Time) bool {
+	minute := now.Unix() / int64(time.Minute/time.Second)
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if limiter.counts == nil || minute != limiter.minute {
+		limiter.minute = minute
+		limiter.counts = map[string]int{}
+	}
+
+	if limiter.counts[clientIP] >= limit {
+		return false
+	}
+
+	limiter.counts[clientIP]++
+	return true
+}
+
+// beaconHandler receive the client reports, also from navigator.sendBeacon() whose content type is not JSON.
+// The reports of the versions not installed are ignored, and so are the reports of a version not delivered to
+// the sticky ID. Each client IP sends at most versionHealth.rateLimit requests a minute.
+func beaconHandler(cache *AppManifestCache) gin.HandlerFunc {
+	limiter := &beaconRateLimiter{}
+
+	return func(c *gin.Context) {
+		now := time.Now()
+
+		if !limiter.allow(getClientIP(c), currentSiteConfig().VersionHealth.RateLimit, now) {
+			c.Header("Retry-After", "60")
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many beacon requests"})
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, beaconMaxBodySize))
+
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+
+		reports, err := parseBeaconReports(body)
+
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		accepted := 0
+		stickyID := stickyIDFromCookie(c)
+		clientIP := getClientIP(c)
+
+		for i := range reports {
+			report := &reports[i]
+
+			if checkBeaconReport(report) != nil || !cache.hasAppVersion(report.ServiceName, &report.GitRevision) {
+				continue
+			}
+
+			if versionHealth.ObserveReport(stickyID, clientIP, report, now) {
+				accepted++
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"accepted": accepted,
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestVersionHealth_beacon(t *testing.T) {
+	versionHealth = NewVersionHealthStore()
+	cache := NewAppManifestCache()
+	v1 := GitRevision{Tag: "v1"}
+	v2 := GitRevision{Tag: "v2"}
+
+	for _, git := range []GitRevision{v1, v2} {
+		if _, err := cache.InstallAppVersion("tester", &AppInstallParam{Manifest: AppManifest{
+			ServiceName: "rmf-a", GitRevision: git, Extra: MetadataExtra{},
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	stickyID := strings.Repeat("a", 32)
+	versionHealth.ObserveDeliveries(stickyID, map[string]string{"rmf-a": v1.GetVersionKey()}, now)
+	versionHealth.ObserveDeliveries(stickyID, map[string]string{"rmf-a": v1.GetVersionKey()}, now)
+	versionHealth.ObserveDeliveries(stickyID, map[string]string{"rmf-a": v2.GetVersionKey()}, now)
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.POST("/api/metrics/beacon", beaconHandler(cache))
+
+	tests := []struct {
+		body     string
+		code     int
+		accepted string
+	}{
+		{`{"type":"chunkError","serviceName":"rmf-a","gitRevision":{"tag":"v2"}}`, http.StatusOK, `{"accepted":1}`},
+		{`[{"type":"exception","serviceName":"rmf-a","gitRevision":{"tag":"v1"}},
+			{"type":"webVital","serviceName":"rmf-a","gitRevision":{"tag":"v1"},"name":"LCP","value":1200},
+			{"type":"webVital","serviceName":"rmf-a","gitRevision":{"tag":"v1"},"name":"LCP","value":1800},
+			{"type":"exception","serviceName":"rmf-a","gitRevision":{"tag":"v9"}},
+			{"type":"unknown","serviceName":"rmf-a","gitRevision":{"tag":"v1"}}]`, http.StatusOK, `{"accepted":3}`},
+		{`not json`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		// navigator.sendBeacon() sends a string as text/plain
+		request := httptest.NewRequest(http.MethodPost, "/api/metrics/beacon", strings.NewReader(tt.body))
+		request.Header.Set("Content-Type", "text/plain;charset=UTF-8")
+		request.AddCookie(&http.Cookie{Name: stickyCookieName, Value: stickyID})
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, request)
+
+		if recorder.Code != tt.code || (tt.accepted != "" && recorder.Body.String() != tt.accepted) {
+			t.Errorf("beacon %s = %d %s, want %d %s", tt.body, recorder.Code, recorder.Body.String(), tt.code, tt.accepted)
+		}
+	}
+
+	summaries := versionHealth.Summary("rmf-a", now.Add(-time.Hour))
+
+	if len(summaries) != 2 {
+		t.Fatalf("Summary() got %d versions, want 2", len(summaries))
+	}
+
+	stable, canary := summaries[0], summaries[1]
+
+	if stable.ErrorRate != 0.5 || stable.Vitals["LCP"].Mean != 1500 || stable.Vitals["LCP"].Count != 2 {
+		t.Errorf("Summary() of v1 = %+v, want error rate 0.5 and LCP mean 1500", stable)
+	}
+
+	if canary.ErrorRate != 1 || canary.Errors[beaconTypeChunkError] != 1 {
+		t.Errorf("Summary() of v2 = %+v, want error rate 1", canary)
+	}
+}
+
+func TestVersionHealth_beaconAbuse(t *testing.T) {
+	versionHealth = NewVersionHealthStore()
+	cache := NewAppManifestCache()
+	v1 := GitRevision{Tag: "v1"}
+
+	if _, err := cache.InstallAppVersion("tester", &AppInstallParam{Manifest: AppManifest{
+		ServiceName: "rmf-a", GitRevision: v1, Extra: MetadataExtra{},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := currentSiteConfig()
+	defer storeSiteConfig(previous)
+
+	conf := previous.Clone()
+	conf.VersionHealth.RateLimit = 6
+	conf.VersionHealth.MaxErrorsPerSubnet = 3
+	storeSiteConfig(conf)
+
+	now := time.Now()
+
+	for _, stickyID := range []string{strings.Repeat("a", 32), strings.Repeat("b", 32)} {
+		versionHealth.ObserveDeliveries(stickyID, map[string]string{"rmf-a": v1.GetVersionKey()}, now)
+	}
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.POST("/api/metrics/beacon", beaconHandler(cache))
+
+	body := `[{"type":"exception","serviceName":"rmf-a","gitRevision":{"tag":"v1"}},
+		{"type":"exception","serviceName":"rmf-a","gitRevision":{"tag":"v1"}},
+		{"type":"chunkError","serviceName":"rmf-a","gitRevision":{"tag":"v1"}}]`
+
+	tests := []struct {
+		name     string
+		stickyID string
+		code     int
+		accepted string
+	}{
+		{"each type once", strings.Repeat("a", 32), http.StatusOK, `{"accepted":2}`},
+		{"counted before", strings.Repeat("a", 32), http.StatusOK, `{"accepted":0}`},
+		{"no sticky ID", "", http.StatusOK, `{"accepted":0}`},
+		{"invalid sticky ID", "forged", http.StatusOK, `{"accepted":0}`},
+		{"subnet capped", strings.Repeat("b", 32), http.StatusOK, `{"accepted":1}`},
+		{"not delivered", strings.Repeat("d", 32), http.StatusOK, `{"accepted":0}`},
+		{"rate limited", strings.Repeat("c", 32), http.StatusTooManyRequests, ""},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest(http.MethodPost, "/api/metrics/beacon", strings.NewReader(body))
+		request.RemoteAddr = "192.168.1.1:5000"
+
+		if tt.stickyID != "" {
+			request.AddCookie(&http.Cookie{Name: stickyCookieName, Value: tt.stickyID})
+		}
+
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, request)
+
+		if recorder.Code != tt.code || (tt.accepted != "" && recorder.Body.String() != tt.accepted) {
+			t.Errorf("beacon %s = %d %s, want %d %s", tt.name, recorder.Code, recorder.Body.String(), tt.code, tt.accepted)
+		}
+	}
+
+	// 3 errors of 2 deliveries
+	if summaries := versionHealth.Summary("rmf-a", now.Add(-time.Hour)); len(summaries) != 1 ||
+		summaries[0].ErrorCount != 3 || summaries[0].ErrorRate != 1 {
+		t.Errorf("Summary() = %+v, want 3 errors and error rate 1", summaries)
+	}
+}
+
+func Test_clientKeys(t *testing.T) {
+	keys := newClientKeys()
+
+	for i := 0; i < 1000; i++ {
+		keys.add(fmt.Sprintf("client-%d", i), 100, 0)
+
+		if size := len(keys.current) + len(keys.previous); size > 100 {
+			t.Fatalf("clientKeys size %d, want at most 100", size)
+		}
+	}
+
+	if keys.count("client-999") != 1 || keys.count("client-900") != 1 || keys.count("client-0") != 0 {
+		t.Errorf("clientKeys should keep the newest keys and drop the oldest")
+	}
+
+	keys.add("client-999", 100, 0)
+
+	if keys.count("client-999") != 2 {
+		t.Errorf("count() = %d, want 2", keys.count("client-999"))
+	}
+
+	// a key is kept from half the retention to the retention
+	keys.expire(89, 180)
+
+	if keys.count("client-999") != 2 {
+		t.Errorf("expire() before half the retention should keep the keys")
+	}
+
+	keys.expire(90, 180)
+	keys.expire(180, 180)
+
+	if keys.count("client-999") != 0 {
+		t.Errorf("expire() after the retention should drop the keys")
+	}
+}
+
+func Test_clientSubnet(t *testing.T) {
+	tests := []struct {
+		clientIP string
+		want     string
+	}{
+		{"192.168.1.23", "192.168.1.0"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::"},
+		{"bad", "bad"},
+	}
+	for _, tt := range tests {
+		if got := clientSubnet(tt.clientIP); got != tt.want {
+			t.Errorf("clientSubnet(%s) = %v, want %v", tt.clientIP, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	webhookEventInstall          = journalOpInstall
+	webhookEventUninstall        = journalOpUninstall
+	webhookEventUpdateExtra      = journalOpUpdateExtra
+	webhookEventRolloutStep      = "rolloutStep"
+	webhookEventSiteConfigReload = "siteConfigReload"
+	webhookEventCanaryRollback   = "canaryRollback"
+
+	webhookEventHeader    = "X-RMF-Event"
+	webhookDeliveryHeader = "X-RMF-Delivery"
+
+	webhookTimeout        = 10 * time.Second
+	webhookQueueSize      = 1000 // of each URL
+	webhookMaxBackoff     = 5 * time.Minute
+	webhookAttemptsKept   = 200
+	rolloutWatchInterval  = 10 * time.Second
+	webhookDefaultRetries = 5
+)
+
+// webhookEvents the events can be subscribed, the other ops of the journal are sent too
+var webhookEvents = map[string]bool{
+	webhookEventInstall:          true,
+	webhookEventUninstall:        true,
+	webhookEventUpdateExtra:      true,
+	journalOpSetRollout:          true,
+	journalOpInstallReleaseSet:   true,
+	journalOpUninstallReleaseSet: true,
+	journalOpUpdateReleaseSet:    true,
+	journalOpRevert:              true,
+	webhookEventRolloutStep:      true,
+	webhookEventSiteConfigReload: true,
+	webhookEventCanaryRollback:   true,
+}
+
+// WebhookConfig an HTTP endpoint receiving the signed events
+type WebhookConfig struct {
+	Name   string   `yaml:"name"`
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"` // sign the payloads when it's set
+	Events []string `yaml:"events"` // empty for all events
+}
+
+func (conf *WebhookConfig) check() error {
+	target, err := url.Parse(conf.URL)
+
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("webhook '%s' has an invalid url '%s', require http or https", conf.Name, conf.URL)
+	}
+
+	for _, event := range conf.Events {
+		if !webhookEvents[event] {
+			return fmt.Errorf("webhook '%s' has an unknown event '%s'", conf.Name, event)
+		}
+	}
+
+	return nil
+}
+
+func (conf *WebhookConfig) subscribes(event string) bool {
+	if len(conf.Events) == 0 {
+		return true
+	}
+
+	for _, item := range conf.Events {
+		if item == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WebhookPayload the JSON body of each delivery
+type WebhookPayload struct {
+	ID    string      `json:"id"`
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+// WebhookAttempt one attempt of a delivery
+type WebhookAttempt struct {
+	DeliveryID string    `json:"deliveryId"`
+	Webhook    string    `json:"webhook"`
+	Event      string    `json:"event"`
+	Attempt    int       `json:"attempt"` // from 1
+	Time       time.Time `json:"time"`
+	Status     int       `json:"status"` // HTTP status, 0 if no response
+	Error      string    `json:"error,omitempty"`
+	WillRetry  bool      `json:"willRetry"`
+}
+
+type webhookJob struct {
+	conf    WebhookConfig
+	id      string
+	event   string
+	body    []byte
+	attempt int
+}
+
+// WebhookDispatcher deliver the events asynchronously, retry the failed ones with backoff. Each URL has its own
+// queue and worker, a slow or failing endpoint only delays (or drops) its own events.
+type WebhookDispatcher struct {
+	mutex    sync.Mutex
+	lastID   int64
+	attempts []WebhookAttempt            // the newest last
+	queues   map[string]chan *webhookJob // by the URL
+	running  bool
+	client   *http.Client
+}
+
+// NewWebhookDispatcher new a WebhookDispatcher, deliver nothing until Run()
+func NewWebhookDispatcher() *WebhookDispatcher {
+	return &WebhookDispatcher{
+		queues: map[string]chan *webhookJob{},
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// webhooks the webhook dispatcher of this process
+var webhooks = NewWebhookDispatcher()
+
+// Dispatch queue the event for each subscribed webhook, never blocks
+func (dispatcher *WebhookDispatcher) Dispatch(event string, data interface{}) {
+	confs := currentSiteConfig().Webhooks
+
+	if len(confs) == 0 {
+		return
+	}
+
+	dispatcher.mutex.Lock()
+	dispatcher.lastID++
+	id := strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatInt(dispatcher.lastID, 10)
+	dispatcher.mutex.Unlock()
+
+	body, err := json.Marshal(&WebhookPayload{ID: id, Event: event, Time: time.Now(), Data: data})
+
+	if err != nil {
+		log.Printf("[ERROR]  Cannot marshal webhook event '%s': %v\n", event, err)
+		return
+	}
+
+	for _, conf := range confs {
+		if conf.subscribes(event) {
+			dispatcher.enqueue(&webhookJob{conf: conf, id: id, event: event, body: body})
+		}
+	}
+}
+
+func (dispatcher *WebhookDispatcher) enqueue(job *webhookJob) {
+	select {
+	case dispatcher.queueOf(job.conf.URL) <- job:
+	default:
+		dispatcher.record(job, 0, fmt.Errorf("the queue is full, dropped"), false)
+		log.Printf("[ERROR]  Drop webhook event '%s' to '%s', the queue is full\n", job.event, job.conf.Name)
+	}
+}
+
+// queueOf the queue of the URL, created (and delivered if running) for a new URL
+func (dispatcher *WebhookDispatcher) queueOf(url string) chan *webhookJob {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+
+	queue, ok := dispatcher.queues[url]
+
+	if !ok {
+		queue = make(chan *webhookJob, webhookQueueSize)
+		dispatcher.queues[url] = queue
+
+		if dispatcher.running {
+			go dispatcher.work(queue)
+		}
+	}
+
+	return queue
+}
+
+// Run start delivering the queued events, one worker for each URL
+func (dispatcher *WebhookDispatcher) Run() {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+
+	if dispatcher.running {
+		return
+	}
+
+	dispatcher.running = true
+
+	for _, queue := range dispatcher.queues {
+		go dispatcher.work(queue)
+	}
+}
+
+func (dispatcher *WebhookDispatcher) work(queue chan *webhookJob) {
+	for job := range queue {
+		dispatcher.deliver(job)
+	}
+}
+
+func (dispatcher *WebhookDispatcher) deliver(job *webhookJob) {
+	job.attempt++
+	status, err := dispatcher.post(job)
+	retries := currentSiteConfig().WebhookRetries
+	willRetry := err != nil && job.attempt <= retries
+	dispatcher.record(job, status, err, willRetry)
+
+	if err == nil {
+		return
+	}
+
+	if !willRetry {
+		log.Printf("[ERROR]  Webhook event '%s' to '%s' failed after %d attempts: %v\n", job.event, job.conf.Name,
+			job.attempt, err)
+		return
+	}
+
+	// 1s, 2s, 4s ... at most webhookMaxBackoff
+	backoff := time.Second << uint(job.attempt-1)
+
+	if backoff > webhookMaxBackoff || backoff <= 0 {
+		backoff = webhookMaxBackoff
+	}
+
+	time.AfterFunc(backoff, func() { dispatcher.enqueue(job) })
+}
+
+func (dispatcher *WebhookDispatcher) post(job *webhookJob) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, job.conf.URL, bytes.NewReader(job.body))
+
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(webhookEventHeader, job.event)
+	request.Header.Set(webhookDeliveryHeader, job.id)
+	request.Header.Set(hmacTimestampHeader, timestamp)
+
+	if job.conf.Secret != "" {
+		request.Header.Set(hmacSignatureHeader, hex.EncodeToString(signWebhookPayload(job.conf.Secret, timestamp, job.body)))
+	}
+
+	resp, err := dispatcher.client.Do(request)
+
+	if err != nil {
+		return 0, err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// signWebhookPayload HMAC-SHA256 of "{timestamp}\n{body}"
+func signWebhookPayload(secret string, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func (dispatcher *WebhookDispatcher) record(job *webhookJob, status int, err error, willRetry bool) {
+	attempt := WebhookAttempt{
+		DeliveryID: job.id,
+		Webhook:    job.conf.Name,
+		Event:      job.event,
+		Attempt:    job.attempt,
+		Time:       time.Now(),
+		Status:     status,
+		WillRetry:  willRetry,
+	}
+
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+
+	dispatcher.attempts = append(dispatcher.attempts, attempt)
+
+	if len(dispatcher.attempts) > webhookAttemptsKept {
+		dispatcher.attempts = append([]WebhookAttempt(nil), dispatcher.attempts[len(dispatcher.attempts)-webhookAttemptsKept:]...)
+	}
+}
+
+// Attempts the recent delivery attempts, the newest first. Only the failed ones if failedOnly
+func (dispatcher *WebhookDispatcher) Attempts(failedOnly bool) []WebhookAttempt {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+
+	res := []WebhookAttempt{}
+
+	for i := len(dispatcher.attempts) - 1; i >= 0; i-- {
+		if attempt := dispatcher.attempts[i]; !failedOnly || attempt.Error != "" {
+			res = append(res, attempt)
+		}
+	}
+
+	return res
+}
+
+// webhookMutationEvent the data of the events of AppManifestCache's mutations
+type webhookMutationEvent struct {
+	Actor    string    `json:"actor"`
+	Revision *Revision `json:"revision"`
+}
+
+// RolloutStepEvent the activation percent of a rollout changed by its schedule
+type RolloutStepEvent struct {
+	ServiceName     string      `json:"serviceName"`
+	GitRevision     GitRevision `json:"gitRevision"`
+	Percent         int         `json:"percent"`
+	PreviousPercent int         `json:"previousPercent"`
+}
+
+// watchRolloutSteps dispatch an event when the percent of a rollout changes, never returns
+func watchRolloutSteps(cache *AppManifestCache, interval time.Duration) {
+	percents := cache.rolloutPercents(time.Now())
+
+	for range time.Tick(interval) {
+		current := cache.rolloutPercents(time.Now())
+
+		for _, event := range diffRolloutPercents(percents, current) {
+			webhooks.Dispatch(webhookEventRolloutStep, event)
+		}
+
+		percents = current
+	}
+}
+
+// diffRolloutPercents the rollout steps between the percents, the new rollouts are not steps
+func diffRolloutPercents(before map[rolloutVersion]int, after map[rolloutVersion]int) []RolloutStepEvent {
+	events := []RolloutStepEvent{}
+
+	for version, percent := range after {
+		if previous, ok := before[version]; ok && previous != percent {
+			events = append(events, RolloutStepEvent{
+				ServiceName:     version.ServiceName,
+				GitRevision:     version.GitRevision,
+				Percent:         percent,
+				PreviousPercent: previous,
+			})
+		}
+	}
+
+	return events
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookDispatcher_retry(t *testing.T) {
+	var calls int32
+	received := make(chan *WebhookPayload, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		signature, _ := hex.DecodeString(r.Header.Get(hmacSignatureHeader))
+
+		if !hmac.Equal(signature, signWebhookPayload("s3cret", r.Header.Get(hmacTimestampHeader), body)) {
+			t.Errorf("the signature of %s is invalid", body)
+		}
+
+		// fail the first attempt
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		payload := &WebhookPayload{}
+		json.Unmarshal(body, payload)
+		received <- payload
+	}))
+	defer server.Close()
+
+	previous := currentSiteConfig()
+	defer storeSiteConfig(previous)
+
+	conf := previous.Clone()
+	conf.Webhooks = []WebhookConfig{
+		{Name: "deploy", URL: server.URL, Secret: "s3cret", Events: []string{webhookEventInstall}},
+	}
+	conf.WebhookRetries = 2
+	storeSiteConfig(conf)
+
+	dispatcher := NewWebhookDispatcher()
+	dispatcher.Run()
+
+	// not subscribed
+	dispatcher.Dispatch(webhookEventUninstall, map[string]string{"serviceName": "rmf-a"})
+	dispatcher.Dispatch(webhookEventInstall, map[string]string{"serviceName": "rmf-a"})
+
+	select {
+	case payload := <-received:
+		if payload.Event != webhookEventInstall || payload.Data.(map[string]interface{})["serviceName"] != "rmf-a" {
+			t.Errorf("received %+v, want the install of rmf-a", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook is not retried")
+	}
+
+	// the successful attempt is recorded after the response
+	time.Sleep(100 * time.Millisecond)
+	attempts := dispatcher.Attempts(false)
+
+	if len(attempts) != 2 || attempts[0].Attempt != 2 || attempts[0].Error != "" || attempts[0].Status != http.StatusOK {
+		t.Fatalf("Attempts() = %+v, want a failed and a successful attempt", attempts)
+	}
+
+	if failed := dispatcher.Attempts(true); len(failed) != 1 || failed[0].Status != http.StatusInternalServerError ||
+		!failed[0].WillRetry || failed[0].DeliveryID != attempts[0].DeliveryID {
+		t.Errorf("Attempts(true) = %+v, want the first attempt", failed)
+	}
+}
+
+func TestWebhookDispatcher_slowWebhook(t *testing.T) {
+	blocked := make(chan struct{})
+	received := make(chan string, 2)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-blocked
+	}))
+	defer slow.Close()
+	defer close(blocked)
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(webhookEventHeader)
+	}))
+	defer fast.Close()
+
+	previous := currentSiteConfig()
+	defer storeSiteConfig(previous)
+
+	conf := previous.Clone()
+	conf.Webhooks = []WebhookConfig{{Name: "slow", URL: slow.URL}, {Name: "fast", URL: fast.URL}}
+	storeSiteConfig(conf)
+
+	dispatcher := NewWebhookDispatcher()
+	dispatcher.Run()
+
+	// the slow webhook holds its worker, not the other's
+	dispatcher.Dispatch(webhookEventInstall, nil)
+	dispatcher.Dispatch(webhookEventUninstall, nil)
+
+	for _, want := range []string{webhookEventInstall, webhookEventUninstall} {
+		select {
+		case event := <-received:
+			if event != want {
+				t.Errorf("received %s, want %s", event, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s is not delivered while the other webhook is slow", want)
+		}
+	}
+}
+
+func TestWebhookConfig_check(t *testing.T) {
+	tests := []struct {
+		conf    WebhookConfig
+		wantErr bool
+	}{
+		{WebhookConfig{Name: "a", URL: "https://hooks.example.com/deploy"}, false},
+		{WebhookConfig{Name: "b", URL: "http://hooks.example.com", Events: []string{webhookEventRolloutStep}}, false},
+		{WebhookConfig{Name: "c", URL: "ftp://hooks.example.com"}, true},
+		{WebhookConfig{Name: "d", URL: "/deploy"}, true},
+		{WebhookConfig{Name: "e", URL: "https://hooks.example.com", Events: []string{"unknown"}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.conf.check(); (err != nil) != tt.wantErr {
+			t.Errorf("check() of %s error = %v, wantErr %v", tt.conf.Name, err, tt.wantErr)
+		}
+	}
+}
+
+func Test_diffRolloutPercents(t *testing.T) {
+	a := rolloutVersion{"rmf-a", GitRevision{Tag: "v2"}}
+	b := rolloutVersion{"rmf-b", GitRevision{Tag: "v3"}}
+	c := rolloutVersion{"rmf-c", GitRevision{Tag: "v4"}}
+
+	events := diffRolloutPercents(map[rolloutVersion]int{a: 10, b: 50}, map[rolloutVersion]int{a: 25, b: 50, c: 5})
+
+	if len(events) != 1 || events[0].ServiceName != "rmf-a" || events[0].PreviousPercent != 10 || events[0].Percent != 25 {
+		t.Errorf("diffRolloutPercents() = %+v, want rmf-a from 10 to 25", events)
+	}
+}